@@ -0,0 +1,38 @@
+package agronomy
+
+import "math"
+
+// This package has the formulas for metrics derived from temperature and humidity. Temperatures
+// are in Celsius, humidity is relative humidity in percent and pressures are in kPa
+
+// Saturation vapour pressure of air, using the Tetens equation
+func SaturationVapourPressure(tempC float64) float64 {
+	return 0.6108 * math.Exp(17.27*tempC/(tempC+237.3))
+}
+
+// Vapour pressure deficit, how much more moisture the air could hold. High values mean plants
+// lose water quickly
+func VapourPressureDeficit(tempC, humidity float64) float64 {
+	return SaturationVapourPressure(tempC) * (1 - humidity/100)
+}
+
+// Dew point, using the Magnus formula. It is undefined for perfectly dry air, which a humidity
+// sensor reading zero usually means it has failed, so false is returned rather than -Inf
+func DewPoint(tempC, humidity float64) (float64, bool) {
+	const b, c = 17.62, 243.12
+	if humidity <= 0 {
+		return 0, false
+	}
+	gamma := math.Log(humidity/100) + b*tempC/(c+tempC)
+	dewPoint := c * gamma / (b - gamma)
+	if math.IsNaN(dewPoint) || math.IsInf(dewPoint, 0) {
+		return 0, false
+	}
+	return dewPoint, true
+}
+
+// Growing degree days for a single day, using the average of the minimum and maximum
+// temperature above the crop's base temperature
+func GrowingDegreeDays(minC, maxC, baseC float64) float64 {
+	return math.Max(0, (minC+maxC)/2-baseC)
+}
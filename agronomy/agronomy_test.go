@@ -0,0 +1,40 @@
+package agronomy
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestDewPoint(t *testing.T) {
+	tests := []struct {
+		tempC, humidity float64
+		want            float64
+		ok              bool
+	}{
+		{tempC: 20, humidity: 100, want: 20, ok: true},
+		{tempC: 20, humidity: 50, want: 9.3, ok: true},
+		{tempC: 0, humidity: 80, want: -3.0, ok: true},
+		{tempC: 20, humidity: 0, ok: false},
+		{tempC: 20, humidity: -5, ok: false},
+		{tempC: 20, humidity: math.NaN(), ok: false},
+		{tempC: math.NaN(), humidity: 50, ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := DewPoint(tt.tempC, tt.humidity)
+		if ok != tt.ok {
+			t.Errorf("DewPoint(%g, %g) ok = %t, want %t", tt.tempC, tt.humidity, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if math.Abs(got-tt.want) > 0.1 {
+			t.Errorf("DewPoint(%g, %g) = %g, want %g", tt.tempC, tt.humidity, got, tt.want)
+		}
+		// Anything it returns has to be writable as JSON
+		if _, err := json.Marshal(got); err != nil {
+			t.Errorf("DewPoint(%g, %g) = %g can't be encoded: %s", tt.tempC, tt.humidity, got, err.Error())
+		}
+	}
+}
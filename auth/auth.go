@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"as2controlv2/config"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// This package checks API tokens against the configured hashes, and what each role may do
+
+// The roles a token can have, each can do everything the ones before it can
+const (
+	RoleViewer   = "viewer"   // Read endpoints
+	RoleOperator = "operator" // Water, cancel and delay
+	RoleAdmin    = "admin"    // Calibration and configuration
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// The prefix of every token hash, so other algorithms can be added later
+const hashPrefix = "sha256:"
+
+// Returned when a token doesn't match any configured one
+var ErrInvalidToken = errors.New("invalid API token")
+
+// A token that has been checked
+type Identity struct {
+	Name string
+	Role string
+}
+
+// Whether an identity's role is allowed to do what needs the given role
+func (id Identity) Allows(role string) bool {
+	return roleLevels[id.Role] >= roleLevels[role]
+}
+
+// The configured tokens
+type Store struct {
+	tokens    []config.APIToken
+	anonymous bool
+}
+
+// Load the tokens from the config and the token file, checking that every one is usable
+func StoreInit(conf config.APIConfig) (*Store, error) {
+	tokens := append([]config.APIToken{}, conf.Tokens...)
+	if conf.TokenFile != "" {
+		bytes, err := os.ReadFile(conf.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read token file: %w", err)
+		}
+		var fileTokens []config.APIToken
+		if err := json.Unmarshal(bytes, &fileTokens); err != nil {
+			return nil, fmt.Errorf("could not parse token file: %w", err)
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	names := make(map[string]bool)
+	for _, t := range tokens {
+		if _, ok := roleLevels[t.Role]; !ok {
+			return nil, fmt.Errorf("token %q has unknown role %q, use viewer, operator or admin", t.Name, t.Role)
+		}
+		if !strings.HasPrefix(t.Hash, hashPrefix) {
+			return nil, fmt.Errorf("token %q hash must start with %s", t.Name, hashPrefix)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("token name %q is used more than once", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return &Store{tokens: tokens, anonymous: conf.AllowAnonymous}, nil
+}
+
+// Whether any tokens are configured
+func (s *Store) Enabled() bool {
+	return s != nil && len(s.tokens) > 0
+}
+
+// Whether the API is open to anyone. Only when no tokens are configured and that was asked for,
+// otherwise a config without tokens refuses every request
+func (s *Store) Anonymous() bool {
+	return s != nil && len(s.tokens) == 0 && s.anonymous
+}
+
+// Check a token against every configured hash
+func (s *Store) Authenticate(token string) (Identity, error) {
+	hash := []byte(HashToken(token))
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return Identity{Name: t.Name, Role: t.Role}, nil
+		}
+	}
+	return Identity{}, ErrInvalidToken
+}
+
+// Hash a token the way it is stored in the config
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Make a new random token
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Whether a role name is valid
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
@@ -0,0 +1,188 @@
+package calibration
+
+import (
+	"as2controlv2/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// This package turns raw soil moisture sensor readings into volumetric water content, using a
+// piecewise linear curve through two or more reference points for each sensor
+
+// Name of the file in the state directory that captured curves are kept in
+const stateFile = "calibration.json"
+
+// The default volumetric water content for the reference points captured by name
+const (
+	DefaultDryValue       = 0.0
+	DefaultSaturatedValue = 45.0 // Typical for a loam at saturation
+)
+
+// The calibration curves for every sensor
+type Store struct {
+	path       string
+	mu         sync.Mutex
+	curves     map[string][]config.CalibrationPoint // Keyed by unit number and reading name
+	configured map[string][]config.CalibrationPoint // Just the curves from the config, to fall back on
+	state      map[string][]config.CalibrationPoint // Just the curves captured at runtime, these are what get saved
+}
+
+// Load the curves from the config, then any captured curves from the state directory over the top
+func StoreInit(conf config.Config) (*Store, error) {
+	s := &Store{
+		path:       filepath.Join(conf.StateDir(), stateFile),
+		curves:     make(map[string][]config.CalibrationPoint),
+		configured: configuredCurves(conf),
+		state:      make(map[string][]config.CalibrationPoint),
+	}
+	for k, points := range s.configured {
+		s.curves[k] = points
+	}
+
+	bytes, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &s.state); err != nil {
+		return nil, fmt.Errorf("could not parse calibration state: %w", err)
+	}
+	for k, points := range s.state {
+		s.curves[k] = points
+	}
+	return s, nil
+}
+
+// The curves set in the config of each unit
+func configuredCurves(conf config.Config) map[string][]config.CalibrationPoint {
+	curves := make(map[string][]config.CalibrationPoint)
+	for _, rmu := range conf.RemoteUnitConfigs {
+		for sensor, points := range rmu.SoilCalibrations {
+			curves[key(rmu.UnitNumber, sensor)] = points
+		}
+	}
+	return curves
+}
+
+// Take the config curves from a changed config. Captured curves are kept, and still take priority
+func (s *Store) Reconfigure(conf config.Config) {
+	configured := configuredCurves(conf)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configured = configured
+	s.curves = make(map[string][]config.CalibrationPoint, len(configured)+len(s.state))
+	for k, points := range configured {
+		s.curves[k] = points
+	}
+	for k, points := range s.state {
+		s.curves[k] = points
+	}
+}
+
+// Calibrate a raw reading, false if the sensor doesn't have a usable curve
+func (s *Store) Apply(unitNumber uint, sensor string, raw float64) (float64, bool) {
+	if s == nil {
+		return raw, false
+	}
+	s.mu.Lock()
+	points := s.curves[key(unitNumber, sensor)]
+	s.mu.Unlock()
+	return Apply(points, raw)
+}
+
+// Add a reference point to a sensor's curve and save it. A point with the same value replaces the
+// old one, so capturing the dry point again overwrites it
+func (s *Store) AddPoint(unitNumber uint, sensor string, p config.CalibrationPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(unitNumber, sensor)
+	points := make([]config.CalibrationPoint, 0)
+	for _, existing := range s.curves[k] {
+		if existing.Value != p.Value {
+			points = append(points, existing)
+		}
+	}
+	points = append(points, p)
+	sort.Slice(points, func(i, j int) bool { return points[i].Raw < points[j].Raw })
+	s.curves[k] = points
+	s.state[k] = points
+	return s.save()
+}
+
+// Remove the captured curve of a sensor, falling back to its config curve if it has one
+func (s *Store) Reset(unitNumber uint, sensor string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := key(unitNumber, sensor)
+	if points, ok := s.configured[k]; ok {
+		s.curves[k] = points
+	} else {
+		delete(s.curves, k)
+	}
+	delete(s.state, k)
+	return s.save()
+}
+
+// Get a copy of every curve, keyed by unit number and reading name
+func (s *Store) Curves() map[string][]config.CalibrationPoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	curves := make(map[string][]config.CalibrationPoint, len(s.curves))
+	for k, points := range s.curves {
+		curves[k] = append([]config.CalibrationPoint(nil), points...)
+	}
+	return curves
+}
+
+// Save the captured curves to the state directory. Must be called with the lock held
+func (s *Store) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, bytes, 0644)
+}
+
+// Calibrate a raw reading against a curve by interpolating between the points either side of it,
+// or extrapolating from the nearest two. The result is clamped to 0 to 100 percent. False if
+// there are fewer than two distinct points
+func Apply(points []config.CalibrationPoint, raw float64) (float64, bool) {
+	sorted := append([]config.CalibrationPoint(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Raw < sorted[j].Raw })
+	if len(sorted) < 2 || sorted[0].Raw == sorted[len(sorted)-1].Raw {
+		return raw, false
+	}
+
+	// Find the segment to use, the end segments are used for extrapolation
+	i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Raw >= raw })
+	i = min(max(i, 1), len(sorted)-1)
+	lo, hi := sorted[i-1], sorted[i]
+	// Step past duplicate raw values, which would divide by zero
+	for lo.Raw == hi.Raw && i < len(sorted)-1 {
+		i++
+		lo, hi = sorted[i-1], sorted[i]
+	}
+	for lo.Raw == hi.Raw && i > 1 {
+		i--
+		lo, hi = sorted[i-1], sorted[i]
+	}
+
+	value := lo.Value + (raw-lo.Raw)*(hi.Value-lo.Value)/(hi.Raw-lo.Raw)
+	return math.Min(math.Max(value, 0), 100), true
+}
+
+// The key a sensor's curve is stored under
+func key(unitNumber uint, sensor string) string {
+	return fmt.Sprintf("%d/%s", unitNumber, sensor)
+}
@@ -0,0 +1,77 @@
+package calibration
+
+import (
+	"as2controlv2/config"
+	"testing"
+)
+
+// A store with a config curve for the first sensor of unit 1, saving to a temporary directory
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	conf := config.Config{
+		StateDirectory: t.TempDir(),
+		RemoteUnitConfigs: []config.RemoteUnitConfig{{
+			UnitNumber: 1,
+			SoilCalibrations: map[string][]config.CalibrationPoint{
+				"soil_1": {{Raw: 800, Value: 0}, {Raw: 400, Value: 40}},
+			},
+		}},
+	}
+	s, err := StoreInit(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Resetting a captured curve goes back to the config curve, or to none if there isn't one
+func TestReset(t *testing.T) {
+	s := testStore(t)
+	for _, sensor := range []string{"soil_1", "soil_2"} {
+		for _, p := range []config.CalibrationPoint{{Raw: 900, Value: 0}, {Raw: 300, Value: 45}} {
+			if err := s.AddPoint(1, sensor, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Reset(1, sensor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v, ok := s.Apply(1, "soil_1", 600); !ok || v != 20 {
+		t.Errorf("soil_1 calibrated to %g, %t after reset, want 20 from the config curve", v, ok)
+	}
+	if _, ok := s.Apply(1, "soil_2", 600); ok {
+		t.Error("soil_2 still has a curve after reset")
+	}
+}
+
+// A changed config curve is used straight away, unless a curve has been captured for the sensor
+func TestReconfigure(t *testing.T) {
+	s := testStore(t)
+	for _, p := range []config.CalibrationPoint{{Raw: 900, Value: 0}, {Raw: 300, Value: 60}} {
+		if err := s.AddPoint(1, "soil_2", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Reconfigure(config.Config{RemoteUnitConfigs: []config.RemoteUnitConfig{{
+		UnitNumber: 1,
+		SoilCalibrations: map[string][]config.CalibrationPoint{
+			"soil_1": {{Raw: 1000, Value: 0}, {Raw: 500, Value: 50}},
+			"soil_2": {{Raw: 800, Value: 0}, {Raw: 400, Value: 40}},
+		},
+	}}})
+
+	if v, _ := s.Apply(1, "soil_1", 600); v != 40 {
+		t.Errorf("soil_1 calibrated to %g, want 40 from the new config curve", v)
+	}
+	if v, _ := s.Apply(1, "soil_2", 600); v != 30 {
+		t.Errorf("soil_2 calibrated to %g, want 30 from the captured curve", v)
+	}
+	if err := s.Reset(1, "soil_2"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Apply(1, "soil_2", 600); v != 20 {
+		t.Errorf("soil_2 calibrated to %g after reset, want 20 from the new config curve", v)
+	}
+}
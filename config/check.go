@@ -0,0 +1,368 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Check a config file as it was written, as well as the config it resolves to. This finds what
+// loading quietly ignores: unknown and misspelt keys, keys given twice and values of the wrong
+// type. The config as written is returned, it is only usable if none of the problems are errors
+func Check(data []byte, format string) (Config, []Problem) {
+	data, err := ToJSON(data, format)
+	if err != nil {
+		return Config{}, []Problem{{Message: err.Error(), Fix: "check the " + format + " syntax just before it"}}
+	}
+	var problems []Problem
+	data, migrations, err := Migrate(data)
+	if err != nil {
+		return Config{}, []Problem{{Path: "schema_version", Message: err.Error(), Fix: "upgrade the control system"}}
+	}
+	if len(migrations) > 0 {
+		problems = append(problems, Problem{
+			Path:    "schema_version",
+			Message: fmt.Sprintf("the file is schema version %d, it is migrated to %d as it is loaded", migrations[0].From, CurrentSchemaVersion),
+			Fix:     "run migrate-config to update the file",
+			Warning: true,
+		})
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := checkValue(dec, "", reflect.TypeOf(Config{}), &problems); err != nil {
+		return Config{}, []Problem{syntaxProblem(data, err)}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return Config{}, []Problem{{Message: "there is more after the config", Fix: "remove everything after the closing }"}}
+	}
+
+	// Values of the wrong type are already reported, everything else still loads
+	var conf Config
+	err = json.Unmarshal(data, &conf)
+	var typeErr *json.UnmarshalTypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		return Config{}, append(problems, syntaxProblem(data, err))
+	}
+	resolved, resolveProblems := resolve(conf)
+	problems = append(problems, resolveProblems...)
+	reported := make(map[string]bool, len(problems))
+	for _, p := range problems {
+		reported[p.Path] = true
+	}
+	for _, p := range resolved.Problems() {
+		// A value that couldn't be loaded is left as zero, which is already explained
+		if !reported[p.Path] {
+			problems = append(problems, p)
+		}
+	}
+	return conf, problems
+}
+
+// Check the things the config refers to outside of itself, such as the serial port and the
+// InfluxDB and OpenWeatherMap servers. These are only warnings as the system waits for them
+func CheckReachable(conf Config, timeout time.Duration) []Problem {
+	var problems []Problem
+	if conf.SerialConfig.Port != "" {
+		if _, err := os.Stat(conf.SerialConfig.Port); err != nil {
+			problems = append(problems, Problem{Path: "serial_config.serial_port", Message: fmt.Sprintf("can't be opened: %s", err.Error()), Fix: "check the serial module is plugged in and the port name", Warning: true})
+		}
+	}
+	if conf.API.TokenFile != "" {
+		if _, err := os.Stat(conf.API.TokenFile); err != nil {
+			// Startup fails without it, so this is not just a warning
+			problems = append(problems, Problem{Path: "api.token_file", Message: fmt.Sprintf("can't be read: %s", err.Error()), Fix: "make the file with the tokens in it, or remove token_file"})
+		}
+	}
+	if conf.Storage.uses("influxdb") {
+		problems = append(problems, checkDial("influxdb_config.url", conf.DatabaseConfig.URL, timeout)...)
+	}
+	problems = append(problems, checkDial("weather_api_config.url", conf.WeatherAPIConfig.URL, timeout)...)
+	return problems
+}
+
+// Check that a connection can be made to the host of a URL
+func checkDial(path, value string, timeout time.Duration) []Problem {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		// Already reported by Validate
+		return nil
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return []Problem{{Path: path, Message: fmt.Sprintf("can't be reached: %s", err.Error()), Fix: "check the address and that the server is running", Warning: true}}
+	}
+	conn.Close()
+	return nil
+}
+
+// Read the next value from the decoder, checking it against the type it will be loaded into
+func checkValue(dec *json.Decoder, path string, t reflect.Type, problems *[]Problem) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '{' {
+			return checkObject(dec, path, t, problems)
+		}
+		if t.Kind() != reflect.Slice {
+			*problems = append(*problems, typeProblem(path, t, "a list"))
+			return skipRest(dec)
+		}
+		for i := 0; dec.More(); i++ {
+			if err := checkValue(dec, fmt.Sprintf("%s[%d]", path, i), t.Elem(), problems); err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	case json.Number:
+		switch t.Kind() {
+		case reflect.Float32, reflect.Float64:
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if _, err := tok.Int64(); err != nil {
+				*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("%s is not a whole number", tok), Fix: "leave out the fraction"})
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if n, err := tok.Int64(); err != nil {
+				*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("%s is not a whole number", tok), Fix: "leave out the fraction"})
+			} else if n < 0 {
+				*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("%s is negative", tok), Fix: "use zero or more"})
+			}
+		default:
+			*problems = append(*problems, typeProblem(path, t, "a number"))
+		}
+	case string:
+		if t.Kind() != reflect.String {
+			*problems = append(*problems, typeProblem(path, t, "a string"))
+		}
+	case bool:
+		if t.Kind() != reflect.Bool {
+			*problems = append(*problems, typeProblem(path, t, "true or false"))
+		}
+	case nil:
+		// null leaves the value as it is
+	}
+	return nil
+}
+
+// Read the keys of an object, the opening brace has already been read
+func checkObject(dec *json.Decoder, path string, t reflect.Type, problems *[]Problem) error {
+	if t.Kind() != reflect.Struct && t.Kind() != reflect.Map {
+		*problems = append(*problems, typeProblem(path, t, "an object"))
+		return skipRest(dec)
+	}
+	fields := jsonFields(t)
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			// Only possible if the decoder has lost its place, stop rather than report nonsense
+			*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("expected a key, found %v", tok), Fix: "check the object's keys are quoted strings"})
+			return skipRest(dec)
+		}
+		keyPath := join(path, key)
+		if seen[key] {
+			*problems = append(*problems, Problem{Path: keyPath, Message: "is given more than once, only the last one is used", Fix: "remove the others"})
+		}
+		seen[key] = true
+
+		if t.Kind() == reflect.Map {
+			if err := checkValue(dec, keyPath, t.Elem(), problems); err != nil {
+				return err
+			}
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			// Loading matches keys ignoring case, so these are still used
+			for name, f := range fields {
+				if strings.EqualFold(name, key) {
+					*problems = append(*problems, Problem{Path: keyPath, Message: "only matches a key ignoring case", Fix: fmt.Sprintf("rename it to %s", name), Warning: true})
+					field, ok = f, true
+					break
+				}
+			}
+		}
+		if !ok {
+			*problems = append(*problems, unknownKeyProblem(keyPath, key, fields))
+			if err := skip(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := checkValue(dec, keyPath, field, problems); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// The JSON keys of a struct and the type each is loaded into
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func unknownKeyProblem(path, key string, fields map[string]reflect.Type) Problem {
+	// Suggest the closest key, if one is close enough to be a typo
+	best, bestDistance := "", len(key)/3+1
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if d := editDistance(key, name); d <= bestDistance && (best == "" || d < editDistance(key, best)) {
+			best = name
+		}
+	}
+	if best != "" {
+		return Problem{Path: path, Message: "unknown key, it is ignored", Fix: fmt.Sprintf("did you mean %s?", best), Warning: true}
+	}
+	return Problem{Path: path, Message: "unknown key, it is ignored", Fix: "remove it", Warning: true}
+}
+
+func typeProblem(path string, t reflect.Type, got string) Problem {
+	var want string
+	switch t.Kind() {
+	case reflect.String:
+		want = "a string"
+	case reflect.Bool:
+		want = "true or false"
+	case reflect.Slice:
+		want = "a list"
+	case reflect.Struct, reflect.Map:
+		want = "an object"
+	default:
+		want = "a number"
+	}
+	fix := "use " + want
+	if want == "a number" && got == "a string" {
+		fix = "remove the quotes around the number"
+	}
+	return Problem{Path: path, Message: fmt.Sprintf("should be %s, not %s", want, got), Fix: fix}
+}
+
+// Skip the next value
+func skip(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); ok && (d == '{' || d == '[') {
+		return skipRest(dec)
+	}
+	return nil
+}
+
+// Skip the rest of an object or list, the opening delimiter has already been read
+func skipRest(dec *json.Decoder) error {
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+	}
+	return nil
+}
+
+// Point at where in the file the JSON can't be read
+func syntaxProblem(data []byte, err error) Problem {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := position(data, syntaxErr.Offset)
+		return Problem{Message: fmt.Sprintf("line %d column %d: %s", line, column, syntaxErr.Error()), Fix: "check for a missing comma or quote, or a trailing comma, just before it"}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return Problem{Message: "the file ends part way through the config", Fix: "check every { and [ is closed"}
+	}
+	return Problem{Message: err.Error()}
+}
+
+func position(data []byte, offset int64) (int, int) {
+	line, column := 1, 1
+	for _, b := range data[:min(int(offset), len(data))] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// The number of single character edits between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// Malformed configs must be reported, never crash the checker
+func TestCheckMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		format  string
+		path    string // Where the problem is expected, anywhere if empty
+		warning bool   // Whether the problem there is only a warning
+	}{
+		{name: "list for object", input: `{"serial_config": [1, 2]}`, format: FormatJSON, path: "serial_config"},
+		{name: "nested list for object", input: `{"serial_config": [[1], {"a": [2]}], "name": "x"}`, format: FormatJSON, path: "serial_config"},
+		{name: "object for list", input: `{"remote_configs": {"a": 1}}`, format: FormatJSON, path: "remote_configs"},
+		{name: "list for number", input: `{"serial_config": {"baud_rate": [1]}}`, format: FormatJSON, path: "serial_config.baud_rate"},
+		{name: "object for string", input: `{"name": {"a": [1, {"b": 2}]}}`, format: FormatJSON, path: "name"},
+		{name: "list for bool", input: `{"remote_configs": [{"disabled": [true]}]}`, format: FormatJSON, path: "remote_configs[0].disabled"},
+		{name: "top level list", input: `[1, 2]`, format: FormatJSON},
+		{name: "top level string", input: `"config"`, format: FormatJSON},
+		{name: "top level number", input: `3`, format: FormatJSON},
+		{name: "truncated", input: `{"serial_config": {"baud_rate": 9600`, format: FormatJSON},
+		{name: "truncated list", input: `{"serial_config": [1, 2`, format: FormatJSON},
+		{name: "unclosed key", input: `{"serial_config`, format: FormatJSON},
+		{name: "trailing comma", input: `{"name": "x",}`, format: FormatJSON},
+		{name: "extra after config", input: `{"name": "x"} {}`, format: FormatJSON},
+		{name: "empty", input: ``, format: FormatJSON},
+		{name: "string for number", input: `{"remote_interval_seconds": "60"}`, format: FormatJSON, path: "remote_interval_seconds"},
+		{name: "fraction for whole number", input: `{"remote_interval_seconds": 1.5}`, format: FormatJSON, path: "remote_interval_seconds"},
+		{name: "negative for unsigned", input: `{"remote_interval_seconds": -1}`, format: FormatJSON, path: "remote_interval_seconds"},
+		{name: "duplicate key", input: `{"schema_version": 2, "name": "x", "name": "y"}`, format: FormatJSON, path: "name"},
+		{name: "unknown key", input: `{"nmae": "x"}`, format: FormatJSON, path: "nmae", warning: true},
+		{name: "yaml list for object", input: "serial_config:\n  - 1\n  - 2\n", format: FormatYAML, path: "serial_config"},
+		{name: "bad yaml", input: "serial_config: [1,\n", format: FormatYAML},
+		{name: "toml list for object", input: "serial_config = [1, 2]\n", format: FormatTOML, path: "serial_config"},
+		{name: "bad toml", input: "serial_config = \n", format: FormatTOML},
+		{name: "unknown format", input: `{}`, format: "ini"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, problems := Check([]byte(tt.input), tt.format)
+			if tt.path == "" {
+				if !HasErrors(problems) {
+					t.Errorf("no errors reported: %v", problems)
+				}
+				return
+			}
+			for _, p := range problems {
+				if p.Path == tt.path && p.Warning == tt.warning {
+					return
+				}
+			}
+			t.Errorf("no problem at %s with warning %t: %v", tt.path, tt.warning, problems)
+		})
+	}
+}
+
+// A mistyped value is skipped whole, so the keys after it are still checked
+func TestCheckContinuesAfterMistypedValue(t *testing.T) {
+	_, problems := Check([]byte(`{"serial_config": [1, [2, 3], {"a": 4}], "nmae": "x"}`), FormatJSON)
+	found := false
+	for _, p := range problems {
+		if p.Path == "nmae" && strings.Contains(p.Fix, "name") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the key after the list was not checked: %v", problems)
+	}
+}
+
+func TestCheckValidConfig(t *testing.T) {
+	conf := MakeExampleConfig()
+	for _, format := range Formats {
+		data, err := Encode(conf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, problems := Check(data, format); HasErrors(problems) {
+			t.Errorf("%s: %v", format, problems)
+		}
+	}
+}
@@ -2,37 +2,220 @@ package config
 
 import (
 	"encoding/json"
+	"os"
+	"time"
 )
 
 // Struct that stores the configuration for the control system
 type Config struct {
+	SchemaVersion          int                  `json:"schema_version"` // The layout of the config, older ones are migrated as they are loaded
 	Name                   string               `json:"name"`
 	Mode                   string               `json:"mode"` // This can be either automatic, or manual
 	WeatherIntervalSeconds uint                 `json:"weather_scrape_interval"`
 	RemoteIntervalSeconds  uint                 `json:"remote_interval_seconds"`
+	StateDirectory         string               `json:"state_dir,omitempty"` // Where the system keeps state between runs, defaults to ./state
 	SerialConfig           SerialConfig         `json:"serial_config"`
 	DatabaseConfig         InfluxDBConfig       `json:"influxdb_config"`
 	WeatherAPIConfig       OpenWeatherMapConfig `json:"weather_api_config"`
 	RemoteUnitConfigs      []RemoteUnitConfig   `json:"remote_configs"`
+	WeatherWarnings        WeatherWarningConfig `json:"weather_warnings"`
+	WateringWindows        []WateringWindow     `json:"watering_windows,omitempty"` // When automatic watering may start, any time if empty
+	WateringPolicy         WateringPolicy       `json:"watering_policy"`            // How units are watered automatically, units can override it
+	Storage                StorageConfig        `json:"storage"`
+	Agronomy               AgronomyConfig       `json:"agronomy"`
+	API                    APIConfig            `json:"api"`
+}
+
+// Access to the HTTP API
+type APIConfig struct {
+	Tokens         []APIToken `json:"tokens,omitempty"`          // Tokens that can use the API, see allow_anonymous for when there are none here or in the token file
+	TokenFile      string     `json:"token_file,omitempty"`      // A JSON list of more tokens, so they can be kept out of the main config
+	TrustedProxies []string   `json:"trusted_proxies,omitempty"` // Proxies allowed to set the client address, none are trusted if empty
+	AllowAnonymous bool       `json:"allow_anonymous,omitempty"` // Let anyone use the API when no tokens are configured, otherwise every request is refused
+	AllowedOrigins []string   `json:"allowed_origins,omitempty"` // Other sites whose pages may open the event WebSocket, such as https://dashboard.example.com
+}
+
+// A token that can use the API. Only a hash of the token is kept, see the token command
+type APIToken struct {
+	Name string `json:"name"` // Who the token belongs to, recorded against everything it changes
+	Role string `json:"role"` // One of viewer, operator or admin
+	Hash string `json:"hash"` // sha256: followed by the hex digest of the token
+}
+
+// Settings for the derived agronomic metrics
+type AgronomyConfig struct {
+	SeasonStart string    `json:"season_start,omitempty"`     // YYYY-MM-DD that growing degree days are accumulated from, defaults to 30 days ago
+	BaseTempsC  []float64 `json:"gdd_base_temps_c,omitempty"` // Crop base temperatures to accumulate growing degree days for, defaults to 10
+	HighVPDKPa  float64   `json:"high_vpd_kpa,omitempty"`     // Vapour pressure deficit above this stresses plants, defaults to 2
+	LowVPDKPa   float64   `json:"low_vpd_kpa,omitempty"`      // Vapour pressure deficit below this risks fungal disease, defaults to 0.4
+}
+
+// Fill in any agronomy settings that were not configured
+func (a AgronomyConfig) WithDefaults() AgronomyConfig {
+	if len(a.BaseTempsC) == 0 {
+		a.BaseTempsC = []float64{10}
+	}
+	if a.HighVPDKPa == 0 {
+		a.HighVPDKPa = 2
+	}
+	if a.LowVPDKPa == 0 {
+		a.LowVPDKPa = 0.4
+	}
+	return a
+}
+
+// Where metrics are stored
+type StorageConfig struct {
+	Backends       []string `json:"backends,omitempty"`         // Any of influxdb and file, defaults to influxdb
+	FilePath       string   `json:"file_path,omitempty"`        // Where the file backend writes to, defaults to metrics.jsonl in the state directory
+	QueuePath      string   `json:"queue_path,omitempty"`       // Where InfluxDB writes are queued, defaults to influxdb_queue.jsonl in the state directory
+	QueueMaxPoints uint     `json:"queue_max_points,omitempty"` // Oldest points are dropped beyond this, defaults to 100000
 }
 
 type RemoteUnitConfig struct {
-	UnitName   string `json:"name"`
-	UnitNumber uint   `json:"number"`
+	UnitName        string           `json:"name"`
+	UnitNumber      uint             `json:"number"`
+	WateringWindows []WateringWindow `json:"watering_windows,omitempty"` // Overrides the system watering windows for this unit
+	GDDBaseTempsC   []float64        `json:"gdd_base_temps_c,omitempty"` // Overrides the system crop base temperatures for this unit
+	MapPosition     *MapPosition     `json:"map_position,omitempty"`     // Where the zone is drawn on the dashboard map, laid out in a grid if not set
+	WateringPolicy  *WateringPolicy  `json:"watering_policy,omitempty"`  // Overrides the parts of the system watering policy it sets
+	Disabled        bool             `json:"disabled,omitempty"`         // Not polled or watered, but kept in the config
+
+	// Calibration curves for each soil moisture sensor, keyed by the reading name the unit reports.
+	// Curves captured through the API or calibrate command are kept in the state directory and
+	// take precedence over these
+	SoilCalibrations map[string][]CalibrationPoint `json:"soil_calibrations,omitempty"`
+}
+
+// How a unit is watered automatically
+type WateringPolicy struct {
+	ThresholdPercent float64 `json:"threshold_percent,omitempty"` // Soil moisture below this is watered, defaults to 25
+	TargetPercent    float64 `json:"target_percent,omitempty"`    // Watering stops early once the soil moisture reaches this, defaults to 40
+	DurationSeconds  uint    `json:"duration_seconds,omitempty"`  // How long each watering runs for, defaults to 30
+}
+
+// Fill in any of the policy that was not configured
+func (p WateringPolicy) WithDefaults() WateringPolicy {
+	if p.ThresholdPercent == 0 {
+		p.ThresholdPercent = 25
+	}
+	if p.TargetPercent == 0 {
+		p.TargetPercent = 40
+	}
+	if p.DurationSeconds == 0 {
+		p.DurationSeconds = 30
+	}
+	return p
 }
 
+// How long each watering runs for
+func (p WateringPolicy) Duration() time.Duration {
+	return time.Duration(p.DurationSeconds) * time.Second
+}
+
+// Override the policy with whatever is set in a unit's policy
+func (p WateringPolicy) Override(unit *WateringPolicy) WateringPolicy {
+	if unit == nil {
+		return p
+	}
+	if unit.ThresholdPercent != 0 {
+		p.ThresholdPercent = unit.ThresholdPercent
+	}
+	if unit.TargetPercent != 0 {
+		p.TargetPercent = unit.TargetPercent
+	}
+	if unit.DurationSeconds != 0 {
+		p.DurationSeconds = unit.DurationSeconds
+	}
+	return p
+}
+
+// A position on the dashboard map, as percentages of its width and height from the top left
+type MapPosition struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// A single point on a soil moisture calibration curve
+type CalibrationPoint struct {
+	Raw   float64 `json:"raw"`   // What the sensor reports
+	Value float64 `json:"value"` // The volumetric water content in percent
+}
+
+// A period relative to sunrise or sunset that automatic watering may start in
+type WateringWindow struct {
+	Event           string `json:"event"`            // Either sunrise or sunset
+	OffsetMinutes   int    `json:"offset_minutes"`   // When the window opens relative to the event, negative is before
+	DurationMinutes uint   `json:"duration_minutes"` // How long the window stays open for
+}
+
+// The solar events a watering window can be relative to
+const (
+	SolarEventSunrise = "sunrise"
+	SolarEventSunset  = "sunset"
+)
+
 type InfluxDBConfig struct {
 	URL          string `json:"url"`
-	Organisation string `json:"string"`
+	Organisation string `json:"organisation"`
 	Bucket       string `json:"bucket"`
 	Token        string `json:"token"`
 }
 
 type OpenWeatherMapConfig struct {
-	URL       string  `json:"url"`
-	Token     string  `json:"token"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	URL               string  `json:"url"`
+	Token             string  `json:"token"`
+	Latitude          float64 `json:"latitude"`
+	Longitude         float64 `json:"longitude"`
+	Location          string  `json:"location,omitempty"`            // Place name such as "Townsville,QLD,AU", used instead of the coordinates
+	Postcode          string  `json:"postcode,omitempty"`            // Postcode and country such as "4810,AU", used instead of the coordinates
+	TimeoutSeconds    uint    `json:"timeout_sec,omitempty"`         // Per request timeout, defaults to 10 seconds
+	MaxRetries        uint    `json:"max_retries,omitempty"`         // Retries after the first attempt, defaults to 3
+	StaleAfterSeconds uint    `json:"stale_after_seconds,omitempty"` // Age after which weather is stale, defaults to 2 hours
+}
+
+// Thresholds for the weather warnings, and what to do when each one is raised
+type WeatherWarningConfig struct {
+	ForecastHours uint              `json:"forecast_hours"`            // How far ahead to look in the forecast
+	HeatwaveTempC *float64          `json:"heatwave_temp_c,omitempty"` // Forecast maximum at or above this is a heatwave
+	FrostTempC    *float64          `json:"frost_temp_c,omitempty"`    // Forecast minimum at or below this is a frost risk, 0 is a threshold like any other
+	HeavyRainMM   *float64          `json:"heavy_rain_mm,omitempty"`   // Rain in a 3 hour period at or above this is heavy
+	HighWindMS    *float64          `json:"high_wind_ms,omitempty"`    // Wind at or above this should not be watered in
+	Actions       map[string]string `json:"actions,omitempty"`         // Warning type (heatwave, frost, heavy_rain, high_wind) to action
+}
+
+// The actions that a weather warning can trigger
+const (
+	WeatherActionNone         = "none"          // Only raise the warning
+	WeatherActionPreWater     = "pre_water"     // Water every zone now, ahead of the weather
+	WeatherActionSkipWatering = "skip_watering" // Hold off any automatic watering while the warning is active
+	WeatherActionFrostProtect = "frost_protect" // Water every zone shortly before the frost is expected
+)
+
+// Fill in any thresholds that were not configured. A threshold that was set to 0 is kept, only
+// missing ones are filled in, so every threshold is set afterwards
+func (w WeatherWarningConfig) WithDefaults() WeatherWarningConfig {
+	if w.ForecastHours == 0 {
+		w.ForecastHours = 24
+	}
+	w.HeatwaveTempC = orDefault(w.HeatwaveTempC, 35)
+	w.FrostTempC = orDefault(w.FrostTempC, 2)
+	w.HeavyRainMM = orDefault(w.HeavyRainMM, 10)
+	w.HighWindMS = orDefault(w.HighWindMS, 10)
+	return w
+}
+
+// Get a threshold, or the default if it was not configured
+func orDefault(v *float64, def float64) *float64 {
+	if v == nil {
+		return &def
+	}
+	return v
+}
+
+// Make a threshold for a config
+func threshold(v float64) *float64 {
+	return &v
 }
 
 type SerialConfig struct {
@@ -41,13 +224,40 @@ type SerialConfig struct {
 	TimeoutSeconds uint   `json:"timeout_sec"`
 }
 
+// The state directory used when one is not configured
+const DefaultStateDirectory = "./state"
+
+// Get the directory the system keeps its state in
+func (c Config) StateDir() string {
+	if c.StateDirectory == "" {
+		return DefaultStateDirectory
+	}
+	return c.StateDirectory
+}
+
+// Copy the config, so a change to the copy can't reach the running one through a shared slice or map
+func (c Config) Clone() Config {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		// Every field is plain data so this can't happen
+		panic(err)
+	}
+	var clone Config
+	if err := json.Unmarshal(bytes, &clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
 // Make an example configuration, for the example arg
 func MakeExampleConfig() Config {
 	return Config{
+		SchemaVersion:          CurrentSchemaVersion,
 		Mode:                   "automatic",
 		Name:                   "example_system_config",
 		WeatherIntervalSeconds: 3600,
 		RemoteIntervalSeconds:  60,
+		StateDirectory:         DefaultStateDirectory,
 		SerialConfig: SerialConfig{
 			Port:           "/dev/ttyS0",
 			BaudRate:       115200,
@@ -60,15 +270,62 @@ func MakeExampleConfig() Config {
 			Token:        "my_super_long_token",
 		},
 		WeatherAPIConfig: OpenWeatherMapConfig{
-			URL:       "http://api.openweathermap.org",
-			Token:     "my_super_long_open_weathermap_config",
-			Latitude:  -19.2569391,
-			Longitude: 146.8239537,
+			URL:               "http://api.openweathermap.org",
+			Token:             "my_super_long_open_weathermap_config",
+			Latitude:          -19.2569391,
+			Longitude:         146.8239537,
+			Location:          "Townsville,QLD,AU",
+			TimeoutSeconds:    10,
+			MaxRetries:        3,
+			StaleAfterSeconds: 7200,
+		},
+		Storage: StorageConfig{
+			Backends: []string{"influxdb"},
+		},
+		WateringPolicy: WateringPolicy{
+			ThresholdPercent: 25,
+			TargetPercent:    40,
+			DurationSeconds:  30,
+		},
+		Agronomy: AgronomyConfig{
+			SeasonStart: "2024-09-01",
+			BaseTempsC:  []float64{10},
+			HighVPDKPa:  2,
+			LowVPDKPa:   0.4,
+		},
+		WeatherWarnings: WeatherWarningConfig{
+			ForecastHours: 24,
+			HeatwaveTempC: threshold(35),
+			FrostTempC:    threshold(2),
+			HeavyRainMM:   threshold(10),
+			HighWindMS:    threshold(10),
+			Actions: map[string]string{
+				"heatwave":   WeatherActionPreWater,
+				"frost":      WeatherActionFrostProtect,
+				"heavy_rain": WeatherActionSkipWatering,
+				"high_wind":  WeatherActionSkipWatering,
+			},
+		},
+		WateringWindows: []WateringWindow{
+			{
+				// From an hour before sunrise until an hour after
+				Event:           SolarEventSunrise,
+				OffsetMinutes:   -60,
+				DurationMinutes: 120,
+			},
+			{
+				// For two hours after sunset
+				Event:           SolarEventSunset,
+				OffsetMinutes:   0,
+				DurationMinutes: 120,
+			},
 		},
 		RemoteUnitConfigs: []RemoteUnitConfig{
 			{
 				UnitName:   "unit_1",
 				UnitNumber: 1,
+				// Where the unit is drawn on the dashboard's zone map
+				MapPosition: &MapPosition{X: 20, Y: 30},
 			},
 			{
 				UnitName:   "unit_2",
@@ -109,9 +366,27 @@ func LoadConfig(bytes []byte) (Config, error) {
 	return conf, nil
 }
 
+// Load a config file in any format, as it is written but migrated to the current schema. See Resolve for the config to run with
+func LoadConfigFile(path string) (Config, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	bytes, err = ToJSON(bytes, FormatOf(path))
+	if err != nil {
+		return Config{}, err
+	}
+	bytes, _, err = Migrate(bytes)
+	if err != nil {
+		return Config{}, err
+	}
+	return LoadConfig(bytes)
+}
+
 // Make the config used throughout testing
 func MakeTestingConfig() Config {
 	return Config{
+		SchemaVersion:          CurrentSchemaVersion,
 		Name:                   "example_system_config",
 		Mode:                   "automatic",
 		WeatherIntervalSeconds: 3600,
@@ -125,12 +400,12 @@ func MakeTestingConfig() Config {
 			URL:          "http://192.168.77.196:8086",
 			Organisation: "Water_Monitoring",
 			Bucket:       "testing",
-			// Token:        "1vCqkEI_vBPdjuoOBrFNI5JA2yIV3C8DnD2C3KyWpgq3XWkdAXM7cHbo2fAxh5jZt2ppFhD2Q1PRoO99bBuArw==",
-			Token: "xw90rybGcwte4JMCM608fCwUMPtnHaVt6kpLMAgml9osFOR7BAdUi8XzGrxQTD3yT_MSq11OL8gXG2fav3pHkQ==",
+			// Tokens are never kept in the source, set them in the environment
+			Token: "env:INFLUXDB_TOKEN",
 		},
 		WeatherAPIConfig: OpenWeatherMapConfig{
 			URL:       "http://api.openweathermap.org",
-			Token:     "4805d72f92a507f6872ebcc184915143",
+			Token:     "env:OPENWEATHERMAP_TOKEN",
 			Latitude:  -19.2569391,
 			Longitude: 146.8239537,
 		},
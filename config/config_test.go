@@ -0,0 +1,44 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Thresholds that are set are kept even at zero, a frost threshold of 0 is common
+func TestWeatherWarningDefaults(t *testing.T) {
+	tests := []struct {
+		input                 string
+		frost, heatwave, rain float64
+	}{
+		{input: `{}`, frost: 2, heatwave: 35, rain: 10},
+		{input: `{"frost_temp_c": 0}`, frost: 0, heatwave: 35, rain: 10},
+		{input: `{"frost_temp_c": -3, "heavy_rain_mm": 0}`, frost: -3, heatwave: 35, rain: 0},
+		{input: `{"frost_temp_c": null, "heatwave_temp_c": 30}`, frost: 2, heatwave: 30, rain: 10},
+	}
+	for _, tt := range tests {
+		var w WeatherWarningConfig
+		if err := json.Unmarshal([]byte(tt.input), &w); err != nil {
+			t.Fatal(err)
+		}
+		d := w.WithDefaults()
+		if *d.FrostTempC != tt.frost || *d.HeatwaveTempC != tt.heatwave || *d.HeavyRainMM != tt.rain {
+			t.Errorf("%s: frost %g, heatwave %g, rain %g, want %g, %g, %g", tt.input, *d.FrostTempC, *d.HeatwaveTempC, *d.HeavyRainMM, tt.frost, tt.heatwave, tt.rain)
+		}
+	}
+}
+
+// A config written back out keeps the thresholds that were set, and leaves the rest to default
+func TestWeatherWarningRoundTrip(t *testing.T) {
+	var w WeatherWarningConfig
+	if err := json.Unmarshal([]byte(`{"frost_temp_c": 0}`), &w); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"forecast_hours":0,"frost_temp_c":0}`; string(data) != want {
+		t.Errorf("written as %s, want %s", data, want)
+	}
+}
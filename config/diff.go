@@ -0,0 +1,161 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Values that are never shown in a diff, only that they changed
+var secretKeys = map[string]bool{"token": true, "hash": true}
+
+// A value that differs between two configs
+type Change struct {
+	Path string      `json:"path"` // The JSON path, such as remote_configs[1].name
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("%s: added %s", c.Path, describeValue(c.New))
+	case c.New == nil:
+		return fmt.Sprintf("%s: removed %s", c.Path, describeValue(c.Old))
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Path, describeValue(c.Old), describeValue(c.New))
+}
+
+// Describe each change, for logging and the version history
+func describe(changes []Change) []string {
+	descriptions := make([]string, len(changes))
+	for i, c := range changes {
+		descriptions[i] = c.String()
+	}
+	return descriptions
+}
+
+func describeValue(v interface{}) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(bytes)
+}
+
+// The values that differ between two configs, by JSON path and in path order. Secrets are
+// redacted
+func Diff(old, new Config) []Change {
+	changes := make([]Change, 0)
+	diffValues("", generic(old), generic(new), &changes)
+	sortChanges(changes)
+	return changes
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
+
+// Whether anything under a top level key of the config changed
+func Changed(changes []Change, key string) bool {
+	for _, c := range changes {
+		if c.Path == key || strings.HasPrefix(c.Path, key+".") || strings.HasPrefix(c.Path, key+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// The config as plain maps, slices and values, as it would be written out
+func generic(c Config) interface{} {
+	var v interface{}
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(bytes, &v); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func diffValues(path string, old, new interface{}, changes *[]Change) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		for k, v := range oldMap {
+			diffValues(join(path, k), v, newMap[k], changes)
+		}
+		for k, v := range newMap {
+			if _, ok := oldMap[k]; !ok {
+				diffValues(join(path, k), nil, v, changes)
+			}
+		}
+		return
+	}
+	oldSlice, oldIsSlice := old.([]interface{})
+	newSlice, newIsSlice := new.([]interface{})
+	if oldIsSlice && newIsSlice {
+		for i := 0; i < len(oldSlice) || i < len(newSlice); i++ {
+			var o, n interface{}
+			if i < len(oldSlice) {
+				o = oldSlice[i]
+			}
+			if i < len(newSlice) {
+				n = newSlice[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), o, n, changes)
+		}
+		return
+	}
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+	if secretKeys[lastKey(path)] {
+		old, new = redacted(old), redacted(new)
+	}
+	*changes = append(*changes, Change{Path: path, Old: redact(old), New: redact(new)})
+}
+
+// Redact the secrets in a whole object that was added or removed
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			if secretKeys[k] {
+				out[k] = redacted(value)
+			} else {
+				out[k] = redact(value)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = redact(value)
+		}
+		return out
+	}
+	return v
+}
+
+func redacted(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return "(redacted)"
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func lastKey(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
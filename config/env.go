@@ -0,0 +1,206 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Every config value can be overridden by an environment variable named after its path with this
+// prefix, in upper case with anything but letters and digits as underscores. Such as
+// AS2_SERIAL_CONFIG_SERIAL_PORT, AS2_REMOTE_CONFIGS_0_NAME or AS2_WEATHER_WARNINGS_ACTIONS_FROST.
+// Lists and objects are given as JSON, lists of plain values can also be comma separated
+const EnvPrefix = "AS2"
+
+// Secrets, the values under the token and hash keys, can be read from elsewhere rather than
+// written in the config. Such as file:/run/secrets/influxdb_token or env:INFLUXDB_TOKEN
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+)
+
+// The config the system runs with: the config as written with the environment overrides and
+// secret references applied. Only the config as written is kept in the history and written back
+// to the file, so a secret never ends up in either
+func Resolve(conf Config) (Config, error) {
+	resolved, problems := resolve(conf)
+	if len(problems) > 0 {
+		return Config{}, &ValidationError{Problems: problems}
+	}
+	return resolved, nil
+}
+
+func resolve(conf Config) (Config, []Problem) {
+	var problems []Problem
+	doc := override("", reflect.TypeOf(conf), generic(conf), &problems)
+	doc = resolveSecrets("", doc, &problems)
+
+	bytes, err := json.Marshal(doc)
+	if err != nil {
+		return Config{}, append(problems, Problem{Message: err.Error()})
+	}
+	var resolved Config
+	if err := json.Unmarshal(bytes, &resolved); err != nil {
+		return Config{}, append(problems, Problem{Message: err.Error()})
+	}
+	return resolved, problems
+}
+
+// The environment variable that overrides the value at a path
+func EnvName(path string) string {
+	parts := strings.FieldsFunc(path, func(r rune) bool {
+		return !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9')
+	})
+	return strings.ToUpper(strings.Join(append([]string{EnvPrefix}, parts...), "_"))
+}
+
+// Override a value, and anything inside it, from the environment
+func override(path string, t reflect.Type, v interface{}, problems *[]Problem) interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	name := EnvName(path)
+	if env, ok := os.LookupEnv(name); ok && path != "" {
+		parsed, err := parseEnv(env, t)
+		if err != nil {
+			*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("%s: %s", name, err.Error()), Fix: fmt.Sprintf("fix or unset %s", name)})
+		} else {
+			v = parsed
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, _ := v.(map[string]interface{})
+		created := m == nil
+		if created {
+			m = make(map[string]interface{})
+		}
+		for key, field := range jsonFields(t) {
+			if child := override(join(path, key), field, m[key], problems); child != nil {
+				m[key] = child
+			}
+		}
+		if created && len(m) == 0 {
+			// Don't make an empty object where there wasn't one
+			return nil
+		}
+		return m
+	case reflect.Slice:
+		list, _ := v.([]interface{})
+		for i := range list {
+			list[i] = override(fmt.Sprintf("%s[%d]", path, i), t.Elem(), list[i], problems)
+		}
+	case reflect.Map:
+		m, _ := v.(map[string]interface{})
+		// Keys can be added as well as overridden
+		for _, env := range os.Environ() {
+			envName, _, _ := strings.Cut(env, "=")
+			if key, ok := strings.CutPrefix(envName, name+"_"); ok && key != "" {
+				if m == nil {
+					m = make(map[string]interface{})
+				}
+				key = strings.ToLower(key)
+				m[key] = override(join(path, key), t.Elem(), m[key], problems)
+			}
+		}
+		if m != nil {
+			return m
+		}
+	}
+	return v
+}
+
+// Parse an environment variable as a value of a config field
+func parseEnv(env string, t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return env, nil
+	case reflect.Bool:
+		return strconv.ParseBool(env)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(env, 10, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a whole number", env)
+		}
+		return json.Number(env), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(env, 10, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a whole number of zero or more", env)
+		}
+		return json.Number(env), nil
+	case reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(env, 64); err != nil {
+			return nil, fmt.Errorf("%q is not a number", env)
+		}
+		return json.Number(env), nil
+	case reflect.Slice:
+		elem := t.Elem()
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		if !strings.HasPrefix(strings.TrimSpace(env), "[") && elem.Kind() != reflect.Struct && elem.Kind() != reflect.Slice && elem.Kind() != reflect.Map {
+			list := make([]interface{}, 0)
+			for _, item := range strings.Split(env, ",") {
+				value, err := parseEnv(strings.TrimSpace(item), elem)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, value)
+			}
+			return list, nil
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(env), &v); err != nil {
+		return nil, fmt.Errorf("is not valid JSON: %s", err.Error())
+	}
+	return v, nil
+}
+
+// Replace the secret references in a value with the secrets
+func resolveSecrets(path string, v interface{}, problems *[]Problem) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			s, ok := child.(string)
+			if !secretKeys[k] || !ok {
+				value[k] = resolveSecrets(join(path, k), child, problems)
+				continue
+			}
+			secret, err := readSecret(s)
+			if err != nil {
+				*problems = append(*problems, Problem{Path: join(path, k), Message: err.Error(), Fix: "check the secret is available to the control system, or give the value itself"})
+				continue
+			}
+			value[k] = secret
+		}
+	case []interface{}:
+		for i, child := range value {
+			value[i] = resolveSecrets(fmt.Sprintf("%s[%d]", path, i), child, problems)
+		}
+	}
+	return v
+}
+
+// Read a secret reference, anything else is the secret itself
+func readSecret(s string) (string, error) {
+	if file, ok := strings.CutPrefix(s, secretFilePrefix); ok {
+		bytes, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read the secret: %w", err)
+		}
+		// Files written by hand or echo usually end in a newline
+		return strings.TrimSpace(string(bytes)), nil
+	}
+	if name, ok := strings.CutPrefix(s, secretEnvPrefix); ok {
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("the secret's environment variable %s is not set", name)
+		}
+		return secret, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// The formats a config file can be written in. The keys are the same in each
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Every config format
+var Formats = []string{FormatJSON, FormatYAML, FormatTOML}
+
+// The format of a config file from its extension, JSON unless it is .yaml, .yml or .toml
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// Convert a config in any format to JSON, so it can be checked and loaded the same way
+func ToJSON(data []byte, format string) ([]byte, error) {
+	var v interface{}
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("could not parse YAML: %w", err)
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &v); err != nil {
+			var decodeErr *toml.DecodeError
+			if errors.As(err, &decodeErr) {
+				row, column := decodeErr.Position()
+				return nil, fmt.Errorf("could not parse TOML at line %d column %d: %w", row, column, err)
+			}
+			return nil, fmt.Errorf("could not parse TOML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %q, use one of %s", format, strings.Join(Formats, ", "))
+	}
+	if v == nil {
+		// An empty file
+		v = map[string]interface{}{}
+	}
+	return json.Marshal(v)
+}
+
+// Write a config out in any format
+func Encode(conf Config, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		// JSON is YAML, so it is read as it is to keep the keys in order, then written out in
+		// block style
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		blockStyle(&node)
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), enc.Close()
+	case FormatTOML:
+		// Numbers are kept as integers where they are, rather than every one being a float
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return toml.Marshal(tomlNumbers(v))
+	}
+	return nil, fmt.Errorf("unknown config format %q, use one of %s", format, strings.Join(Formats, ", "))
+}
+
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+func tomlNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			v[k] = tomlNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = tomlNumbers(value)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		n, _ := v.Float64()
+		return n
+	}
+	return v
+}
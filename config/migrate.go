@@ -0,0 +1,165 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The schema version of configs written by this version of the system. Older configs are
+// upgraded as they are loaded, see Migrate
+const CurrentSchemaVersion = 2
+
+// An upgrade from one schema version to the next
+type Migration struct {
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	Summary string `json:"summary"`
+}
+
+type migration struct {
+	summary string
+	apply   func(doc map[string]interface{})
+}
+
+// The upgrade from each schema version to the next, the first is from version 1. Configs from
+// before there was a schema version are version 1
+var migrations = []migration{
+	{
+		summary: "rename influxdb_config.string to organisation, remove ble_address and soil_type from the units as they were never used, and write out the default watering policy and weather warning thresholds",
+		apply: func(doc map[string]interface{}) {
+			fillDefaults(doc, "watering_policy", WateringPolicy{}.WithDefaults())
+			fillDefaults(doc, "weather_warnings", WeatherWarningConfig{}.WithDefaults())
+			if db, ok := doc["influxdb_config"].(map[string]interface{}); ok {
+				renameKey(db, "string", "organisation")
+			}
+			units, _ := doc["remote_configs"].([]interface{})
+			for _, u := range units {
+				if unit, ok := u.(map[string]interface{}); ok {
+					delete(unit, "ble_address")
+					delete(unit, "soil_type")
+				}
+			}
+		},
+	},
+}
+
+// Upgrade a config, as JSON, to the current schema version. The migrations that were applied are
+// returned, if there were none the config is returned as it is. Configs that can't be read are
+// also returned as they are, for loading to report why
+func Migrate(data []byte) ([]byte, []Migration, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Numbers are kept exactly as they were written
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return data, nil, nil
+	}
+	version := 1
+	if v, ok := doc["schema_version"].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil {
+			return data, nil, nil
+		}
+		version = max(int(n), 1)
+	}
+	if version > CurrentSchemaVersion {
+		return nil, nil, fmt.Errorf("schema version %d is newer than this version of the system understands, which is %d", version, CurrentSchemaVersion)
+	}
+	if version == CurrentSchemaVersion {
+		return data, nil, nil
+	}
+
+	var applied []Migration
+	for v := version; v < CurrentSchemaVersion; v++ {
+		m := migrations[v-1]
+		m.apply(doc)
+		applied = append(applied, Migration{From: v, To: v + 1, Summary: m.summary})
+	}
+	doc["schema_version"] = CurrentSchemaVersion
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrated, applied, nil
+}
+
+// What migrating a config file did
+type MigrationResult struct {
+	From       int
+	Migrations []Migration
+	Changes    []Change // Everything that is different in the file, including unknown keys that were dropped
+}
+
+// Upgrade a config file to the current schema version. Unless dryRun is set it is rewritten in
+// place in the same format, with the old file kept as a backup
+func MigrateFile(path string, dryRun bool) (MigrationResult, error) {
+	var result MigrationResult
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return result, err
+	}
+	data, err := ToJSON(original, FormatOf(path))
+	if err != nil {
+		return result, err
+	}
+	migrated, applied, err := Migrate(data)
+	if err != nil {
+		return result, err
+	}
+	result.From = CurrentSchemaVersion
+	if len(applied) > 0 {
+		result.From = applied[0].From
+	}
+	result.Migrations = applied
+
+	conf, err := LoadConfig(migrated)
+	if err != nil {
+		return result, fmt.Errorf("could not load the migrated config: %w", err)
+	}
+	var old interface{}
+	if err := json.Unmarshal(data, &old); err != nil {
+		return result, err
+	}
+	diffValues("", old, generic(conf), &result.Changes)
+	sortChanges(result.Changes)
+	if dryRun || len(result.Changes) == 0 {
+		return result, nil
+	}
+	return result, writeFile(path, conf)
+}
+
+// Set any of the values in an object that are missing. Values that were set are kept, even to zero
+func fillDefaults(doc map[string]interface{}, key string, defaults interface{}) {
+	bytes, err := json.Marshal(defaults)
+	if err != nil {
+		panic(err)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(bytes, &values); err != nil {
+		panic(err)
+	}
+	m, ok := doc[key].(map[string]interface{})
+	if !ok {
+		doc[key] = values
+		return
+	}
+	for k, v := range values {
+		if _, present := m[k]; !present {
+			m[k] = v
+		}
+	}
+}
+
+// Rename a key in an object, unless the new key is already set
+func renameKey(m map[string]interface{}, from, to string) {
+	v, ok := m[from]
+	if !ok {
+		return
+	}
+	delete(m, from)
+	if _, ok := m[to]; !ok {
+		m[to] = v
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const version1Config = `{
+	"name": "test",
+	"influxdb_config": {"url": "http://localhost:8086", "string": "org", "bucket": "b", "token": "t"},
+	"remote_configs": [{"name": "unit_1", "unit_number": 1, "ble_address": "aa:bb", "soil_type": "clay"}],
+	"weather_warnings": {"frost_temp_c": 0, "forecast_hours": 12}
+}`
+
+func TestMigrate(t *testing.T) {
+	migrated, applied, err := Migrate([]byte(version1Config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].From != 1 || applied[0].To != 2 {
+		t.Fatalf("applied %v, want the migration from 1 to 2", applied)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(migrated, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if v := doc["schema_version"]; v != float64(CurrentSchemaVersion) {
+		t.Errorf("schema_version = %v, want %d", v, CurrentSchemaVersion)
+	}
+	db := doc["influxdb_config"].(map[string]interface{})
+	if _, ok := db["string"]; ok || db["organisation"] != "org" {
+		t.Errorf("influxdb_config = %v, want string renamed to organisation", db)
+	}
+	unit := doc["remote_configs"].([]interface{})[0].(map[string]interface{})
+	for _, key := range []string{"ble_address", "soil_type"} {
+		if _, ok := unit[key]; ok {
+			t.Errorf("unit still has %s", key)
+		}
+	}
+
+	// Values that were set are kept, even to zero, and only the missing ones are filled in
+	warnings := doc["weather_warnings"].(map[string]interface{})
+	want := map[string]interface{}{"frost_temp_c": 0.0, "forecast_hours": 12.0, "heatwave_temp_c": 35.0, "heavy_rain_mm": 10.0, "high_wind_ms": 10.0}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("weather_warnings = %v, want %v", warnings, want)
+	}
+	if _, ok := doc["watering_policy"].(map[string]interface{}); !ok {
+		t.Error("the watering policy defaults were not written out")
+	}
+
+	conf, err := LoadConfig(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frost := *conf.WeatherWarnings.WithDefaults().FrostTempC; frost != 0 {
+		t.Errorf("frost threshold = %g after loading, want 0", frost)
+	}
+}
+
+// Configs already at the current version are left exactly as they are
+func TestMigrateCurrent(t *testing.T) {
+	data := []byte(`{"schema_version": 2, "name": "test", "weather_warnings": {"frost_temp_c": 0}}`)
+	migrated, applied, err := Migrate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 || string(migrated) != string(data) {
+		t.Errorf("migrated to %s with %v, want it unchanged", migrated, applied)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	if _, _, err := Migrate([]byte(`{"schema_version": 99}`)); err == nil {
+		t.Error("no error for a config from a newer version")
+	}
+}
+
+// Migrating a file rewrites it in place, keeping the original as a backup
+func TestMigrateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(version1Config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := MigrateFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.From != 1 || len(result.Changes) == 0 {
+		t.Fatalf("dry run result = %+v, want changes from version 1", result)
+	}
+	if data, _ := os.ReadFile(path); string(data) != version1Config {
+		t.Fatal("a dry run changed the file")
+	}
+
+	if _, err := MigrateFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path + ".bak"); string(data) != version1Config {
+		t.Error("the backup is not the original file")
+	}
+	result, err = MigrateFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Migrations) != 0 || len(result.Changes) != 0 {
+		t.Errorf("the migrated file still needs %v: %v", result.Migrations, result.Changes)
+	}
+}
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory in the state directory that every applied version of the config is kept in
+const versionsDir = "config_versions"
+
+// A version of the config that was applied
+type Version struct {
+	Version int       `json:"version"`
+	At      time.Time `json:"at"`
+	By      string    `json:"by"`                // Who made the change, such as token:alice
+	Summary string    `json:"summary"`           // What was changed
+	Changes []string  `json:"changes,omitempty"` // Each value that changed from the previous version
+}
+
+// A version along with the config it applied, as kept on disk
+type versionRecord struct {
+	Version
+	Config Config `json:"config"`
+}
+
+// The running config, the file it came from and its history. Changes are validated, recorded,
+// applied, then written back to the file with the previous file kept as a backup
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	dir      string
+	current  Config
+	running  Config // The current config resolved, as it was applied
+	versions []Version
+}
+
+// Load the version history from the state directory. The loaded config is recorded as a new
+// version if it differs from the last one, such as after the file was edited by hand. running is
+// the loaded config as it was resolved
+func StoreInit(path string, conf, running Config) (*Store, error) {
+	s := &Store{
+		path:    path,
+		dir:     filepath.Join(conf.StateDir(), versionsDir),
+		current: conf,
+		running: running,
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		record, err := s.readRecord(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.versions = append(s.versions, record.Version)
+	}
+	sort.Slice(s.versions, func(i, j int) bool { return s.versions[i].Version < s.versions[j].Version })
+
+	var changes []string
+	if len(s.versions) > 0 {
+		last, err := s.Load(s.versions[len(s.versions)-1].Version)
+		if err != nil {
+			return nil, err
+		}
+		changes = describe(Diff(last, conf))
+		if len(changes) == 0 {
+			return s, nil
+		}
+	}
+	if _, err := s.record(conf, "file", fmt.Sprintf("loaded from %s", path), changes); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The running config and its version
+func (s *Store) Current() (Config, Version) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current.Clone(), s.versions[len(s.versions)-1]
+}
+
+// Every version, oldest first
+func (s *Store) Versions() []Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Version(nil), s.versions...)
+}
+
+// The config of an earlier version
+func (s *Store) Load(version int) (Config, error) {
+	record, err := s.readRecord(s.versionPath(version))
+	if errors.Is(err, os.ErrNotExist) {
+		return Config{}, ErrUnknownVersion
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	return record.Config, nil
+}
+
+// Returned by Load for a version that was never applied
+var ErrUnknownVersion = errors.New("no such config version")
+
+// The file the config is kept in
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Change the running config. The change is made to a copy, which is resolved and validated then
+// handed to apply to put it into effect. It is only kept, and written to the file, if apply succeeds
+func (s *Store) Update(by, summary string, change func(*Config) error, apply func(Config) error) (Version, error) {
+	return s.update(by, summary, change, apply, true)
+}
+
+// Replace the running config with one read from the file, such as after it was edited. It is
+// validated and applied like any other change, but the file is left as it is
+func (s *Store) Replace(by, summary string, conf Config, apply func(Config) error) (Version, error) {
+	return s.update(by, summary, func(c *Config) error {
+		*c = conf
+		return nil
+	}, apply, false)
+}
+
+func (s *Store) update(by, summary string, change func(*Config) error, apply func(Config) error, write bool) (Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.current.Clone()
+	if err := change(&next); err != nil {
+		return Version{}, err
+	}
+	// The store keeps the config as written, it is the resolved one that is checked and run
+	resolved, err := Resolve(next)
+	if err != nil {
+		return Version{}, err
+	}
+	if err := resolved.Validate(); err != nil {
+		return Version{}, err
+	}
+	changes := Diff(s.current, next)
+	if len(changes) == 0 {
+		// The config as written is the same, but a secret or an environment override it refers
+		// to may have changed. Secrets are redacted in the history like any other change
+		changes = Diff(s.running, resolved)
+	}
+	if len(changes) == 0 {
+		// Nothing to apply, don't clutter the history
+		return s.versions[len(s.versions)-1], nil
+	}
+	// It is recorded before it is applied, so whatever is running is always in the history. If it
+	// can't be applied the record is taken back out
+	v, err := s.writeRecord(next, by, summary, describe(changes))
+	if err != nil {
+		return Version{}, err
+	}
+	if err := apply(resolved); err != nil {
+		if removeErr := os.Remove(s.versionPath(v.Version)); removeErr != nil {
+			return Version{}, fmt.Errorf("%w, and could not remove its record: %s", err, removeErr.Error())
+		}
+		return Version{}, err
+	}
+	s.versions = append(s.versions, v)
+	s.current = next
+	s.running = resolved
+	// It is running now, so it is kept even if the file can't be written
+	if !write {
+		return v, nil
+	}
+	if err := writeFile(s.path, next); err != nil {
+		return v, fmt.Errorf("applied but could not save to %s: %w", s.path, err)
+	}
+	return v, nil
+}
+
+// Write the config to a file in its format, keeping the previous file as a backup. The new file
+// is written alongside and renamed over the old one, so a crash can't leave it half written.
+// Comments in YAML and TOML files are not kept. The file keeps the permissions it had, a new one
+// is only readable by its owner as it can hold secrets
+func writeFile(path string, conf Config) error {
+	bytes, err := Encode(conf, FormatOf(path))
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+		old, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := writeWithMode(path+".bak", old, mode); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := writeWithMode(tmp, bytes, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Write a file with exactly the given permissions, whatever the umask or an earlier file had
+func writeWithMode(path string, data []byte, mode os.FileMode) error {
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// Keep a version of the config in the history, and make it the current one
+func (s *Store) record(conf Config, by, summary string, changes []string) (Version, error) {
+	v, err := s.writeRecord(conf, by, summary, changes)
+	if err != nil {
+		return Version{}, err
+	}
+	s.versions = append(s.versions, v)
+	s.current = conf
+	return v, nil
+}
+
+// Write the next version of the config to the history, without making it the current one
+func (s *Store) writeRecord(conf Config, by, summary string, changes []string) (Version, error) {
+	v := Version{Version: 1, At: time.Now(), By: by, Summary: summary, Changes: changes}
+	if len(s.versions) > 0 {
+		v.Version = s.versions[len(s.versions)-1].Version + 1
+	}
+	bytes, err := json.MarshalIndent(versionRecord{Version: v, Config: conf}, "", "  ")
+	if err != nil {
+		return Version{}, err
+	}
+	if err := os.WriteFile(s.versionPath(v.Version), bytes, 0o600); err != nil {
+		return Version{}, err
+	}
+	return v, nil
+}
+
+func (s *Store) versionPath(version int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.json", version))
+}
+
+// Read a version from the history. Versions kept before a schema change are migrated, so they can
+// still be rolled back to
+func (s *Store) readRecord(path string) (versionRecord, error) {
+	var record versionRecord
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return record, err
+	}
+	var raw struct {
+		Version
+		Config json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return record, fmt.Errorf("could not parse config version %s: %w", filepath.Base(path), err)
+	}
+	migrated, _, err := Migrate(raw.Config)
+	if err != nil {
+		return record, fmt.Errorf("could not migrate config version %s: %w", filepath.Base(path), err)
+	}
+	record.Version = raw.Version
+	if err := json.Unmarshal(migrated, &record.Config); err != nil {
+		return record, fmt.Errorf("could not parse config version %s: %w", filepath.Base(path), err)
+	}
+	return record, nil
+}
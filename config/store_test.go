@@ -0,0 +1,151 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	dir := t.TempDir()
+	conf := MakeExampleConfig()
+	conf.StateDirectory = filepath.Join(dir, "state")
+	path := filepath.Join(dir, "config.json")
+	if err := writeFile(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	s, err := StoreInit(path, conf, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func rename(name string) func(*Config) error {
+	return func(c *Config) error {
+		c.Name = name
+		return nil
+	}
+}
+
+// A change that can't be applied leaves no trace in the history
+func TestStoreApplyFailure(t *testing.T) {
+	s := testStore(t)
+	failed := errors.New("could not apply")
+	_, err := s.Update("test", "rename", rename("renamed"), func(Config) error { return failed })
+	if !errors.Is(err, failed) {
+		t.Fatalf("err = %v, want %v", err, failed)
+	}
+	if len(s.Versions()) != 1 {
+		t.Errorf("%d versions, want 1", len(s.Versions()))
+	}
+	if conf, _ := s.Current(); conf.Name == "renamed" {
+		t.Error("the change was kept")
+	}
+	if _, err := s.Load(2); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("the record of the change was kept: %v", err)
+	}
+
+	// The next change gets the version the failed one would have had
+	v, err := s.Update("test", "rename", rename("renamed"), func(Config) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 2 {
+		t.Errorf("version = %d, want 2", v.Version)
+	}
+}
+
+// A change that can't be recorded is never applied
+func TestStoreRecordFailure(t *testing.T) {
+	s := testStore(t)
+	if err := os.RemoveAll(s.dir); err != nil {
+		t.Fatal(err)
+	}
+	applied := false
+	_, err := s.Update("test", "rename", rename("renamed"), func(Config) error {
+		applied = true
+		return nil
+	})
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if applied {
+		t.Error("the change was applied")
+	}
+	if conf, _ := s.Current(); conf.Name == "renamed" {
+		t.Error("the change was kept")
+	}
+}
+
+// Saving a config keeps the permissions the file had
+func TestWriteFileKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(path, MakeExampleConfig()); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + ".bak"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0o640 {
+			t.Errorf("%s has mode %o, want 640", filepath.Base(p), mode)
+		}
+	}
+
+	// A new file is only readable by its owner
+	path = filepath.Join(t.TempDir(), "new.json")
+	if err := writeFile(path, MakeExampleConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("new file has mode %o, want 600", mode)
+	}
+}
+
+// Re-reading an unchanged file applies a secret that changed behind it, without recording the
+// secret itself
+func TestStoreSecretChanged(t *testing.T) {
+	t.Setenv("INFLUXDB_TOKEN", "old-secret")
+	s := testStore(t)
+	conf, _ := s.Current()
+	conf.DatabaseConfig.Token = "env:INFLUXDB_TOKEN"
+	resolved, err := Resolve(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.current, s.running = conf, resolved
+
+	var applied Config
+	apply := func(c Config) error {
+		applied = c
+		return nil
+	}
+	if v, err := s.Replace("test", "reload", conf, apply); err != nil || v.Version != 1 {
+		t.Fatalf("version %d with %v, want nothing applied while the secret is the same", v.Version, err)
+	}
+
+	t.Setenv("INFLUXDB_TOKEN", "new-secret")
+	v, err := s.Replace("test", "reload", conf, apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 2 || applied.DatabaseConfig.Token != "new-secret" {
+		t.Fatalf("version %d applied token %q, want version 2 with the new secret", v.Version, applied.DatabaseConfig.Token)
+	}
+	want := `influxdb_config.token: "(redacted)" -> "(redacted)"`
+	if len(v.Changes) != 1 || v.Changes[0] != want {
+		t.Errorf("changes = %v, want %s", v.Changes, want)
+	}
+}
@@ -0,0 +1,420 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A problem with a config, at the JSON path it was found
+type Problem struct {
+	Path    string `json:"path"`              // Such as remote_configs[1].number
+	Message string `json:"message"`           // What is wrong
+	Fix     string `json:"fix,omitempty"`     // What to change to fix it
+	Warning bool   `json:"warning,omitempty"` // The system can run with it, but it is probably a mistake
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = fmt.Sprintf("%s: %s", p.Path, p.Message)
+	}
+	if p.Fix != "" {
+		s = fmt.Sprintf("%s (%s)", s, p.Fix)
+	}
+	return s
+}
+
+// The error for a config that has problems
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// Whether any of the problems stop the system from running
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// The weather warning types that can have an action
+var weatherWarningTypes = []string{"heatwave", "frost", "heavy_rain", "high_wind"}
+
+// The storage backends that can be configured, see the db package
+var storageBackends = []string{"influxdb", "file"}
+
+// The roles an API token can have, see the auth package
+var tokenRoles = []string{"viewer", "operator", "admin"}
+
+// Check the config for values the control system can't run with, every problem is returned
+// rather than just the first. Warnings are left out, see Problems
+func (c Config) Validate() error {
+	var errs []Problem
+	for _, p := range c.Problems() {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Problems: errs}
+	}
+	return nil
+}
+
+// Every problem with the config, including the warnings
+func (c Config) Problems() []Problem {
+	var problems []Problem
+	add := func(path, fix, format string, args ...interface{}) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...), Fix: fix})
+	}
+	warn := func(path, fix, format string, args ...interface{}) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...), Fix: fix, Warning: true})
+	}
+
+	if c.SchemaVersion != CurrentSchemaVersion {
+		add("schema_version", fmt.Sprintf("run migrate-config to upgrade the file to %d", CurrentSchemaVersion), "schema version %d is not the current one, %d", c.SchemaVersion, CurrentSchemaVersion)
+	}
+	if c.Mode != "automatic" && c.Mode != "manual" {
+		add("mode", `set it to "automatic" or "manual"`, "unknown mode %q", c.Mode)
+	}
+	if c.RemoteIntervalSeconds == 0 {
+		add("remote_interval_seconds", "set how often to poll the units, such as 60", "must be more than zero")
+	}
+	if c.WeatherIntervalSeconds == 0 {
+		add("weather_scrape_interval", "set how often to fetch the weather, such as 3600", "must be more than zero")
+	}
+
+	// Units are found by number and by name, so both have to be unique
+	numbers := make(map[uint]int)
+	names := make(map[string]int)
+	for i, rmu := range c.RemoteUnitConfigs {
+		path := fmt.Sprintf("remote_configs[%d]", i)
+		if rmu.UnitName == "" {
+			add(path+".name", "give the unit a name", "is empty")
+		} else if j, ok := names[rmu.UnitName]; ok {
+			add(path+".name", "rename one of the units", "%q is also used by remote_configs[%d]", rmu.UnitName, j)
+		} else {
+			names[rmu.UnitName] = i
+		}
+		if rmu.UnitNumber == 0 {
+			// Device zero is the serial module itself
+			add(path+".number", "number units from 1", "must be more than zero")
+		} else if j, ok := numbers[rmu.UnitNumber]; ok {
+			add(path+".number", "give each unit its own number", "%d is also used by remote_configs[%d]", rmu.UnitNumber, j)
+		} else {
+			numbers[rmu.UnitNumber] = i
+		}
+		if rmu.WateringPolicy != nil {
+			problems = append(problems, c.WateringPolicy.WithDefaults().Override(rmu.WateringPolicy).validate(path+".watering_policy")...)
+		}
+		for j, w := range rmu.WateringWindows {
+			problems = append(problems, w.validate(fmt.Sprintf("%s.watering_windows[%d]", path, j))...)
+		}
+		if p := rmu.MapPosition; p != nil && (p.X < 0 || p.X > 100 || p.Y < 0 || p.Y > 100) {
+			add(path+".map_position", "use percentages of the map from 0 to 100", "(%g, %g) is off the map", p.X, p.Y)
+		}
+		sensors := make([]string, 0, len(rmu.SoilCalibrations))
+		for sensor := range rmu.SoilCalibrations {
+			sensors = append(sensors, sensor)
+		}
+		sort.Strings(sensors)
+		for _, sensor := range sensors {
+			problems = append(problems, validateCurve(fmt.Sprintf("%s.soil_calibrations.%s", path, sensor), rmu.SoilCalibrations[sensor])...)
+		}
+	}
+	if c.Mode == "automatic" && len(c.RemoteUnitConfigs) == 0 {
+		warn("remote_configs", "add a unit for each remote unit on the serial bus", "no units are configured, nothing will be watered")
+	}
+
+	problems = append(problems, c.SerialConfig.validate("serial_config")...)
+	problems = append(problems, c.Storage.validate("storage")...)
+	if c.Storage.uses("influxdb") {
+		problems = append(problems, c.DatabaseConfig.validate("influxdb_config")...)
+	}
+	problems = append(problems, c.WeatherAPIConfig.validate("weather_api_config")...)
+	problems = append(problems, c.WateringPolicy.WithDefaults().validate("watering_policy")...)
+	for i, w := range c.WateringWindows {
+		problems = append(problems, w.validate(fmt.Sprintf("watering_windows[%d]", i))...)
+	}
+	problems = append(problems, c.WeatherWarnings.validate("weather_warnings")...)
+	problems = append(problems, c.Agronomy.validate("agronomy")...)
+	problems = append(problems, c.API.validate("api")...)
+	return problems
+}
+
+// Check the serial port settings
+func (s SerialConfig) validate(path string) []Problem {
+	var problems []Problem
+	if s.Port == "" {
+		problems = append(problems, Problem{Path: path + ".serial_port", Message: "is empty", Fix: "set the serial port the units are on, such as /dev/ttyS0"})
+	}
+	if s.BaudRate == 0 {
+		problems = append(problems, Problem{Path: path + ".baud_rate", Message: "must be more than zero", Fix: "use the baud rate of the serial module, such as 115200"})
+	}
+	if s.TimeoutSeconds == 0 {
+		problems = append(problems, Problem{Path: path + ".timeout_sec", Message: "is zero, reads will wait forever for a unit that doesn't answer", Fix: "set a timeout, such as 5", Warning: true})
+	}
+	return problems
+}
+
+// Whether a storage backend is in use, InfluxDB is used if none are configured
+func (s StorageConfig) uses(backend string) bool {
+	if len(s.Backends) == 0 {
+		return backend == "influxdb"
+	}
+	for _, b := range s.Backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the storage backends
+func (s StorageConfig) validate(path string) []Problem {
+	var problems []Problem
+	seen := make(map[string]bool)
+	for i, b := range s.Backends {
+		p := fmt.Sprintf("%s.backends[%d]", path, i)
+		if !contains(storageBackends, b) {
+			problems = append(problems, Problem{Path: p, Message: fmt.Sprintf("unknown backend %q", b), Fix: "use one of " + strings.Join(storageBackends, ", ")})
+		} else if seen[b] {
+			problems = append(problems, Problem{Path: p, Message: fmt.Sprintf("%q is listed more than once", b), Fix: "remove the duplicate", Warning: true})
+		}
+		seen[b] = true
+	}
+	if s.FilePath != "" && !s.uses("file") {
+		problems = append(problems, Problem{Path: path + ".file_path", Message: "is set but the file backend is not used", Fix: `add "file" to storage.backends or remove file_path`, Warning: true})
+	}
+	if (s.QueuePath != "" || s.QueueMaxPoints != 0) && !s.uses("influxdb") {
+		problems = append(problems, Problem{Path: path + ".queue_path", Message: "the InfluxDB queue is configured but the influxdb backend is not used", Fix: `add "influxdb" to storage.backends or remove the queue settings`, Warning: true})
+	}
+	return problems
+}
+
+// Check the InfluxDB connection settings, only when the influxdb backend is used
+func (d InfluxDBConfig) validate(path string) []Problem {
+	var problems []Problem
+	problems = append(problems, validateURL(path+".url", d.URL, "set the InfluxDB address, such as http://localhost:8086")...)
+	if d.Organisation == "" {
+		problems = append(problems, Problem{Path: path + ".organisation", Message: "is empty", Fix: "set the InfluxDB organisation to write to"})
+	}
+	if d.Bucket == "" {
+		problems = append(problems, Problem{Path: path + ".bucket", Message: "is empty", Fix: "set the InfluxDB bucket to write to"})
+	}
+	if d.Token == "" {
+		problems = append(problems, Problem{Path: path + ".token", Message: "is empty, InfluxDB will refuse every write", Fix: "set an InfluxDB API token with write access to the bucket"})
+	}
+	return problems
+}
+
+// Check the OpenWeatherMap settings
+func (w OpenWeatherMapConfig) validate(path string) []Problem {
+	var problems []Problem
+	problems = append(problems, validateURL(path+".url", w.URL, "set it to http://api.openweathermap.org")...)
+	if w.Token == "" {
+		problems = append(problems, Problem{Path: path + ".token", Message: "is empty, weather can't be fetched", Fix: "set an OpenWeatherMap API key"})
+	}
+	if w.Latitude < -90 || w.Latitude > 90 {
+		problems = append(problems, Problem{Path: path + ".latitude", Message: fmt.Sprintf("%g is not a latitude", w.Latitude), Fix: "use decimal degrees from -90 to 90"})
+	}
+	if w.Longitude < -180 || w.Longitude > 180 {
+		problems = append(problems, Problem{Path: path + ".longitude", Message: fmt.Sprintf("%g is not a longitude", w.Longitude), Fix: "use decimal degrees from -180 to 180"})
+	}
+	if w.Location == "" && w.Postcode == "" && w.Latitude == 0 && w.Longitude == 0 {
+		problems = append(problems, Problem{Path: path, Message: "no location is set, the weather will be for 0, 0", Fix: "set latitude and longitude, location or postcode", Warning: true})
+	}
+	if w.Location != "" && w.Postcode != "" {
+		problems = append(problems, Problem{Path: path + ".location", Message: "is ignored as postcode is also set", Fix: "remove one of location and postcode", Warning: true})
+	}
+	return problems
+}
+
+// Check the agronomy settings
+func (a AgronomyConfig) validate(path string) []Problem {
+	var problems []Problem
+	if a.SeasonStart != "" {
+		if _, err := time.Parse(time.DateOnly, a.SeasonStart); err != nil {
+			problems = append(problems, Problem{Path: path + ".season_start", Message: fmt.Sprintf("%q is not a date", a.SeasonStart), Fix: "use YYYY-MM-DD"})
+		}
+	}
+	d := a.WithDefaults()
+	if d.LowVPDKPa >= d.HighVPDKPa {
+		problems = append(problems, Problem{
+			Path:    path + ".low_vpd_kpa",
+			Message: fmt.Sprintf("low %g is not below high %g", d.LowVPDKPa, d.HighVPDKPa),
+			Fix:     "lower low_vpd_kpa or raise high_vpd_kpa",
+		})
+	}
+	return problems
+}
+
+// Check the API tokens and proxies
+func (a APIConfig) validate(path string) []Problem {
+	var problems []Problem
+	names := make(map[string]int)
+	for i, t := range a.Tokens {
+		p := fmt.Sprintf("%s.tokens[%d]", path, i)
+		if t.Name == "" {
+			problems = append(problems, Problem{Path: p + ".name", Message: "is empty", Fix: "name the token after who uses it"})
+		} else if j, ok := names[t.Name]; ok {
+			problems = append(problems, Problem{Path: p + ".name", Message: fmt.Sprintf("%q is also used by %s.tokens[%d]", t.Name, path, j), Fix: "give each token its own name"})
+		} else {
+			names[t.Name] = i
+		}
+		if !contains(tokenRoles, t.Role) {
+			problems = append(problems, Problem{Path: p + ".role", Message: fmt.Sprintf("unknown role %q", t.Role), Fix: "use one of " + strings.Join(tokenRoles, ", ")})
+		}
+		digest, ok := strings.CutPrefix(t.Hash, "sha256:")
+		if _, err := hex.DecodeString(digest); !ok || err != nil || len(digest) != 64 {
+			problems = append(problems, Problem{Path: p + ".hash", Message: "is not a sha256: hash", Fix: "make a token with the token command and copy its hash, the token itself is never kept"})
+		}
+	}
+	if a.AllowAnonymous && len(a.Tokens) > 0 {
+		problems = append(problems, Problem{Path: path + ".allow_anonymous", Message: "has no effect while tokens are configured", Fix: "remove allow_anonymous", Warning: true})
+	}
+	for i, origin := range a.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			problems = append(problems, Problem{Path: fmt.Sprintf("%s.allowed_origins[%d]", path, i), Message: fmt.Sprintf("%q is not an origin", origin), Fix: "use the scheme and host the pages are served from, such as https://dashboard.example.com"})
+		}
+	}
+	for i, proxy := range a.TrustedProxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			problems = append(problems, Problem{Path: fmt.Sprintf("%s.trusted_proxies[%d]", path, i), Message: fmt.Sprintf("%q is not an address or network", proxy), Fix: "use an IP address or a CIDR such as 10.0.0.0/8"})
+		}
+	}
+	return problems
+}
+
+// Check a soil moisture calibration curve
+func validateCurve(path string, points []CalibrationPoint) []Problem {
+	var problems []Problem
+	raws := make(map[float64]bool)
+	for i, p := range points {
+		if p.Value < 0 || p.Value > 100 {
+			problems = append(problems, Problem{Path: fmt.Sprintf("%s[%d].value", path, i), Message: fmt.Sprintf("%g is not a percentage", p.Value), Fix: "use the volumetric water content from 0 to 100"})
+		}
+		raws[p.Raw] = true
+	}
+	if len(raws) < 2 {
+		problems = append(problems, Problem{Path: path, Message: "needs at least two points with different raw values, the raw reading is used as it is", Fix: "capture a dry and a saturated point", Warning: true})
+	}
+	return problems
+}
+
+// Check that a URL is set and is one the clients can use
+func validateURL(path, value, fix string) []Problem {
+	if value == "" {
+		return []Problem{{Path: path, Message: "is empty", Fix: fix}}
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return []Problem{{Path: path, Message: fmt.Sprintf("%q is not an http or https URL", value), Fix: fix}}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a watering policy once the defaults and any unit overrides are applied
+func (p WateringPolicy) validate(path string) []Problem {
+	var problems []Problem
+	if p.ThresholdPercent < 0 || p.ThresholdPercent > 100 {
+		problems = append(problems, Problem{Path: path + ".threshold_percent", Message: fmt.Sprintf("%g is not a percentage", p.ThresholdPercent), Fix: "use a value from 0 to 100"})
+	}
+	if p.TargetPercent < 0 || p.TargetPercent > 100 {
+		problems = append(problems, Problem{Path: path + ".target_percent", Message: fmt.Sprintf("%g is not a percentage", p.TargetPercent), Fix: "use a value from 0 to 100"})
+	}
+	if p.TargetPercent <= p.ThresholdPercent {
+		problems = append(problems, Problem{
+			Path:    path + ".target_percent",
+			Message: fmt.Sprintf("target %g is not above the threshold %g, watering would stop as soon as it starts", p.TargetPercent, p.ThresholdPercent),
+			Fix:     "raise the target or lower the threshold",
+		})
+	}
+	if p.DurationSeconds > 3600 {
+		problems = append(problems, Problem{Path: path + ".duration_seconds", Message: fmt.Sprintf("%d seconds is over an hour", p.DurationSeconds), Fix: "water for an hour or less, and more often if needed"})
+	}
+	return problems
+}
+
+// Check a watering window
+func (w WateringWindow) validate(path string) []Problem {
+	var problems []Problem
+	if w.Event != SolarEventSunrise && w.Event != SolarEventSunset {
+		problems = append(problems, Problem{Path: path + ".event", Message: fmt.Sprintf("unknown event %q", w.Event), Fix: `use "sunrise" or "sunset"`})
+	}
+	if w.DurationMinutes == 0 || w.DurationMinutes > 24*60 {
+		problems = append(problems, Problem{Path: path + ".duration_minutes", Message: fmt.Sprintf("%d minutes is not a usable window", w.DurationMinutes), Fix: "use a duration from 1 to 1440 minutes"})
+	}
+	return problems
+}
+
+// Check the weather warning thresholds once the defaults are applied
+func (w WeatherWarningConfig) validate(path string) []Problem {
+	var problems []Problem
+	d := w.WithDefaults()
+	// The forecast only goes out 5 days
+	if d.ForecastHours > 120 {
+		problems = append(problems, Problem{Path: path + ".forecast_hours", Message: fmt.Sprintf("%d hours is beyond the 5 day forecast", d.ForecastHours), Fix: "use 120 hours or less"})
+	}
+	if *d.FrostTempC >= *d.HeatwaveTempC {
+		problems = append(problems, Problem{
+			Path:    path + ".frost_temp_c",
+			Message: fmt.Sprintf("frost temperature %g is not below the heatwave temperature %g", *d.FrostTempC, *d.HeatwaveTempC),
+			Fix:     "lower frost_temp_c or raise heatwave_temp_c",
+		})
+	}
+	if *d.HeavyRainMM < 0 {
+		problems = append(problems, Problem{Path: path + ".heavy_rain_mm", Message: "must not be negative", Fix: "use the rain in millimetres over 3 hours, such as 10"})
+	}
+	if *d.HighWindMS < 0 {
+		problems = append(problems, Problem{Path: path + ".high_wind_ms", Message: "must not be negative", Fix: "use the wind speed in metres per second, such as 10"})
+	}
+	types := make([]string, 0, len(w.Actions))
+	for warningType := range w.Actions {
+		types = append(types, warningType)
+	}
+	sort.Strings(types)
+	for _, warningType := range types {
+		action := w.Actions[warningType]
+		if !contains(weatherWarningTypes, warningType) {
+			problems = append(problems, Problem{Path: path + ".actions." + warningType, Message: fmt.Sprintf("unknown warning type %q", warningType), Fix: "use one of " + strings.Join(weatherWarningTypes, ", ")})
+		}
+		switch action {
+		case WeatherActionNone, WeatherActionPreWater, WeatherActionSkipWatering, WeatherActionFrostProtect:
+		default:
+			problems = append(problems, Problem{
+				Path:    path + ".actions." + warningType,
+				Message: fmt.Sprintf("unknown action %q", action),
+				Fix:     fmt.Sprintf("use one of %s, %s, %s or %s", WeatherActionNone, WeatherActionPreWater, WeatherActionSkipWatering, WeatherActionFrostProtect),
+			})
+		}
+	}
+	return problems
+}
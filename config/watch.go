@@ -0,0 +1,40 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+// Call onChange whenever the file at path changes. The file is checked every interval, and
+// onChange waits until it has stopped changing for an interval so a half written file isn't
+// picked up. This never returns
+func WatchFile(path string, interval time.Duration, onChange func()) {
+	last := fileHash(path)
+	var pending []byte
+	for range time.Tick(interval) {
+		current := fileHash(path)
+		switch {
+		case bytes.Equal(current, last):
+			pending = nil
+		case pending != nil && bytes.Equal(current, pending):
+			// It has settled
+			last = current
+			pending = nil
+			onChange()
+		default:
+			pending = current
+		}
+	}
+}
+
+// The hash of a file's contents, nil if it can't be read
+func fileHash(path string) []byte {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(contents)
+	return sum[:]
+}
@@ -0,0 +1,116 @@
+package control
+
+import (
+	"as2controlv2/agronomy"
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"fmt"
+	"time"
+)
+
+// How far back growing degree days are accumulated from if no season start is configured
+const defaultSeasonLength = 30 * 24 * time.Hour
+
+// Work out the metrics derived from a unit's averaged temperature and humidity
+func deriveAgronomicValues(values *db.CurrentLocalValues) {
+	values.VapourPressureDeficit = agronomy.VapourPressureDeficit(values.Temperature, values.Humidity)
+	values.DewPoint = nil
+	if dewPoint, ok := agronomy.DewPoint(values.Temperature, values.Humidity); ok {
+		values.DewPoint = &dewPoint
+	}
+}
+
+// Check whether the growing degree days need updating, this happens once a day
+func (cs *ControlSystem) CheckAgronomyTimes() {
+	if time.Now().After(cs.systemTiming.NextAgronomyTime) {
+		cs.systemTiming.NextAgronomyTime = time.Now().Add(24 * time.Hour)
+		cs.updateGrowingDegreeDays()
+	}
+}
+
+// Get the crop base temperatures for a unit, its own if it has any, otherwise the system ones
+func (cs *ControlSystem) baseTemps(rmu config.RemoteUnitConfig) []float64 {
+	if len(rmu.GDDBaseTempsC) > 0 {
+		return rmu.GDDBaseTempsC
+	}
+	return cs.currentConfig().Agronomy.WithDefaults().BaseTempsC
+}
+
+// Get the day growing degree days are accumulated from
+func (cs *ControlSystem) seasonStart() time.Time {
+	if cs.currentConfig().Agronomy.SeasonStart != "" {
+		t, err := time.ParseInLocation(time.DateOnly, cs.currentConfig().Agronomy.SeasonStart, time.Local)
+		if err == nil {
+			return t
+		}
+		cs.logger.Warn(fmt.Sprintf("invalid season start %q, using the last 30 days", cs.currentConfig().Agronomy.SeasonStart))
+	}
+	return time.Now().Add(-defaultSeasonLength)
+}
+
+// Accumulate growing degree days for each unit and base temperature from the daily temperature
+// range in storage, writing each day's value. This runs in the background as the history query
+// can be slow
+func (cs *ControlSystem) updateGrowingDegreeDays() {
+	history, ok := cs.storage().(db.HistoryReader)
+	if !ok {
+		return
+	}
+	days := int(time.Since(cs.seasonStart()).Hours()/24) + 1
+	units := cs.currentConfig().RemoteUnitConfigs
+
+	go func() {
+		for _, rmu := range units {
+			ranges, err := history.DailyTemperatureRange(rmu.UnitName, days)
+			if err != nil {
+				cs.logger.Warn(fmt.Sprintf("could not get temperature history for unit %d: %s", rmu.UnitNumber, err.Error()))
+				continue
+			}
+			tags := db.Tags{
+				SystemName:     cs.currentConfig().Name,
+				RemoteUnitName: rmu.UnitName,
+			}
+			totals := make(map[float64]float64)
+			for _, base := range cs.baseTemps(rmu) {
+				accumulated := 0.0
+				for _, r := range ranges {
+					daily := agronomy.GrowingDegreeDays(r.Min, r.Max, base)
+					accumulated += daily
+					if err := cs.storage().WriteGrowingDegreeDays(tags, base, r.Day, daily, accumulated); err != nil {
+						cs.logger.Error(fmt.Sprintf("could not write growing degree days for unit %d: %s", rmu.UnitNumber, err.Error()))
+					}
+				}
+				totals[base] = accumulated
+			}
+			cs.historyMu.Lock()
+			cs.growingDegreeDays[rmu.UnitNumber] = totals
+			cs.historyMu.Unlock()
+		}
+	}()
+}
+
+// Generate vapour pressure deficit warnings from the last set of remote unit polls
+func (cs *ControlSystem) generateAgronomyWarnings(s *schedulerState) []warning {
+	conf := cs.currentConfig().Agronomy.WithDefaults()
+	ws := make([]warning, 0)
+	for i, v := range s.SensorAverages {
+		rmu := s.Units[i]
+		if !cs.unitReadingsUsable(rmu.UnitNumber) {
+			continue
+		}
+		if v.VapourPressureDeficit > conf.HighVPDKPa {
+			ws = append(ws, warning{
+				Name:  rmu.UnitName,
+				Value: v.VapourPressureDeficit,
+				Msg:   fmt.Sprintf("Vapour pressure deficit is high, plants in unit %d may be water stressed", rmu.UnitNumber),
+			})
+		} else if v.VapourPressureDeficit < conf.LowVPDKPa {
+			ws = append(ws, warning{
+				Name:  rmu.UnitName,
+				Value: v.VapourPressureDeficit,
+				Msg:   fmt.Sprintf("Vapour pressure deficit is low, unit %d is at risk of fungal disease", rmu.UnitNumber),
+			})
+		}
+	}
+	return ws
+}
@@ -0,0 +1,461 @@
+package control
+
+import (
+	"as2controlv2/auth"
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A route of the versioned API. The routes are registered and the OpenAPI document is generated
+// from the same list, so the two can't drift apart
+type APIRoute struct {
+	Method   string
+	Path     string // Relative to /api/v1, in gin syntax
+	Summary  string
+	Role     string // The role a token needs to use the route
+	Handler  gin.HandlerFunc
+	Query    []QueryParam
+	Request  interface{} // A value of the request body type, nil if there is no body
+	Response interface{} // A value of the success response type, nil for a stream
+	Status   int         // The success status, OK if zero
+	Errors   []int       // The error statuses the route can respond with
+	Stream   string      // The content type of a streamed response
+}
+
+// A query parameter of a route
+type QueryParam struct {
+	Name        string
+	Type        string // An OpenAPI type, such as string or integer
+	Description string
+}
+
+// The body of every error response
+type errorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+// The body of a successful command
+type commandResponse struct {
+	Message string     `json:"message"`
+	Unit    uint       `json:"unit"`
+	At      *time.Time `json:"at,omitempty"` // When a watering is now due to start
+}
+
+// The request to water a unit now
+type waterNowRequest struct {
+	DurationSeconds uint `json:"duration_seconds"` // The default duration if zero
+}
+
+// The request to acknowledge a warning
+type acknowledgeRequest struct {
+	Key string `json:"key" binding:"required"` // The key the warning is listed with
+}
+
+// The request to delay a pending watering
+type delayRequest struct {
+	Minutes uint `json:"minutes"` // 60 if zero
+}
+
+// The request to capture a calibration point
+type calibrationRequest struct {
+	Point string   `json:"point"` // dry or saturated
+	Value *float64 `json:"value"` // The volumetric water content, overrides the point
+}
+
+// The stored history of a metric for a unit
+type historyResponse struct {
+	Unit   uint        `json:"unit"`
+	Name   string      `json:"name"`
+	Metric string      `json:"metric"`
+	Data   interface{} `json:"data"`
+}
+
+// Pending and active waterings, and whether automatic watering is held off
+type scheduleResponse struct {
+	Waterings  []scheduleEntry `json:"waterings"`
+	HeldUntil  *time.Time      `json:"held_until,omitempty"`
+	HeldReason string          `json:"held_reason,omitempty"`
+}
+
+// The calibration curves and the readings they can be captured from
+type calibrationResponse struct {
+	Curves   map[string][]config.CalibrationPoint `json:"curves"`
+	Readings map[string]soilReadings              `json:"readings"`
+}
+
+// Respond with the error envelope. Errors that aren't API errors are internal ones
+func respondError(c *gin.Context, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = newAPIError(http.StatusInternalServerError, codeInternal, "%s", err.Error())
+	}
+	c.AbortWithStatusJSON(apiErr.Status, errorEnvelope{Error: *apiErr})
+}
+
+// Bind the JSON body of a request, an empty body leaves the defaults
+func bindBody(c *gin.Context, body interface{}) error {
+	if err := c.ShouldBindJSON(body); err != nil && !errors.Is(err, io.EOF) {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: %s", err.Error())
+	}
+	return nil
+}
+
+// Get the unit named by the :id of the path, by number or name
+func (cs *ControlSystem) pathUnit(c *gin.Context) (config.RemoteUnitConfig, error) {
+	rmu, ok := cs.findUnit(c.Param("id"))
+	if !ok {
+		return rmu, newAPIError(http.StatusNotFound, codeUnitNotFound, "unit %q does not exist", c.Param("id"))
+	}
+	return rmu, nil
+}
+
+// Get a positive integer query, or the default if it isn't given
+func positiveQuery(c *gin.Context, name string, def int) (int, error) {
+	value, err := strconv.Atoi(c.DefaultQuery(name, strconv.Itoa(def)))
+	if err != nil || value <= 0 {
+		return 0, newAPIError(http.StatusBadRequest, codeInvalidRequest, "%s must be a positive integer", name)
+	}
+	return value, nil
+}
+
+// The routes of /api/v1
+func (cs *ControlSystem) V1Routes() []APIRoute {
+	notFound := []int{http.StatusNotFound}
+	routes := []APIRoute{
+		{
+			Method: http.MethodGet, Path: "/warnings", Role: auth.RoleViewer, Summary: "Every current warning",
+			Handler: cs.v1GETWarnings, Response: []warning{},
+		},
+		{
+			Method: http.MethodPost, Path: "/warnings/acknowledge", Role: auth.RoleOperator, Summary: "Acknowledge a raised warning",
+			Handler: cs.v1POSTAcknowledge, Request: acknowledgeRequest{}, Response: warning{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+		},
+		{
+			Method: http.MethodGet, Path: "/units", Role: auth.RoleViewer, Summary: "The status of every unit",
+			Handler: cs.v1GETUnits, Response: []unitStatus{},
+		},
+		{
+			Method: http.MethodGet, Path: "/units/:id", Role: auth.RoleViewer, Summary: "The status of a unit, by number or name",
+			Handler: cs.v1GETUnit, Response: unitStatus{}, Errors: notFound,
+		},
+		{
+			Method: http.MethodGet, Path: "/units/:id/history", Role: auth.RoleViewer, Summary: "The stored history of a metric for a unit",
+			Handler: cs.v1GETUnitHistory, Response: historyResponse{},
+			Query: []QueryParam{
+				{Name: "metric", Type: "string", Description: "soil_moisture, water_volume or temperature_range"},
+				{Name: "hours", Type: "integer", Description: "How far back soil moisture goes, 24 by default"},
+				{Name: "days", Type: "integer", Description: "How many days of daily metrics, 7 by default"},
+			},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusNotImplemented},
+		},
+		{
+			Method: http.MethodPost, Path: "/units/:id/watering", Role: auth.RoleOperator, Summary: "Water a unit now",
+			Handler: cs.v1POSTWatering, Request: waterNowRequest{}, Response: commandResponse{}, Status: http.StatusAccepted,
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		},
+		{
+			Method: http.MethodDelete, Path: "/units/:id/watering", Role: auth.RoleOperator, Summary: "Stop a unit that is watering",
+			Handler: cs.v1DELETEWatering, Response: commandResponse{}, Status: http.StatusAccepted,
+			Errors: []int{http.StatusNotFound, http.StatusConflict},
+		},
+		{
+			Method: http.MethodPost, Path: "/units/:id/watering/delay", Role: auth.RoleOperator, Summary: "Delay a pending watering",
+			Handler: cs.v1POSTDelay, Request: delayRequest{}, Response: commandResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		},
+		{
+			Method: http.MethodPost, Path: "/units/:id/calibration", Role: auth.RoleAdmin, Summary: "Capture a calibration point for a unit's soil moisture sensors from its last poll",
+			Handler: cs.v1POSTCalibration, Request: calibrationRequest{}, Response: commandResponse{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+		},
+		{
+			Method: http.MethodDelete, Path: "/units/:id/calibration/:sensor", Role: auth.RoleAdmin, Summary: "Remove the captured calibration curve of a sensor",
+			Handler: cs.v1DELETECalibration, Response: commandResponse{}, Errors: notFound,
+		},
+		{
+			Method: http.MethodGet, Path: "/calibration", Role: auth.RoleViewer, Summary: "Every calibration curve and the last raw soil moisture readings",
+			Handler: cs.v1GETCalibration, Response: calibrationResponse{}, Errors: []int{http.StatusNotImplemented},
+		},
+		{
+			Method: http.MethodGet, Path: "/schedule", Role: auth.RoleViewer, Summary: "Every pending and active watering",
+			Handler: cs.v1GETSchedule, Response: scheduleResponse{},
+		},
+		{
+			Method: http.MethodGet, Path: "/waterings", Role: auth.RoleViewer, Summary: "The record of past waterings",
+			Handler: cs.v1GETWaterings, Response: []db.WateringEvent{},
+			Query: []QueryParam{
+				{Name: "unit", Type: "string", Description: "Only this unit, by number or name"},
+				{Name: "hours", Type: "integer", Description: "How far back to go, 168 by default"},
+			},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusNotImplemented},
+		},
+		{
+			Method: http.MethodGet, Path: "/connectivity", Role: auth.RoleViewer, Summary: "The link state of every unit",
+			Handler: cs.RouteGETConnectivity, Response: []unitLink{},
+		},
+		{
+			Method: http.MethodGet, Path: "/health", Role: auth.RoleViewer, Summary: "The health of every subsystem, /healthz and /readyz only give the overall status",
+			Handler: cs.v1GETHealth, Response: healthReport{},
+		},
+		{
+			Method: http.MethodGet, Path: "/events", Role: auth.RoleViewer, Summary: "Stream events as Server-Sent Events",
+			Handler: cs.RouteGETEvents, Stream: "text/event-stream",
+			Query: []QueryParam{
+				{Name: "unit", Type: "string", Description: "Comma separated units to stream, by number or name"},
+				{Name: "type", Type: "string", Description: "Comma separated event types to stream"},
+				{Name: "last_event_id", Type: "integer", Description: "Resume after this event, the Last-Event-ID header also works"},
+			},
+		},
+		{
+			Method: http.MethodGet, Path: "/events/ws", Role: auth.RoleViewer, Summary: "Stream events over a WebSocket, with the same query as /events",
+			Handler: cs.RouteGETEventsWebSocket, Stream: "application/json",
+		},
+	}
+	return append(routes, cs.configRoutes()...)
+}
+
+func (cs *ControlSystem) v1GETHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, cs.healthReport())
+}
+
+func (cs *ControlSystem) v1GETWarnings(c *gin.Context) {
+	c.JSON(http.StatusOK, cs.currentWarnings())
+}
+
+func (cs *ControlSystem) v1POSTAcknowledge(c *gin.Context) {
+	var req acknowledgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: %s", err.Error()))
+		return
+	}
+	w, err := cs.acknowledgeWarning(req.Key, requestedBy(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+func (cs *ControlSystem) v1GETUnits(c *gin.Context) {
+	cs.RouteGETUnits(c)
+}
+
+func (cs *ControlSystem) v1GETUnit(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cs.unitStatus(rmu))
+}
+
+func (cs *ControlSystem) v1GETUnitHistory(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	hours, err := positiveQuery(c, "hours", 24)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	days, err := positiveQuery(c, "days", 7)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	metric := c.DefaultQuery("metric", "soil_moisture")
+	data, err := cs.unitHistory(rmu, metric, hours, days)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, historyResponse{Unit: rmu.UnitNumber, Name: rmu.UnitName, Metric: metric, Data: data})
+}
+
+func (cs *ControlSystem) v1POSTWatering(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req waterNowRequest
+	if err := bindBody(c, &req); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := cs.waterNow(c.Request.Context(), rmu.UnitNumber, time.Duration(req.DurationSeconds)*time.Second, requestedBy(c)); err != nil {
+		respondError(c, err)
+		return
+	}
+	now := time.Now()
+	c.JSON(http.StatusAccepted, commandResponse{
+		Message: fmt.Sprintf("scheduled watering for unit %d for now", rmu.UnitNumber),
+		Unit:    rmu.UnitNumber,
+		At:      &now,
+	})
+}
+
+func (cs *ControlSystem) v1DELETEWatering(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := cs.cancelWatering(c.Request.Context(), rmu.UnitNumber); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, commandResponse{
+		Message: fmt.Sprintf("switching water for unit %d off at its next poll", rmu.UnitNumber),
+		Unit:    rmu.UnitNumber,
+	})
+}
+
+func (cs *ControlSystem) v1POSTDelay(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	req := delayRequest{}
+	if err := bindBody(c, &req); err != nil {
+		respondError(c, err)
+		return
+	}
+	if req.Minutes == 0 {
+		req.Minutes = 60
+	}
+	at, err := cs.delayWatering(c.Request.Context(), rmu.UnitNumber, time.Duration(req.Minutes)*time.Minute)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, commandResponse{
+		Message: fmt.Sprintf("unit %d has been delayed by %d minutes", rmu.UnitNumber, req.Minutes),
+		Unit:    rmu.UnitNumber,
+		At:      &at,
+	})
+}
+
+func (cs *ControlSystem) v1POSTCalibration(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var req calibrationRequest
+	if err := bindBody(c, &req); err != nil {
+		respondError(c, err)
+		return
+	}
+	valueStr := ""
+	if req.Value != nil {
+		valueStr = strconv.FormatFloat(*req.Value, 'f', -1, 64)
+	}
+	value, err := CalibrationPointValue(req.Point, valueStr)
+	if err != nil {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "%s", err.Error()))
+		return
+	}
+	if _, err := cs.captureCalibrationPoint(rmu.UnitNumber, value); err != nil {
+		respondError(c, newAPIError(http.StatusConflict, codeCalibrationFailed, "%s", err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, commandResponse{
+		Message: fmt.Sprintf("captured %.1f%% point for unit %d", value, rmu.UnitNumber),
+		Unit:    rmu.UnitNumber,
+	})
+}
+
+func (cs *ControlSystem) v1DELETECalibration(c *gin.Context) {
+	rmu, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if cs.calibrations == nil {
+		respondError(c, newAPIError(http.StatusNotImplemented, codeNotSupported, "calibration is not available"))
+		return
+	}
+	if err := cs.calibrations.Reset(rmu.UnitNumber, c.Param("sensor")); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, commandResponse{
+		Message: fmt.Sprintf("reset calibration of %s on unit %d", c.Param("sensor"), rmu.UnitNumber),
+		Unit:    rmu.UnitNumber,
+	})
+}
+
+func (cs *ControlSystem) v1GETCalibration(c *gin.Context) {
+	if cs.calibrations == nil {
+		respondError(c, newAPIError(http.StatusNotImplemented, codeNotSupported, "calibration is not available"))
+		return
+	}
+	cs.RouteGETCalibration(c)
+}
+
+func (cs *ControlSystem) v1GETSchedule(c *gin.Context) {
+	state := cs.state()
+	response := scheduleResponse{Waterings: state.schedule()}
+	if state.held() {
+		heldUntil := state.HeldUntil
+		response.HeldUntil = &heldUntil
+		response.HeldReason = state.HoldReason
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (cs *ControlSystem) v1GETWaterings(c *gin.Context) {
+	history, ok := cs.storage().(db.HistoryReader)
+	if !ok {
+		respondError(c, newAPIError(http.StatusNotImplemented, codeNotSupported, "storage backend does not support history queries"))
+		return
+	}
+	unitName := ""
+	if id := c.Query("unit"); id != "" {
+		rmu, ok := cs.findUnit(id)
+		if !ok {
+			respondError(c, newAPIError(http.StatusNotFound, codeUnitNotFound, "unit %q does not exist", id))
+			return
+		}
+		unitName = rmu.UnitName
+	}
+	hours, err := positiveQuery(c, "hours", 168)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	events, err := history.WateringHistory(unitName, time.Duration(hours)*time.Hour)
+	if err != nil {
+		respondError(c, fmt.Errorf("could not query watering history: %w", err))
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// Mark a route as deprecated in favour of its /api/v1 successor. The route keeps working, the
+// headers just tell clients where to move to
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		c.Next()
+	}
+}
+
+// Route for anything under /api/v1 that doesn't exist
+func V1NotFound(c *gin.Context) {
+	respondError(c, newAPIError(http.StatusNotFound, codeNotFound, "no route %s %s", c.Request.Method, c.Request.URL.Path))
+}
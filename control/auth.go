@@ -0,0 +1,140 @@
+package control
+
+import (
+	"as2controlv2/auth"
+	"as2controlv2/db"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Where the identity of the caller is kept in the gin context
+const identityKey = "identity"
+
+// The identity used for every request when no tokens are configured and the API is open
+var anonymous = auth.Identity{Name: "anonymous", Role: auth.RoleAdmin}
+
+// Codes in the error envelope for authentication failures
+const (
+	codeUnauthorised = "unauthorised"
+	codeForbidden    = "forbidden"
+)
+
+// Set the tokens that can use the API. With none configured every request is refused, unless the
+// API is allowed to be open. They can be replaced while requests are being served, such as when
+// the config is reloaded
+func (cs *ControlSystem) SetTokens(tokens *auth.Store) {
+	cs.tokens.Store(tokens)
+}
+
+// The routes that take a token in the access_token query, browsers can't set headers on event
+// streams
+var queryTokenPaths = map[string]bool{
+	"/api/events":       true,
+	"/api/events/ws":    true,
+	"/api/v1/events":    true,
+	"/api/v1/events/ws": true,
+}
+
+// Middleware that takes the access_token query off every request, so it must come before the
+// logger. On the event stream routes it is used as the bearer token if there isn't one already,
+// anywhere else it is ignored
+func QueryToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		if !query.Has("access_token") {
+			c.Next()
+			return
+		}
+		token := query.Get("access_token")
+		query.Del("access_token")
+		c.Request.URL.RawQuery = query.Encode()
+		c.Request.RequestURI = c.Request.URL.RequestURI()
+		if token != "" && queryTokenPaths[c.Request.URL.Path] && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+		c.Next()
+	}
+}
+
+// Middleware that only lets through requests with a token whose role allows the route. Tokens are
+// taken from the Authorization header, see QueryToken for event streams. Requests that change
+// anything are written to the audit trail
+func (cs *ControlSystem) Authorise(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := anonymous
+		tokens := cs.tokens.Load()
+		if !tokens.Enabled() && !tokens.Anonymous() {
+			respondError(c, newAPIError(http.StatusForbidden, codeForbidden, "no API tokens are configured, add some with the token command or set api.allow_anonymous"))
+			return
+		}
+		if tokens.Enabled() {
+			token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if token == "" {
+				c.Header("WWW-Authenticate", "Bearer")
+				respondError(c, newAPIError(http.StatusUnauthorized, codeUnauthorised, "an API token is required"))
+				return
+			}
+			var err error
+			id, err = tokens.Authenticate(token)
+			if err != nil {
+				c.Header("WWW-Authenticate", "Bearer")
+				respondError(c, newAPIError(http.StatusUnauthorized, codeUnauthorised, "%s", err.Error()))
+				return
+			}
+			if !id.Allows(role) {
+				respondError(c, newAPIError(http.StatusForbidden, codeForbidden, "token %q has the %s role, this needs %s", id.Name, id.Role, role))
+				// Refused changes are worth knowing about too
+				if isMutating(c) {
+					cs.audit(c, id)
+				}
+				return
+			}
+		}
+		c.Set(identityKey, id)
+		c.Next()
+
+		if isMutating(c) {
+			cs.audit(c, id)
+		}
+	}
+}
+
+// Whether a request can change anything
+func isMutating(c *gin.Context) bool {
+	return c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead
+}
+
+// Write a request that changed something to the audit trail
+func (cs *ControlSystem) audit(c *gin.Context, id auth.Identity) {
+	// Never record the token itself
+	query := c.Request.URL.Query()
+	query.Del("access_token")
+
+	cs.logger.Info(fmt.Sprintf("%s %s by %s (%s) from %s: %d", c.Request.Method, c.Request.URL.Path, id.Name, id.Role, c.ClientIP(), c.Writer.Status()))
+	err := cs.storage().WriteEvent("api_audit", db.Tags{SystemName: cs.currentConfig().Name}, map[string]interface{}{
+		"token":     id.Name,
+		"role":      id.Role,
+		"method":    c.Request.Method,
+		"path":      c.Request.URL.Path,
+		"query":     query.Encode(),
+		"status":    c.Writer.Status(),
+		"client_ip": c.ClientIP(),
+	})
+	if err != nil {
+		cs.logger.Error(fmt.Sprintf("could not write audit record: %s", err.Error()))
+	}
+}
+
+// Who made a request, for recording against what it changes. Without tokens configured the client
+// address is all there is to go on
+func requestedBy(c *gin.Context) string {
+	if v, ok := c.Get(identityKey); ok {
+		if id := v.(auth.Identity); id != anonymous {
+			return "token:" + id.Name
+		}
+	}
+	return "api:" + c.ClientIP()
+}
@@ -0,0 +1,153 @@
+package control
+
+import (
+	"as2controlv2/auth"
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A control system with just enough set up to serve authorised routes, audit records go to the
+// returned sink
+func authTestSystem(t *testing.T, api config.APIConfig) (*ControlSystem, *db.MemorySink) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	conf := config.MakeExampleConfig()
+	conf.API = api
+	tokens, err := auth.StoreInit(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := db.NewMemorySink()
+	cs := &ControlSystem{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), dbHandler: sink}
+	cs.systemConfig.Store(&conf)
+	cs.SetTokens(tokens)
+	return cs, sink
+}
+
+// A token for each role, the token itself is the role name
+func roleTokens() config.APIConfig {
+	var api config.APIConfig
+	for _, role := range []string{auth.RoleViewer, auth.RoleOperator, auth.RoleAdmin} {
+		api.Tokens = append(api.Tokens, config.APIToken{Name: role + "-token", Role: role, Hash: auth.HashToken(role)})
+	}
+	return api
+}
+
+// Serve a request through routes that need each role, the same way SetupRoutes does
+func serveAuthorised(cs *ControlSystem, method, target, token string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Use(QueryToken())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/api/v1/units", cs.Authorise(auth.RoleViewer), ok)
+	r.GET("/api/v1/events", cs.Authorise(auth.RoleViewer), ok)
+	r.POST("/api/v1/units/:id/watering", cs.Authorise(auth.RoleOperator), ok)
+	r.PUT("/api/v1/config/units/:id", cs.Authorise(auth.RoleAdmin), ok)
+
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Each role can use its own routes and the ones below it, and nothing above
+func TestAuthoriseRoles(t *testing.T) {
+	cs, _ := authTestSystem(t, roleTokens())
+	routes := []struct {
+		method, target, role string
+	}{
+		{http.MethodGet, "/api/v1/units", auth.RoleViewer},
+		{http.MethodPost, "/api/v1/units/1/watering", auth.RoleOperator},
+		{http.MethodPut, "/api/v1/config/units/1", auth.RoleAdmin},
+	}
+	levels := map[string]int{auth.RoleViewer: 1, auth.RoleOperator: 2, auth.RoleAdmin: 3}
+	for _, rt := range routes {
+		for token, level := range levels {
+			want := http.StatusOK
+			if level < levels[rt.role] {
+				want = http.StatusForbidden
+			}
+			if w := serveAuthorised(cs, rt.method, rt.target, token); w.Code != want {
+				t.Errorf("%s %s with the %s token: status %d, want %d", rt.method, rt.target, token, w.Code, want)
+			}
+		}
+		if w := serveAuthorised(cs, rt.method, rt.target, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token: status %d, want %d", rt.method, rt.target, w.Code, http.StatusUnauthorized)
+		}
+		if w := serveAuthorised(cs, rt.method, rt.target, "not-a-token"); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s with an unknown token: status %d, want %d", rt.method, rt.target, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+// Without tokens every request is refused, unless the API is allowed to be open
+func TestAuthoriseWithoutTokens(t *testing.T) {
+	cs, _ := authTestSystem(t, config.APIConfig{})
+	if w := serveAuthorised(cs, http.MethodGet, "/api/v1/units", ""); w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	cs, _ = authTestSystem(t, config.APIConfig{AllowAnonymous: true})
+	if w := serveAuthorised(cs, http.MethodPut, "/api/v1/config/units/1", ""); w.Code != http.StatusOK {
+		t.Errorf("status %d with allow_anonymous, want %d", w.Code, http.StatusOK)
+	}
+
+	// Configured tokens are always needed, whatever allow_anonymous says
+	api := roleTokens()
+	api.AllowAnonymous = true
+	cs, _ = authTestSystem(t, api)
+	if w := serveAuthorised(cs, http.MethodGet, "/api/v1/units", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d with tokens and allow_anonymous, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// Tokens in the query only work for event streams, and never reach the handlers or the log
+func TestQueryToken(t *testing.T) {
+	cs, _ := authTestSystem(t, roleTokens())
+	if w := serveAuthorised(cs, http.MethodGet, "/api/v1/events?access_token=viewer", ""); w.Code != http.StatusOK {
+		t.Errorf("event stream: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serveAuthorised(cs, http.MethodGet, "/api/v1/units?access_token=admin", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("units: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	r := gin.New()
+	r.Use(QueryToken())
+	var query, uri string
+	r.GET("/api/v1/events", func(c *gin.Context) {
+		query, uri = c.Request.URL.RawQuery, c.Request.RequestURI
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/events?unit=1&access_token=viewer", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if query != "unit=1" || uri != "/api/v1/events?unit=1" {
+		t.Errorf("query %q and URI %q still have the token", query, uri)
+	}
+}
+
+// Changes are written to the audit trail, including refused ones, and reads aren't
+func TestAuthoriseAudit(t *testing.T) {
+	cs, sink := authTestSystem(t, roleTokens())
+	serveAuthorised(cs, http.MethodGet, "/api/v1/units", auth.RoleViewer)
+	serveAuthorised(cs, http.MethodPost, "/api/v1/units/1/watering", auth.RoleOperator)
+	serveAuthorised(cs, http.MethodPut, "/api/v1/config/units/1", auth.RoleOperator)
+
+	points := sink.Points()
+	if len(points) != 2 {
+		t.Fatalf("%d audit records, want 2: %v", len(points), points)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusForbidden} {
+		p := points[i]
+		if p.Tags["event"] != "api_audit" || p.Fields["token"] != "operator-token" || p.Fields["status"] != want {
+			t.Errorf("audit record %d is %v, want the operator token with status %d", i, p, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package control
+
+import (
+	"as2controlv2/calibration"
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The raw soil moisture readings from a single poll of a unit
+type soilReadings struct {
+	At  time.Time          `json:"at"`
+	Raw map[string]float64 `json:"raw"` // Keyed by reading name
+}
+
+// Readings older than this many poll intervals are too old to capture a calibration point from
+const captureMaxAgeIntervals = 2
+
+// Keep the raw readings from a poll for capturing calibration points, and store each sensor's
+// raw and calibrated values
+func (cs *ControlSystem) recordSoilReadings(rmu config.RemoteUnitConfig, raw map[string]float64, tags db.Tags) {
+	cs.soilReadingsMu.Lock()
+	cs.soilReadings[rmu.UnitNumber] = soilReadings{At: time.Now(), Raw: raw}
+	cs.soilReadingsMu.Unlock()
+
+	for sensor, value := range raw {
+		calibrated, _ := cs.calibrations.Apply(rmu.UnitNumber, sensor, value)
+		if err := cs.storage().WriteSoilMoistureSensor(tags, sensor, value, calibrated); err != nil {
+			cs.logger.Error(fmt.Sprintf("could not write soil moisture sensor %s for unit %d: %s", sensor, rmu.UnitNumber, err.Error()))
+		}
+	}
+}
+
+// Add a calibration point to every soil moisture sensor on a unit, using the readings from the
+// last poll. Returns the raw readings that were used
+func (cs *ControlSystem) captureCalibrationPoint(unitNumber uint, value float64) (map[string]float64, error) {
+	if cs.calibrations == nil {
+		return nil, fmt.Errorf("calibration is not available")
+	}
+	cs.soilReadingsMu.Lock()
+	last, ok := cs.soilReadings[unitNumber]
+	cs.soilReadingsMu.Unlock()
+	if !ok || len(last.Raw) == 0 {
+		return nil, fmt.Errorf("no soil moisture readings from unit %d yet", unitNumber)
+	}
+	maxAge := captureMaxAgeIntervals * time.Duration(cs.currentConfig().RemoteIntervalSeconds) * time.Second
+	if age := time.Since(last.At); age > maxAge {
+		return nil, fmt.Errorf("the last readings from unit %d are %s old, wait for a fresh poll", unitNumber, age.Round(time.Second))
+	}
+
+	for sensor, raw := range last.Raw {
+		if err := cs.calibrations.AddPoint(unitNumber, sensor, config.CalibrationPoint{Raw: raw, Value: value}); err != nil {
+			return nil, err
+		}
+	}
+	cs.logger.Info(fmt.Sprintf("captured calibration point %.1f%% for %d sensors on unit %d", value, len(last.Raw), unitNumber))
+	return last.Raw, nil
+}
+
+// Work out the volumetric water content of a reference point, either by name or given directly
+func CalibrationPointValue(point, valueStr string) (float64, error) {
+	if valueStr != "" {
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil || value < 0 || value > 100 {
+			return 0, fmt.Errorf("value must be a percentage between 0 and 100")
+		}
+		return value, nil
+	}
+	switch point {
+	case "dry":
+		return calibration.DefaultDryValue, nil
+	case "saturated":
+		return calibration.DefaultSaturatedValue, nil
+	}
+	return 0, fmt.Errorf("unknown point %q, use dry or saturated, or give a value", point)
+}
+
+// Route GET: The calibration curve of every sensor, along with the last raw readings of each unit
+func (cs *ControlSystem) RouteGETCalibration(c *gin.Context) {
+	if cs.calibrations == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"msg": "calibration is not available",
+		})
+		return
+	}
+	cs.soilReadingsMu.Lock()
+	readings := make(map[string]soilReadings, len(cs.soilReadings))
+	for unitNumber, r := range cs.soilReadings {
+		readings[strconv.Itoa(int(unitNumber))] = r
+	}
+	cs.soilReadingsMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"curves":   cs.calibrations.Curves(),
+		"readings": readings,
+	})
+}
+
+// Route POST: Capture a calibration point for every soil moisture sensor on a unit from its last
+// poll, route is /api/calibration/capture?unit=1&point=dry, or &value=30 for a point in between
+func (cs *ControlSystem) RoutePOSTCaptureCalibration(c *gin.Context) {
+	unit, err := strconv.Atoi(c.Query("unit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "no unit or non-numeric unit given",
+		})
+		return
+	}
+	if _, ok := cs.unitConfig(uint(unit)); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "unit number does not exist",
+		})
+		return
+	}
+	value, err := CalibrationPointValue(c.Query("point"), c.Query("value"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+
+	raw, err := cs.captureCalibrationPoint(uint(unit), value)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	sensors := make([]string, 0, len(raw))
+	for sensor := range raw {
+		sensors = append(sensors, sensor)
+	}
+	sort.Strings(sensors)
+	c.JSON(http.StatusOK, gin.H{
+		"msg":     fmt.Sprintf("captured %.1f%% point for unit %d", value, unit),
+		"sensors": sensors,
+		"raw":     raw,
+	})
+}
+
+// Route DELETE: Remove the captured curve of a sensor, route is /api/calibration?unit=1&sensor=soil_moisture_1
+func (cs *ControlSystem) RouteDELETECalibration(c *gin.Context) {
+	unit, err := strconv.Atoi(c.Query("unit"))
+	sensor := c.Query("sensor")
+	if err != nil || sensor == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "a numeric unit and a sensor must be given",
+		})
+		return
+	}
+	if cs.calibrations == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"msg": "calibration is not available",
+		})
+		return
+	}
+	if err := cs.calibrations.Reset(uint(unit), sensor); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"msg": fmt.Sprintf("could not reset calibration: %s", err.Error()),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": fmt.Sprintf("reset calibration of %s on unit %d", sensor, unit),
+	})
+}
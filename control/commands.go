@@ -0,0 +1,229 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/events"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Codes in the error envelope, for clients to match on rather than the message
+const (
+	codeInvalidRequest     = "invalid_request"
+	codeUnitNotFound       = "unit_not_found"
+	codeNotFound           = "not_found"
+	codeWateringNotPending = "watering_not_pending"
+	codeWateringNotActive  = "watering_not_active"
+	codeWateringActive     = "watering_already_active"
+	codeCalibrationFailed  = "calibration_unavailable"
+	codeNotSupported       = "not_supported"
+	codeInternal           = "internal_error"
+	codeUnitDisabled       = "unit_disabled"
+	codeInvalidConfig      = "invalid_config"
+	codeUnitExists         = "unit_exists"
+	codeSchedulerBusy      = "scheduler_busy"
+)
+
+// How long a command waits for the scheduler loop to pick it up
+const commandTimeout = 30 * time.Second
+
+// An error from an API operation, with the status and code to respond with
+type apiError struct {
+	Status   int              `json:"-"`
+	Code     string           `json:"code"`
+	Message  string           `json:"message"`
+	Problems []config.Problem `json:"problems,omitempty"` // Everything wrong with a config change
+}
+
+func (e *apiError) Error() string {
+	if len(e.Problems) == 0 {
+		return e.Message
+	}
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.String()
+	}
+	return fmt.Sprintf("%s: %s", e.Message, strings.Join(problems, "; "))
+}
+
+// Make an API error with a formatted message
+func newAPIError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Get a configured unit, or the not found error
+func (cs *ControlSystem) requireUnit(unitNumber uint) (config.RemoteUnitConfig, error) {
+	rmu, ok := cs.unitConfig(unitNumber)
+	if !ok {
+		return rmu, newAPIError(http.StatusNotFound, codeUnitNotFound, "unit %d does not exist", unitNumber)
+	}
+	return rmu, nil
+}
+
+// A change to the watering schedule from the API, waiting for the scheduler loop to make it.
+// Only the loop touches the schedule, so it never changes part way through an iteration
+type scheduleCommand struct {
+	ctx  context.Context
+	run  func() error
+	done chan error
+}
+
+// Make any schedule changes that are waiting, called from the scheduler loop
+func (cs *ControlSystem) applyScheduleCommands() {
+	for {
+		select {
+		case cmd := <-cs.scheduleCommands:
+			if err := cmd.ctx.Err(); err != nil {
+				// The client has given up on it
+				cmd.done <- err
+				continue
+			}
+			err := cmd.run()
+			cs.publishState(true)
+			cmd.done <- err
+		default:
+			return
+		}
+	}
+}
+
+// Hand a schedule change to the scheduler loop and wait for it to be made
+func (cs *ControlSystem) submitCommand(ctx context.Context, run func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	cmd := scheduleCommand{ctx: ctx, run: run, done: make(chan error, 1)}
+	select {
+	case cs.scheduleCommands <- cmd:
+	case <-ctx.Done():
+		return newAPIError(http.StatusServiceUnavailable, codeSchedulerBusy, "the scheduler did not pick up the command, try again")
+	}
+	return <-cmd.done
+}
+
+// Push a pending watering back, returning when it will now start
+func (cs *ControlSystem) delayWatering(ctx context.Context, unitNumber uint, by time.Duration) (time.Time, error) {
+	var at time.Time
+	err := cs.submitCommand(ctx, func() error {
+		if _, err := cs.requireUnit(unitNumber); err != nil {
+			return err
+		}
+		next, ok := cs.systemTiming.NextWateringTime[unitNumber]
+		if !ok {
+			return newAPIError(http.StatusConflict, codeWateringNotPending, "unit %d is not to be watered", unitNumber)
+		}
+		at = next.Add(by)
+		cs.systemTiming.NextWateringTime[unitNumber] = at
+		return nil
+	})
+	return at, err
+}
+
+// Stop a running watering at the next poll of the unit
+func (cs *ControlSystem) cancelWatering(ctx context.Context, unitNumber uint) error {
+	return cs.submitCommand(ctx, func() error {
+		if _, err := cs.requireUnit(unitNumber); err != nil {
+			return err
+		}
+		if _, ok := cs.systemTiming.WateringUntilTime[unitNumber]; !ok {
+			return newAPIError(http.StatusConflict, codeWateringNotActive, "unit %d is not watering", unitNumber)
+		}
+		cs.systemTiming.WateringUntilTime[unitNumber] = time.Now()
+		if run, ok := cs.activeWaterings[unitNumber]; ok {
+			run.EndReason = db.EndCancelled
+		}
+		return nil
+	})
+}
+
+// Schedule a unit to be watered straight away
+func (cs *ControlSystem) waterNow(ctx context.Context, unitNumber uint, duration time.Duration, requestedBy string) error {
+	return cs.submitCommand(ctx, func() error {
+		rmu, err := cs.requireUnit(unitNumber)
+		if err != nil {
+			return err
+		}
+		if rmu.Disabled {
+			return newAPIError(http.StatusConflict, codeUnitDisabled, "unit %d is disabled", unitNumber)
+		}
+		if _, ok := cs.activeWaterings[unitNumber]; ok {
+			return newAPIError(http.StatusConflict, codeWateringActive, "unit %d is already watering", unitNumber)
+		}
+		cs.scheduleWatering(unitNumber, time.Now(), WateringRequest{Trigger: db.TriggerManual, RequestedBy: requestedBy, Duration: duration})
+		return nil
+	})
+}
+
+// Get the stored history of a metric for a unit
+func (cs *ControlSystem) unitHistory(rmu config.RemoteUnitConfig, metric string, hours, days int) (interface{}, error) {
+	history, ok := cs.storage().(db.HistoryReader)
+	if !ok {
+		return nil, newAPIError(http.StatusNotImplemented, codeNotSupported, "storage backend does not support history queries")
+	}
+	if hours <= 0 || days <= 0 {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "hours and days must be positive")
+	}
+
+	var data interface{}
+	var err error
+	switch metric {
+	case "soil_moisture":
+		data, err = history.SoilMoistureHistory(rmu.UnitName, time.Duration(hours)*time.Hour)
+	case "water_volume":
+		data, err = history.DailyWaterVolume(rmu.UnitName, days)
+	case "temperature_range":
+		data, err = history.DailyTemperatureRange(rmu.UnitName, days)
+	default:
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "unknown metric, valid metrics are soil_moisture, water_volume and temperature_range")
+	}
+	if errors.Is(err, db.ErrNoHistory) {
+		return nil, newAPIError(http.StatusNotImplemented, codeNotSupported, "%s", err.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not query history: %w", err)
+	}
+	return data, nil
+}
+
+// Get every current warning, from the last state the scheduler loop published
+func (cs *ControlSystem) currentWarnings() []warning {
+	return cs.warningsFor(cs.state())
+}
+
+// Get every warning raised by a copy of the scheduler loop's state
+func (cs *ControlSystem) warningsFor(s *schedulerState) []warning {
+	warnings := cs.generateTemperatureSensorWarnings(s)
+	warnings = append(warnings, cs.generateHumiditySensorWarnings(s)...)
+	warnings = append(warnings, cs.generateWeatherWarnings(s)...)
+	warnings = append(warnings, cs.generateStorageWarnings()...)
+	warnings = append(warnings, cs.generateLinkWarnings()...)
+	warnings = append(warnings, cs.generateAgronomyWarnings(s)...)
+
+	cs.acknowledgedMu.Lock()
+	defer cs.acknowledgedMu.Unlock()
+	for i := range warnings {
+		warnings[i].Key = warningKey(warnings[i])
+		_, warnings[i].Acknowledged = cs.acknowledged[warnings[i].Key]
+	}
+	return cs.withPeriod(warnings)
+}
+
+// Acknowledge a warning that is currently raised. It stays acknowledged until it clears
+func (cs *ControlSystem) acknowledgeWarning(key, by string) (warning, error) {
+	for _, w := range cs.currentWarnings() {
+		if w.Key != key {
+			continue
+		}
+		cs.acknowledgedMu.Lock()
+		cs.acknowledged[key] = by
+		cs.acknowledgedMu.Unlock()
+		w.Acknowledged = true
+		cs.events.Publish(events.TypeWarningAcknowledged, cs.warningUnit(w), w)
+		return w, nil
+	}
+	return warning{}, newAPIError(http.StatusNotFound, codeNotFound, "no warning %q is raised", key)
+}
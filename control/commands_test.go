@@ -0,0 +1,118 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/serial"
+	"as2controlv2/weather"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A control system with a weather observation of high wind, so that warnings are raised for
+// every planned watering
+func warningTestSystem(t *testing.T) *ControlSystem {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"dt": %d, "main": {"temp": 293.15}, "wind": {"speed": 25}}`, time.Now().Unix())
+	}))
+	t.Cleanup(server.Close)
+
+	conf := config.MakeExampleConfig()
+	conf.WeatherAPIConfig.URL = server.URL
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cs := ControlSystemInit(logger, conf, db.NewMemorySink(), weather.WeatherInit(conf.WeatherAPIConfig), serial.SerialConnection{}, nil)
+	if err := cs.FetchWeatherData(); err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+// The API reads warnings while the scheduler loop changes the waterings and readings they are
+// based on, run with -race to check it only sees published state
+func TestCurrentWarningsWhileLoopRuns(t *testing.T) {
+	cs := warningTestSystem(t)
+	units := cs.currentConfig().RemoteUnitConfigs
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cs.currentWarnings()
+			}
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		unit := units[i%len(units)].UnitNumber
+		if i%2 == 0 {
+			cs.scheduleWatering(unit, time.Now().Add(time.Minute), WateringRequest{Trigger: db.TriggerThreshold})
+		} else {
+			delete(cs.systemTiming.NextWateringTime, unit)
+			delete(cs.systemTiming.WateringRequests, unit)
+		}
+		cs.currentSensorAverages[i%len(units)].Temperature = float64(i % 50)
+		cs.publishWarningChanges()
+		cs.publishState(true)
+	}
+	close(stop)
+	wg.Wait()
+
+	// Once published, a planned watering in the wind is warned about
+	cs.scheduleWatering(units[0].UnitNumber, time.Now().Add(time.Minute), WateringRequest{Trigger: db.TriggerThreshold})
+	cs.publishState(true)
+	for _, w := range cs.currentWarnings() {
+		if w.Type == weatherWarningHighWind && w.Name == units[0].UnitName {
+			return
+		}
+	}
+	t.Errorf("no high wind warning for %s", units[0].UnitName)
+}
+
+// Each warning is for the unit its readings came from, after a unit before it is removed
+func TestWarningsAfterUnitRemoved(t *testing.T) {
+	cs := warningTestSystem(t)
+	units := cs.currentConfig().RemoteUnitConfigs
+	if len(units) < 2 {
+		t.Fatalf("the example config has %d units, want at least 2", len(units))
+	}
+	last := units[len(units)-1]
+	for i := range units {
+		cs.currentSensorAverages[i].Temperature = 20
+	}
+	cs.currentSensorAverages[len(units)-1].Temperature = 40
+	cs.linksMu.Lock()
+	for _, rmu := range units {
+		cs.unitLinks[rmu.UnitNumber] = &unitLink{UnitNumber: rmu.UnitNumber, UnitName: rmu.UnitName, State: linkOnline}
+	}
+	cs.linksMu.Unlock()
+
+	next := *cs.currentConfig()
+	next.RemoteUnitConfigs = append([]config.RemoteUnitConfig(nil), units[1:]...)
+	if err := cs.applyConfig(next, nil); err != nil {
+		t.Fatal(err)
+	}
+	cs.publishState(true)
+
+	var names []string
+	for _, w := range cs.currentWarnings() {
+		if w.Value == 40 {
+			names = append(names, w.Name)
+		}
+	}
+	if len(names) != 1 || names[0] != last.UnitName {
+		t.Errorf("high temperature warnings for %v, want only %s", names, last.UnitName)
+	}
+}
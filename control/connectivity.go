@@ -0,0 +1,221 @@
+package control
+
+import (
+	"as2controlv2/db"
+	"as2controlv2/events"
+	"fmt"
+	"time"
+)
+
+// The link states a remote unit can be in
+const (
+	linkUnknown  = "unknown"  // Not polled yet
+	linkOnline   = "online"   // Polling normally
+	linkDegraded = "degraded" // Some polls are failing, or the data is getting old
+	linkOffline  = "offline"  // Polls keep failing, or the data is too old to use
+)
+
+// Thresholds for moving between link states
+const (
+	offlineAfterFailures  = 3 // Consecutive failed polls before a unit is offline
+	onlineAfterSuccesses  = 2 // Consecutive good polls before a recovering unit is online again
+	degradedAfterInterval = 2 // Poll intervals without fresh data before a unit is degraded
+	offlineAfterInterval  = 4 // Poll intervals without fresh data before a unit is offline
+)
+
+// The status values written to storage for each state, higher is healthier
+var linkStatusCodes = map[string]uint{
+	linkOffline:  0,
+	linkDegraded: 1,
+	linkOnline:   2,
+	linkUnknown:  3,
+}
+
+// The connectivity of a single remote unit
+type unitLink struct {
+	UnitName             string    `json:"name"`
+	UnitNumber           uint      `json:"number"`
+	State                string    `json:"state"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	LastSuccess          time.Time `json:"last_success"`
+	LastAttempt          time.Time `json:"last_attempt"`
+	LastTransition       time.Time `json:"last_transition"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+// A link for a unit that hasn't been polled yet
+func newUnitLink(unitNumber uint, unitName string) unitLink {
+	return unitLink{
+		UnitName:       unitName,
+		UnitNumber:     unitNumber,
+		State:          linkUnknown,
+		LastTransition: time.Now(),
+	}
+}
+
+// Change the link of a unit, making it if this is the first time it has been seen. The change
+// returns the state the link should be in, any transition is written out once the lock is released
+func (cs *ControlSystem) updateLink(unitNumber uint, change func(l *unitLink) string) {
+	cs.linksMu.Lock()
+	l, ok := cs.unitLinks[unitNumber]
+	if !ok {
+		created := newUnitLink(unitNumber, cs.unitName(unitNumber))
+		l = &created
+		cs.unitLinks[unitNumber] = l
+	}
+	previous := l.State
+	if state := change(l); state != previous {
+		l.State = state
+		l.LastTransition = time.Now()
+	}
+	updated := *l
+	cs.linksMu.Unlock()
+
+	if updated.State != previous {
+		cs.announceLinkState(updated, previous)
+	}
+}
+
+// Record a successful poll of a unit
+func (cs *ControlSystem) recordPollSuccess(unitNumber uint) {
+	cs.updateLink(unitNumber, func(l *unitLink) string {
+		l.ConsecutiveSuccesses++
+		l.ConsecutiveFailures = 0
+		l.LastAttempt = time.Now()
+		l.LastSuccess = l.LastAttempt
+		l.LastError = ""
+
+		switch l.State {
+		case linkUnknown:
+			return linkOnline
+		case linkOffline:
+			// Don't trust a unit that has just come back until it has stayed up for a bit
+			if l.ConsecutiveSuccesses >= onlineAfterSuccesses {
+				return linkOnline
+			}
+			return linkDegraded
+		case linkDegraded:
+			if l.ConsecutiveSuccesses >= onlineAfterSuccesses {
+				return linkOnline
+			}
+		}
+		return l.State
+	})
+}
+
+// Record a failed poll of a unit
+func (cs *ControlSystem) recordPollFailure(unitNumber uint, err error) {
+	cs.updateLink(unitNumber, func(l *unitLink) string {
+		l.ConsecutiveFailures++
+		l.ConsecutiveSuccesses = 0
+		l.LastAttempt = time.Now()
+		l.LastError = err.Error()
+
+		if l.ConsecutiveFailures >= offlineAfterFailures {
+			return linkOffline
+		} else if l.State != linkOffline {
+			return linkDegraded
+		}
+		return l.State
+	})
+}
+
+// Downgrade any unit whose last good poll is too old, even if it hasn't been counted as failing,
+// for example when the whole poll loop has been stuck
+func (cs *ControlSystem) checkLinkFreshness() {
+	interval := time.Duration(cs.currentConfig().RemoteIntervalSeconds) * time.Second
+	if interval == 0 {
+		return
+	}
+	for _, link := range cs.linkSnapshot() {
+		if link.LastSuccess.IsZero() {
+			continue
+		}
+		cs.updateLink(link.UnitNumber, func(l *unitLink) string {
+			age := time.Since(l.LastSuccess)
+			if age > offlineAfterInterval*interval {
+				return linkOffline
+			} else if age > degradedAfterInterval*interval && l.State == linkOnline {
+				return linkDegraded
+			}
+			return l.State
+		})
+	}
+}
+
+// Write a unit's move to a new link state to storage and publish it
+func (cs *ControlSystem) announceLinkState(l unitLink, previous string) {
+	state := l.State
+	cs.logger.Info(fmt.Sprintf("unit %d link is now %s, was %s", l.UnitNumber, state, previous))
+
+	tags := db.Tags{
+		SystemName:     cs.currentConfig().Name,
+		RemoteUnitName: l.UnitName,
+	}
+	if err := cs.storage().WriteStatusMetric(tags, linkStatusCodes[state]); err != nil {
+		cs.logger.Error(fmt.Sprintf("could not write status for unit %d: %s", l.UnitNumber, err.Error()))
+	}
+	cs.writeEvent("link_state_change", l.UnitNumber, map[string]interface{}{
+		"from": previous,
+		"to":   state,
+	})
+	switch state {
+	case linkOnline:
+		cs.publishUnitEvent(events.TypeUnitOnline, l.UnitNumber, l)
+	case linkOffline:
+		cs.publishUnitEvent(events.TypeUnitOffline, l.UnitNumber, l)
+	}
+}
+
+// Whether a unit's readings are fresh enough to make decisions on and include in averages
+func (cs *ControlSystem) unitReadingsUsable(unitNumber uint) bool {
+	l := cs.linkStatus(unitNumber)
+	return l.State != linkOffline && l.State != linkUnknown
+}
+
+// Get a copy of the link of a unit, a unit that hasn't been polled yet is unknown
+func (cs *ControlSystem) linkStatus(unitNumber uint) unitLink {
+	cs.linksMu.Lock()
+	defer cs.linksMu.Unlock()
+	if l, ok := cs.unitLinks[unitNumber]; ok {
+		return *l
+	}
+	return newUnitLink(unitNumber, cs.unitName(unitNumber))
+}
+
+// Get a copy of every link that has been seen
+func (cs *ControlSystem) linkSnapshot() map[uint]unitLink {
+	cs.linksMu.Lock()
+	defer cs.linksMu.Unlock()
+	links := make(map[uint]unitLink, len(cs.unitLinks))
+	for unitNumber, l := range cs.unitLinks {
+		links[unitNumber] = *l
+	}
+	return links
+}
+
+// Get a copy of the link of every configured unit
+func (cs *ControlSystem) unitLinkStatuses() []unitLink {
+	links := make([]unitLink, 0, len(cs.currentConfig().RemoteUnitConfigs))
+	for _, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		links = append(links, cs.linkStatus(rmu.UnitNumber))
+	}
+	return links
+}
+
+// Generate a warning for every unit that is not online
+func (cs *ControlSystem) generateLinkWarnings() []warning {
+	ws := make([]warning, 0)
+	for _, l := range cs.unitLinkStatuses() {
+		if l.State != linkDegraded && l.State != linkOffline {
+			continue
+		}
+		ws = append(ws, warning{
+			Name:  l.UnitName,
+			Value: float64(l.ConsecutiveFailures),
+			Msg:   fmt.Sprintf("Unit %d is %s, its readings are not being used for watering decisions while offline", l.UnitNumber, l.State),
+		})
+	}
+	return ws
+}
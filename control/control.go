@@ -1,14 +1,20 @@
 package control
 
 import (
+	"as2controlv2/auth"
+	"as2controlv2/calibration"
 	"as2controlv2/config"
 	"as2controlv2/db"
+	"as2controlv2/events"
+	"as2controlv2/metrics"
 	"as2controlv2/serial"
 	"as2controlv2/weather"
 	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,29 +22,61 @@ import (
 type ControlSystem struct {
 	logger *slog.Logger
 
-	systemConfig config.Config // We want to be able to access all of our config
-
-	dbHandler             db.DBConnection              // Connection to write to InfluxDB
-	weatherHandler        weather.WeatherAPI           // Connection to pull data from OpenWeatherMap
-	serialHandler         serial.SerialConnection      // Connection to the serial port (Bluetooth module)
-	currentWeatherValues  weather.CurrentWeatherResult // The current weather prediction
-	currentSensorAverages []db.CurrentLocalValues      // The current average from all the sensor readings
-	systemTiming          Timings                      // The time coordination for the whole system
+	systemConfig atomic.Pointer[config.Config] // We want to be able to access all of our config, replaced whole when it changes
+
+	storageMu             sync.RWMutex
+	dbHandler             db.MetricsSink                 // Where metrics are written, normally InfluxDB. Read it with storage, it is swapped when the settings change
+	weatherHandler        *weather.WeatherAPI            // Connection to pull data from OpenWeatherMap
+	serialHandler         serial.SerialConnection        // Connection to the serial port (Bluetooth module)
+	currentWeatherValues  weather.CurrentWeatherResult   // The current weather prediction
+	currentSensorAverages []db.CurrentLocalValues        // The current average from all the sensor readings
+	systemTiming          Timings                        // The time coordination for the whole system
+	wateringHeldUntil     time.Time                      // Automatic watering is held off until this time by a weather action
+	wateringHoldReason    string                         // The warning type that is holding watering off
+	lastWeatherActions    map[string]time.Time           // When each weather warning type last triggered its action
+	lastWateredAt         map[uint]time.Time             // When each unit last finished watering
+	dryingRates           map[uint]dryingRate            // How fast each unit is drying out, from the stored history
+	historyMu             sync.Mutex                     // Protects the drying rates, which are worked out in the background
+	activeWaterings       map[uint]*wateringRun          // The waterings that are currently running
+	unitLinks             map[uint]*unitLink             // The connectivity of each remote unit
+	linksMu               sync.Mutex                     // Protects the links, which the API reads
+	growingDegreeDays     map[uint]map[float64]float64   // Accumulated growing degree days for each unit, by base temperature
+	calibrations          *calibration.Store             // Soil moisture calibration curves for each sensor
+	soilReadings          map[uint]soilReadings          // The last raw soil moisture readings from each unit, for capturing calibration points
+	soilReadingsMu        sync.Mutex                     // Protects the soil readings, which the API reads
+	lastPolls             map[uint]unitPoll              // The last successful poll of each unit, for the API
+	lastPollsMu           sync.Mutex                     // Protects the last polls
+	lastLoop              atomic.Int64                   // When the scheduler loop last went round, in unix nanoseconds
+	serialErr             error                          // Why the serial link could not be opened, nil if it is usable
+	weatherErr            error                          // The error from the last weather fetch, nil if it succeeded
+	healthMu              sync.Mutex                     // Protects the errors above, which the health checks read
+	events                *events.Bus                    // Where events are published for the live stream
+	activeWarnings        map[string]warning             // The warnings at the last check, to publish raised and cleared events
+	tokens                atomic.Pointer[auth.Store]     // The tokens that can use the API, and whether it is open without any
+	acknowledged          map[string]string              // Who acknowledged each raised warning, by warning key
+	acknowledgedMu        sync.Mutex                     // Protects the acknowledgements, which the API changes
+	configStore           *config.Store                  // The versioned config, nil if it can't be changed at runtime
+	configChanges         chan configChange              // Config changes from the API, for the scheduler loop to apply
+	scheduleCommands      chan scheduleCommand           // Schedule changes from the API, for the scheduler loop to make
+	published             atomic.Pointer[schedulerState] // The scheduler loop's state as the API sees it
 }
 
 // Struct to store the timings for the system
 type Timings struct {
-	NextRemoteUnitFetchTime    time.Time          // The next time to fetch data from the remote units
-	NextWeatherReportFetchTime time.Time          // The next time to fetch weather data from open weather map
-	NextRainReportFetchTime    time.Time          // The next time to fetch rain data from open weather map
-	NextWateringTime           map[uint]time.Time // In this case the keys are the corresponding zone, deleted after we are done
-	WateringUntilTime          map[uint]time.Time // This is where we store the time we water until, deleted after we are done
+	NextRemoteUnitFetchTime    time.Time                // The next time to fetch data from the remote units
+	NextWeatherReportFetchTime time.Time                // The next time to fetch weather data from open weather map
+	NextRainReportFetchTime    time.Time                // The next time to fetch rain data from open weather map
+	NextForecastFetchTime      time.Time                // The next time to fetch the forecast from open weather map
+	NextWeatherActionTime      time.Time                // The next time to check the weather warnings for actions
+	NextAgronomyTime           time.Time                // The next time to update the growing degree days
+	NextWateringTime           map[uint]time.Time       // In this case the keys are the corresponding zone, deleted after we are done
+	WateringUntilTime          map[uint]time.Time       // This is where we store the time we water until, deleted after we are done
+	WateringRequests           map[uint]WateringRequest // Why each pending watering was scheduled, deleted once it starts
 }
 
 // Initialise the control system
-func ControlSystemInit(logger *slog.Logger, config config.Config, dbHandler db.DBConnection, weatherHandler weather.WeatherAPI, serialHandler serial.SerialConnection) *ControlSystem {
-	return &ControlSystem{
-		systemConfig:          config,
+func ControlSystemInit(logger *slog.Logger, config config.Config, dbHandler db.MetricsSink, weatherHandler *weather.WeatherAPI, serialHandler serial.SerialConnection, calibrations *calibration.Store) *ControlSystem {
+	cs := &ControlSystem{
 		logger:                logger,
 		dbHandler:             dbHandler,
 		weatherHandler:        weatherHandler,
@@ -46,7 +84,25 @@ func ControlSystemInit(logger *slog.Logger, config config.Config, dbHandler db.D
 		currentWeatherValues:  weather.CurrentWeatherResult{},
 		currentSensorAverages: make([]db.CurrentLocalValues, len(config.RemoteUnitConfigs)),
 		systemTiming:          makeTimings(),
-	}
+		lastWeatherActions:    make(map[string]time.Time),
+		lastWateredAt:         make(map[uint]time.Time),
+		dryingRates:           make(map[uint]dryingRate),
+		activeWaterings:       make(map[uint]*wateringRun),
+		unitLinks:             make(map[uint]*unitLink),
+		growingDegreeDays:     make(map[uint]map[float64]float64),
+		calibrations:          calibrations,
+		soilReadings:          make(map[uint]soilReadings),
+		lastPolls:             make(map[uint]unitPoll),
+		events:                events.NewBus(),
+		activeWarnings:        make(map[string]warning),
+		acknowledged:          make(map[string]string),
+		configChanges:         make(chan configChange),
+		scheduleCommands:      make(chan scheduleCommand),
+	}
+	cs.systemConfig.Store(&config)
+	cs.publishState(true)
+	cs.registerMetrics(metrics.Default)
+	return cs
 }
 
 func makeTimings() Timings {
@@ -54,7 +110,12 @@ func makeTimings() Timings {
 		NextRemoteUnitFetchTime:    time.Now(),
 		NextWeatherReportFetchTime: time.Now(),
 		NextRainReportFetchTime:    time.Now(),
+		NextForecastFetchTime:      time.Now(),
+		NextWeatherActionTime:      time.Now(),
+		NextAgronomyTime:           time.Now(),
 		NextWateringTime:           make(map[uint]time.Time),
+		WateringUntilTime:          make(map[uint]time.Time),
+		WateringRequests:           make(map[uint]WateringRequest),
 	}
 }
 
@@ -83,7 +144,9 @@ func (cs *ControlSystem) FetchRemoteUnitReading(rmu config.RemoteUnitConfig, cur
 	humiditySum := 0.0
 	humidityCount := 0
 	soilMositureSum := 0.0
+	soilMoistureRawSum := 0.0
 	soilMoistureCount := 0
+	rawSoilReadings := make(map[string]float64)
 	flowRateSum := 0.0
 	flowRateCount := 0
 	// Since there is only one water on, we can just look for the water_on
@@ -119,8 +182,11 @@ func (cs *ControlSystem) FetchRemoteUnitReading(rmu config.RemoteUnitConfig, cur
 				// Its over 9000!!!
 				continue
 			}
+			calibrated, _ := cs.calibrations.Apply(rmu.UnitNumber, r.Name, r.Value)
 			soilMoistureCount++
-			soilMositureSum += r.Value
+			soilMositureSum += calibrated
+			soilMoistureRawSum += r.Value
+			rawSoilReadings[r.Name] = r.Value
 			continue
 		}
 
@@ -146,16 +212,32 @@ func (cs *ControlSystem) FetchRemoteUnitReading(rmu config.RemoteUnitConfig, cur
 	currentValues.Temperature = temperaturesSum / float64(temperatureCount)
 	currentValues.Humidity = humiditySum / float64(humidityCount)
 	currentValues.SoilMoisture = soilMositureSum / float64(soilMoistureCount)
+	currentValues.SoilMoistureRaw = soilMoistureRawSum / float64(soilMoistureCount)
+	// Not every unit has a flow meter, and NaN can't be written or served
+	currentValues.FlowRate = 0
+	if flowRateCount > 0 {
+		currentValues.FlowRate = flowRateSum / float64(flowRateCount)
+	}
+	deriveAgronomicValues(currentValues)
+	cs.recordPoll(rmu.UnitNumber, readings, *currentValues)
+	cs.publishUnitEvent(events.TypeReading, rmu.UnitNumber, readingsOf(*currentValues))
 	// Write these to InfluxDB
 	// Make the tags
 	tags := db.Tags{
-		SystemName:     cs.systemConfig.Name,
+		SystemName:     cs.currentConfig().Name,
 		RemoteUnitName: rmu.UnitName,
 	}
-	err = cs.dbHandler.WriteUnitMetrics(rmu.UnitName, *currentValues, tags)
-	if err != nil {
-		return err
+	// A storage failure shouldn't stop us from checking the watering below
+	if err = cs.storage().WriteUnitMetrics(rmu.UnitName, *currentValues, tags); err != nil {
+		cs.logger.Error(fmt.Sprintf("could not write metrics for unit %d: %s", rmu.UnitNumber, err.Error()))
 	}
+	cs.recordSoilReadings(rmu, rawSoilReadings, tags)
+
+	// Keep the drying trend up to date for the watering checks
+	cs.refreshDryingRate(rmu)
+
+	// Track how much water has gone out, and stop early once the soil is wet enough
+	cs.updateWateringRun(rmu.UnitNumber, *currentValues)
 
 	// TODO: Might want better error handling here, this function is really lloooonnnnngggg.
 
@@ -181,34 +263,63 @@ func (cs *ControlSystem) FetchRemoteUnitReading(rmu config.RemoteUnitConfig, cur
 
 // Fetch all of the currently configured remote units
 func (cs *ControlSystem) FetchRemoteUnitReadings() error {
+	if !cs.serialAvailable() {
+		return errSerialUnavailable
+	}
 	cs.logger.Info(fmt.Sprintf("current unit is: %d", cs.serialHandler.CurrentDevice))
 	// For each remote unit, grab all the values
-	for i, rmu := range cs.systemConfig.RemoteUnitConfigs {
+	for i, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		// Disabled units are left alone, unless they need polling to finish a watering
+		if _, watering := cs.activeWaterings[rmu.UnitNumber]; rmu.Disabled && !watering {
+			continue
+		}
 		// If check that we are on the right connection
 		if rmu.UnitNumber != cs.serialHandler.CurrentDevice {
 			// Switch to the device we want data from
 			cs.logger.Info(fmt.Sprintf("attempting to switch from device %d to device %d", cs.serialHandler.CurrentDevice, rmu.UnitNumber))
-			if err := cs.serialHandler.SwitchDevice(rmu.UnitNumber); err != nil {
-				return err
+			switchStart := time.Now()
+			err := cs.serialHandler.SwitchDevice(rmu.UnitNumber)
+			observeUnitOperation("as2_ble_switch_duration_seconds", "as2_ble_switches_total", rmu.UnitNumber, switchStart, err)
+			if err != nil {
+				// Count it against this unit and move on to the next one
+				cs.logger.Error(fmt.Sprintf("could not switch to unit %d: %s", rmu.UnitNumber, err.Error()))
+				cs.recordPollFailure(rmu.UnitNumber, err)
+				continue
 			}
 		}
+		pollStart := time.Now()
 		err := cs.FetchRemoteUnitReading(rmu, &cs.currentSensorAverages[i])
+		observeUnitOperation("as2_unit_poll_duration_seconds", "as2_unit_polls_total", rmu.UnitNumber, pollStart, err)
 		if err != nil {
 			// Don't return, just move on
 			cs.logger.Error(fmt.Sprintf("could not fetch sensor data from unit %d: %s", rmu.UnitNumber, err.Error()))
+			cs.recordPollFailure(rmu.UnitNumber, err)
 			continue
 		}
+		cs.recordPollSuccess(rmu.UnitNumber)
 	}
+	cs.checkLinkFreshness()
 	// Now go back to the original device
 	cs.serialHandler.CurrentDevice = 0
 	return nil
 }
 
-// Fetch the current weather data from OpenWeatherMap
+// Fetch the current weather data from OpenWeatherMap. On failure the last good observation
+// is kept, and it will be reported as stale once it gets too old
 func (cs *ControlSystem) FetchWeatherData() error {
 	weatherResult, err := cs.weatherHandler.GetCurrentWeather()
+	var retry *weather.RetryError
+	if errors.As(err, &retry) {
+		// It is tried again shortly, and only reported if the retries run out
+		return err
+	}
+	cs.recordWeatherResult(err)
 	if err != nil {
-		cs.logger.Error("could not fetch weather data")
+		if obs, ok := cs.weatherHandler.LastObservation(); ok {
+			cs.logger.Error(fmt.Sprintf("could not fetch weather data, keeping observation from %s ago", obs.Age().Round(time.Second)))
+		} else {
+			cs.logger.Error("could not fetch weather data, no previous observation to fall back on")
+		}
 		return err
 	}
 
@@ -216,7 +327,7 @@ func (cs *ControlSystem) FetchWeatherData() error {
 	cs.currentWeatherValues = weatherResult
 	cs.logger.Info("fetched weather data")
 	// Write to influxDB
-	if err := cs.dbHandler.WriteWeatherMetrics(weatherResult); err != nil {
+	if err := cs.storage().WriteWeatherMetrics(weatherResult); err != nil {
 		return err
 	}
 	return nil
@@ -228,21 +339,39 @@ func (cs *ControlSystem) CheckWatering() {
 		Check the current soil moisture in each zone, if it below the required threshold,
 		start watering in 20 minutes, unless the cancel endpoint is hit...
 
-		- This threshold is 25% soil moisture
+		- This threshold is 25% soil moisture, unless the watering policy says otherwise
+		- A zone that is drying fast enough to cross it in the next few hours is watered early
 	*/
+	if cs.wateringIsHeld() {
+		return
+	}
 	for i, rmu := range cs.currentSensorAverages {
-		if rmu.SoilMoisture < 25 {
-			if _, ok := cs.systemTiming.NextWateringTime[cs.systemConfig.RemoteUnitConfigs[i].UnitNumber]; ok {
+		if cs.currentConfig().RemoteUnitConfigs[i].Disabled {
+			continue
+		}
+		threshold := cs.wateringPolicy(cs.currentConfig().RemoteUnitConfigs[i].UnitNumber).ThresholdPercent
+		trigger := db.TriggerThreshold
+		if rmu.SoilMoisture >= threshold {
+			trigger = db.TriggerDryingTrend
+		}
+		// Don't water off the back of stale readings from a unit we can't reach
+		if !cs.unitReadingsUsable(cs.currentConfig().RemoteUnitConfigs[i].UnitNumber) {
+			continue
+		}
+		if rmu.SoilMoisture < threshold || cs.willDryOut(cs.currentConfig().RemoteUnitConfigs[i].UnitNumber, rmu.SoilMoisture) {
+			if _, ok := cs.systemTiming.NextWateringTime[cs.currentConfig().RemoteUnitConfigs[i].UnitNumber]; ok {
 				continue
 			}
-			if _, ok := cs.systemTiming.WateringUntilTime[cs.systemConfig.RemoteUnitConfigs[i].UnitNumber]; ok {
+			if _, ok := cs.systemTiming.WateringUntilTime[cs.currentConfig().RemoteUnitConfigs[i].UnitNumber]; ok {
 				continue
 			}
-			if cs.systemConfig.Mode == "automatic" {
-				// Set the watering to go off in 20 minutes
-				cs.systemTiming.NextWateringTime[cs.systemConfig.RemoteUnitConfigs[i].UnitNumber] = time.Now()
-				cs.logger.Info(fmt.Sprintf("scheduling unit number %d for watering in one minute", cs.systemConfig.RemoteUnitConfigs[i].UnitNumber))
-			} else if cs.systemConfig.Mode == "manual" {
+			if cs.currentConfig().Mode == "automatic" {
+				// Set the watering to go off at the start of the next watering window
+				unitNumber := cs.currentConfig().RemoteUnitConfigs[i].UnitNumber
+				at := cs.nextWateringStart(unitNumber)
+				cs.scheduleWatering(unitNumber, at, WateringRequest{Trigger: trigger, RequestedBy: requestedByController})
+				cs.logger.Info(fmt.Sprintf("scheduling unit number %d for watering at %s", unitNumber, at.Format(time.RFC3339)))
+			} else if cs.currentConfig().Mode == "manual" {
 				// Just suggest that we water, send shit to Grafana
 				// Work out how I am going to send off the warnings
 			}
@@ -260,15 +389,36 @@ func (cs *ControlSystem) HandleWateringOnEvent(unitNumber uint) error {
 	if cs.systemTiming.NextWateringTime == nil {
 		cs.systemTiming.NextWateringTime = make(map[uint]time.Time, 0)
 	}
-	err := cs.serialHandler.WriteToDevice(fmt.Sprintf("water_on=%d\r\n", unitNumber))
+	req := cs.wateringRequest(unitNumber)
+	err := cs.writeToDevice(fmt.Sprintf("water_on=%d\r\n", unitNumber))
 	if err != nil {
+		// Record the fault and drop the request, automatic watering will be scheduled again
+		// if the zone still needs it
+		cs.recordWateringFault(unitNumber, req)
 		return err
 	}
 	// Then delete it from the map as we don't need to store it anymore
 	cs.logger.Info(fmt.Sprintf("turning on watering for unit %d", unitNumber))
+	cs.writeEvent("watering_on", unitNumber, nil)
 	delete(cs.systemTiming.NextWateringTime, unitNumber)
-	// Then set a timer to water for some amount of time, maybe 20 minutes
-	cs.systemTiming.WateringUntilTime[unitNumber] = time.Now().Add(30 * time.Second)
+	delete(cs.systemTiming.WateringRequests, unitNumber)
+	// Then set a timer to water for the requested amount of time
+	cs.systemTiming.WateringUntilTime[unitNumber] = time.Now().Add(req.Duration)
+	cs.activeWaterings[unitNumber] = &wateringRun{
+		WateringRequest: req,
+		Start:           time.Now(),
+		lastFlowSample:  time.Now(),
+	}
+	cs.publishUnitEvent(events.TypeWateringStarted, unitNumber, scheduleEntry{
+		UnitName:        cs.unitName(unitNumber),
+		UnitNumber:      unitNumber,
+		State:           "active",
+		Start:           time.Now(),
+		Until:           cs.systemTiming.WateringUntilTime[unitNumber],
+		DurationSeconds: req.Duration.Seconds(),
+		Trigger:         req.Trigger,
+		RequestedBy:     req.RequestedBy,
+	})
 	return nil
 }
 
@@ -295,6 +445,14 @@ func (cs *ControlSystem) checkIfNeedsWateringOff(unitNumber uint) bool {
 	}
 }
 
+// Send a command over the serial link, if it is usable
+func (cs *ControlSystem) writeToDevice(msg string) error {
+	if !cs.serialAvailable() {
+		return errSerialUnavailable
+	}
+	return cs.serialHandler.WriteToDevice(msg)
+}
+
 // Handle turning off watering for a particular device
 func (cs *ControlSystem) HandleWateringOffEvent(unitNumber uint) error {
 	if cs.systemTiming.WateringUntilTime == nil {
@@ -303,25 +461,82 @@ func (cs *ControlSystem) HandleWateringOffEvent(unitNumber uint) error {
 	if cs.systemTiming.NextWateringTime == nil {
 		cs.systemTiming.NextWateringTime = make(map[uint]time.Time, 0)
 	}
-	err := cs.serialHandler.WriteToDevice(fmt.Sprintf("water_off=%d\r\n", unitNumber))
+	err := cs.writeToDevice(fmt.Sprintf("water_off=%d\r\n", unitNumber))
 	if err != nil {
 		return err
 	}
 	cs.logger.Info(fmt.Sprintf("turning off watering for unit %d", unitNumber))
+	cs.writeEvent("watering_off", unitNumber, nil)
+	cs.finishWateringRun(unitNumber)
 	// Now delete it from the watering map
 	delete(cs.systemTiming.WateringUntilTime, unitNumber)
+	cs.lastWateredAt[unitNumber] = time.Now()
 	return nil
 }
 
+// Get the config the system is running with. It is only ever replaced whole, never changed in
+// place, so it can be read from anywhere
+func (cs *ControlSystem) currentConfig() *config.Config {
+	return cs.systemConfig.Load()
+}
+
+// Get the storage backends metrics are written to and history is read from
+func (cs *ControlSystem) storage() db.MetricsSink {
+	cs.storageMu.RLock()
+	defer cs.storageMu.RUnlock()
+	return cs.dbHandler
+}
+
+// Get the config of a unit by its number
+func (cs *ControlSystem) unitConfig(unitNumber uint) (config.RemoteUnitConfig, bool) {
+	for _, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		if rmu.UnitNumber == unitNumber {
+			return rmu, true
+		}
+	}
+	return config.RemoteUnitConfig{}, false
+}
+
+// Get the configured name of a unit, or a placeholder if it is not configured
+func (cs *ControlSystem) unitName(unitNumber uint) string {
+	if rmu, ok := cs.unitConfig(unitNumber); ok {
+		return rmu.UnitName
+	}
+	return fmt.Sprintf("unit_%d", unitNumber)
+}
+
+// Write an event for a unit to storage, failures are only logged as events are not critical
+func (cs *ControlSystem) writeEvent(eventName string, unitNumber uint, fields map[string]interface{}) {
+	tags := db.Tags{
+		SystemName:     cs.currentConfig().Name,
+		RemoteUnitName: cs.unitName(unitNumber),
+	}
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["unit_number"] = unitNumber
+	if err := cs.storage().WriteEvent(eventName, tags, fields); err != nil {
+		cs.logger.Error(fmt.Sprintf("could not write %s event for unit %d: %s", eventName, unitNumber, err.Error()))
+	}
+}
+
 // Collection of sensor warnings, would be better as a type warnings []warning
 type warnings struct {
-	sensorWarnings []warning
+	sensorWarnings  []warning
+	weatherWarnings []warning
 }
 
 type warning struct {
-	Name  string  `json:"name"`
-	Value float64 `json:"value"`
-	Msg   string  `json:"message"`
+	Name       string     `json:"name"`
+	Value      float64    `json:"value"`
+	Msg        string     `json:"message"`
+	Type       string     `json:"type,omitempty"`        // Set for warnings that can trigger a weather action
+	ExpectedAt *time.Time `json:"expected_at,omitempty"` // When forecast weather is expected to arrive
+	Stale      bool       `json:"stale,omitempty"`       // Set when the warning is based on out of date weather data
+	Period     string     `json:"period,omitempty"`      // Whether the warning was raised during the day or night
+
+	Key          string `json:"key,omitempty"`          // Identifies the warning while it stays raised, for acknowledging it
+	Acknowledged bool   `json:"acknowledged,omitempty"` // Someone has seen the warning, it is still listed until it clears
 }
 
 // Gets the warnings for the system, based on most current data
@@ -333,33 +548,46 @@ func (cs *ControlSystem) GetNewWarnings() warnings {
 		to use
 	*/
 	ws := make([]warning, 0)
+	s := cs.state()
 
 	// Check temperatures, threshold is above 35 degrees, below 12 degrees
-	ws = append(ws, cs.generateTemperatureSensorWarnings()...)
+	ws = append(ws, cs.generateTemperatureSensorWarnings(s)...)
 
 	// Check humidities, threshold is above 90%, below 20%
-	ws = append(ws, cs.generateHumiditySensorWarnings()...)
+	ws = append(ws, cs.generateHumiditySensorWarnings(s)...)
+
+	// Check that storage is keeping up
+	ws = append(ws, cs.generateStorageWarnings()...)
+
+	// Check that every unit is reachable
+	ws = append(ws, cs.generateLinkWarnings()...)
 
-	// Check weather, if the temperatures and humidities are the same, lots of rain (>100mm),
-	// or lots of cloud cover
+	// Check the vapour pressure deficit, for plant stress
+	ws = append(ws, cs.generateAgronomyWarnings(s)...)
+
+	// Check weather, both the current observation and the forecast
 	return warnings{
-		sensorWarnings: ws,
+		sensorWarnings:  cs.withPeriod(ws),
+		weatherWarnings: cs.withPeriod(cs.generateWeatherWarnings(s)),
 	}
 }
 
 // Generate temperature sensor warnings from the last remote unit poll
-func (cs *ControlSystem) generateTemperatureSensorWarnings() []warning {
+func (cs *ControlSystem) generateTemperatureSensorWarnings(s *schedulerState) []warning {
 	ws := make([]warning, 0)
-	for i, v := range cs.currentSensorAverages {
+	for i, v := range s.SensorAverages {
+		if !cs.unitReadingsUsable(s.Units[i].UnitNumber) {
+			continue
+		}
 		if v.Temperature > 35 {
 			ws = append(ws, warning{
-				Name:  cs.systemConfig.RemoteUnitConfigs[i].UnitName,
+				Name:  s.Units[i].UnitName,
 				Value: v.Temperature,
 				Msg:   fmt.Sprintf("Temperture is high, Zone %d should be monitored", i),
 			})
 		} else if v.Temperature < 12 {
 			ws = append(ws, warning{
-				Name:  cs.systemConfig.RemoteUnitConfigs[i].UnitName,
+				Name:  s.Units[i].UnitName,
 				Value: v.Temperature,
 				Msg:   fmt.Sprintf("Temperature is low, Zone %d should be monitored", i),
 			})
@@ -370,18 +598,21 @@ func (cs *ControlSystem) generateTemperatureSensorWarnings() []warning {
 }
 
 // Generate humidity warnings from the last set of remote unit poll.
-func (cs *ControlSystem) generateHumiditySensorWarnings() []warning {
+func (cs *ControlSystem) generateHumiditySensorWarnings(s *schedulerState) []warning {
 	ws := make([]warning, 0)
-	for i, v := range cs.currentSensorAverages {
+	for i, v := range s.SensorAverages {
+		if !cs.unitReadingsUsable(s.Units[i].UnitNumber) {
+			continue
+		}
 		if v.Humidity > 90 {
 			ws = append(ws, warning{
-				Name:  cs.systemConfig.RemoteUnitConfigs[i].UnitName,
+				Name:  s.Units[i].UnitName,
 				Value: v.Humidity,
 				Msg:   fmt.Sprintf("Humidity is very high, Zone %d should be monitored", i),
 			})
 		} else if v.Humidity < 20 {
 			ws = append(ws, warning{
-				Name:  cs.systemConfig.RemoteUnitConfigs[i].UnitName,
+				Name:  s.Units[i].UnitName,
 				Value: v.Humidity,
 				Msg:   fmt.Sprintf("Humidity is very low, Zone %d should be monitored", i),
 			})
@@ -390,26 +621,77 @@ func (cs *ControlSystem) generateHumiditySensorWarnings() []warning {
 	return ws
 }
 
+// Check whether the current weather values are too old to base decisions on
+func (cs *ControlSystem) weatherIsStale() bool {
+	obs, _ := cs.weatherHandler.LastObservation()
+	return obs.IsStale(cs.weatherHandler.StaleAfter())
+}
+
+// Generate a warning if writes to storage are backing up, which means the database is unreachable
+func (cs *ControlSystem) generateStorageWarnings() []warning {
+	ws := make([]warning, 0)
+	buffered, ok := cs.storage().(db.Buffered)
+	if !ok {
+		return ws
+	}
+	// A handful of points is normal between drains
+	if depth := buffered.QueueDepth(); depth > 100 {
+		ws = append(ws, warning{
+			Name:  "Storage backlog",
+			Value: float64(depth),
+			Msg:   "Metrics are queueing up waiting to be written, check that InfluxDB is reachable",
+		})
+	}
+	if dropped := buffered.QueueDropped(); dropped > 0 {
+		ws = append(ws, warning{
+			Name:  "Storage points dropped",
+			Value: float64(dropped),
+			Msg:   "The write queue filled up and the oldest metrics were dropped",
+		})
+	}
+	return ws
+}
+
 // Generate weather warnings from the last weather data fetch
-func (cs *ControlSystem) generateWeatherWarnings() []warning {
-	// Check the cloud cover mainly,
+func (cs *ControlSystem) generateWeatherWarnings(s *schedulerState) []warning {
 	ws := make([]warning, 0)
-	if cs.currentWeatherValues.Clouds.All > 90 {
+	obs, ok := s.Observation, s.HaveObservation
+	if !ok {
+		// No observation to base any warnings on yet, but there may be a forecast
+		return append(ws, cs.generateForecastWarnings(s)...)
+	}
+	stale := obs.IsStale(cs.weatherHandler.StaleAfter())
+	if stale {
+		ws = append(ws, warning{
+			Name:  "Stale weather data",
+			Value: obs.Age().Minutes(),
+			Msg:   "Weather data has not been updated recently, weather warnings may be out of date",
+			Stale: true,
+		})
+	}
+
+	// Check the cloud cover mainly, which only matters while the sun is up
+	if s.Weather.Clouds.All > 90 && cs.currentPeriod() == periodDay {
 		ws = append(ws, warning{
 			Name:  "Cloud cover",
-			Value: cs.currentWeatherValues.Clouds.All,
+			Value: s.Weather.Clouds.All,
 			Msg:   "It is very cloudy, plants may not receive optimal sunlight",
+			Stale: stale,
 		})
 	}
 
 	// Check the wind, 20m/s is nearly cyclonic
-	if cs.currentWeatherValues.Wind.Speed > 20 {
+	if s.Weather.Wind.Speed > 20 {
 		ws = append(ws, warning{
 			Name:  "High Wind Speed",
-			Value: cs.currentWeatherValues.Wind.Speed,
+			Value: s.Weather.Wind.Speed,
 			Msg:   "The current wind speed is very high, ensure plants are sheltered",
+			Stale: stale,
 		})
 	}
+
+	ws = append(ws, cs.generateObservedWeatherWarnings(s, stale)...)
+	ws = append(ws, cs.generateForecastWarnings(s)...)
 	return ws
 }
 
@@ -417,6 +699,12 @@ func (cs *ControlSystem) generateWeatherWarnings() []warning {
 // triggers the appropriate event
 func (cs *ControlSystem) CheckTimings() error {
 	for {
+		cs.heartbeat()
+
+		// Config changes go in between iterations, so nothing below sees half of one
+		cs.applyConfigChanges()
+		cs.applyScheduleCommands()
+
 		// Check fetch times
 		if err := cs.CheckFetchTimes(); err != nil {
 			cs.logger.Error(fmt.Sprintf("could not fetch remote data: %s", err.Error()))
@@ -427,9 +715,22 @@ func (cs *ControlSystem) CheckTimings() error {
 			cs.logger.Error(fmt.Sprintf("could not fetch weather data: %s", err.Error()))
 		}
 
+		// Check forecast times
+		if err := cs.CheckForecastFetchTimes(); err != nil {
+			cs.logger.Error(fmt.Sprintf("could not fetch forecast data: %s", err.Error()))
+		}
+
 		// Check that we need to water soon
 		cs.CheckWatering()
 
+		// Act on any weather warnings
+		cs.CheckWeatherActionTimes()
+
+		// Update the growing degree days
+		cs.CheckAgronomyTimes()
+
+		cs.publishState(false)
+
 	}
 }
 
@@ -437,7 +738,7 @@ func (cs *ControlSystem) CheckTimings() error {
 func (cs *ControlSystem) CheckFetchTimes() error {
 	if time.Now().After(cs.systemTiming.NextRemoteUnitFetchTime) {
 		// Set the next time
-		cs.systemTiming.NextRemoteUnitFetchTime = time.Now().Add(time.Duration(cs.systemConfig.RemoteIntervalSeconds) * time.Second)
+		cs.systemTiming.NextRemoteUnitFetchTime = time.Now().Add(time.Duration(cs.currentConfig().RemoteIntervalSeconds) * time.Second)
 		// Fetch the new remote units
 		err := cs.FetchRemoteUnitReadings()
 		if err != nil {
@@ -451,14 +752,46 @@ func (cs *ControlSystem) CheckFetchTimes() error {
 func (cs *ControlSystem) CheckWeatherFetchTimes() error {
 	if time.Now().After(cs.systemTiming.NextWeatherReportFetchTime) {
 		// Set the next time
-		cs.systemTiming.NextWeatherReportFetchTime = time.Now().Add(time.Duration(cs.systemConfig.WeatherIntervalSeconds) * time.Second)
+		cs.systemTiming.NextWeatherReportFetchTime = time.Now().Add(time.Duration(cs.currentConfig().WeatherIntervalSeconds) * time.Second)
 		if err := cs.FetchWeatherData(); err != nil {
+			retryWeatherFetch(&cs.systemTiming.NextWeatherReportFetchTime, err)
 			return err
 		}
 	}
 	return nil
 }
 
+// Check the forecast fetching times for the system, the forecast is fetched as often as the weather
+func (cs *ControlSystem) CheckForecastFetchTimes() error {
+	if time.Now().After(cs.systemTiming.NextForecastFetchTime) {
+		cs.systemTiming.NextForecastFetchTime = time.Now().Add(time.Duration(cs.currentConfig().WeatherIntervalSeconds) * time.Second)
+		if _, err := cs.weatherHandler.GetForecast(); err != nil {
+			retryWeatherFetch(&cs.systemTiming.NextForecastFetchTime, err)
+			return err
+		}
+		cs.logger.Info("fetched forecast data")
+	}
+	return nil
+}
+
+// Bring a weather fetch forward for a request that is worth retrying, rather than waiting for
+// the next one. The loop carries on in the meantime
+func retryWeatherFetch(next *time.Time, err error) {
+	var retry *weather.RetryError
+	if errors.As(err, &retry) {
+		*next = time.Now().Add(retry.Wait)
+	}
+}
+
+// Check the weather warnings for actions every 30 seconds
+func (cs *ControlSystem) CheckWeatherActionTimes() {
+	if time.Now().After(cs.systemTiming.NextWeatherActionTime) {
+		cs.systemTiming.NextWeatherActionTime = time.Now().Add(30 * time.Second)
+		cs.CheckWeatherActions()
+		cs.publishWarningChanges()
+	}
+}
+
 // Check if we need to water for each system
 func (cs *ControlSystem) CheckWateringOnTimes() error {
 	if cs.systemTiming.NextWateringTime == nil {
@@ -1,6 +1,8 @@
 package control
 
 import (
+	"as2controlv2/db"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -11,11 +13,7 @@ import (
 
 // Route GET: Produce the warnings for Grafana
 func (cs *ControlSystem) RouteGETWarnings(c *gin.Context) {
-	// Get the warnings
-	warnings := cs.generateTemperatureSensorWarnings()
-	warnings = append(warnings, cs.generateHumiditySensorWarnings()...)
-	warnings = append(warnings, cs.generateWeatherWarnings()...)
-	c.JSON(http.StatusOK, warnings)
+	c.JSON(http.StatusOK, cs.currentWarnings())
 }
 
 // Route POST: Delay watering for a particular unit by 60 minutes
@@ -26,6 +24,7 @@ func (cs *ControlSystem) RoutePOSTDelayWatering(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"msg": "no unit to delay given",
 		})
+		return
 	}
 
 	unit, err := strconv.Atoi(unitStr)
@@ -33,17 +32,16 @@ func (cs *ControlSystem) RoutePOSTDelayWatering(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"msg": "invalid unit to delay, parse error",
 		})
+		return
 	}
 
-	// Check if the unit is to be watered
-	if _, ok := cs.systemTiming.NextWateringTime[uint(unit)]; !ok {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"msg": "unit is not to be watered",
+	// Now delay the watering
+	if _, err := cs.delayWatering(c.Request.Context(), uint(unit), 60*time.Minute); err != nil {
+		c.JSON(legacyStatus(err), gin.H{
+			"msg": err.Error(),
 		})
+		return
 	}
-
-	// Now delay the watering
-	cs.systemTiming.NextWateringTime[uint(unit)] = cs.systemTiming.NextWateringTime[uint(unit)].Add(60 * time.Minute)
 	c.JSON(http.StatusOK, gin.H{
 		"msg": fmt.Sprintf("unit %d has been delayed by 60 minutes", unit),
 	})
@@ -67,15 +65,13 @@ func (cs *ControlSystem) RoutePOSTCancelWatering(c *gin.Context) {
 		return
 	}
 
-	if _, ok := cs.systemTiming.WateringUntilTime[uint(unit)]; !ok {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"msg": "unit is not watering",
+	// Schedule it for the next sensor scrape
+	if err := cs.cancelWatering(c.Request.Context(), uint(unit)); err != nil {
+		c.JSON(legacyStatus(err), gin.H{
+			"msg": err.Error(),
 		})
 		return
 	}
-
-	// Schedule it for the next sensor scrape
-	cs.systemTiming.WateringUntilTime[uint(unit)] = time.Now()
 	c.JSON(http.StatusOK, gin.H{
 		"msg": fmt.Sprintf("switching water for unit %d off for now", unit),
 	})
@@ -99,22 +95,126 @@ func (cs *ControlSystem) RoutePOSTWaterNow(c *gin.Context) {
 		})
 		return
 	}
-	// Check if it is already scheduled
-	ok := false
-	for _, unitConfig := range cs.systemConfig.RemoteUnitConfigs {
-		if unitConfig.UnitNumber == uint(unit) {
-			ok = true
-			break
-		}
+	if err := cs.waterNow(c.Request.Context(), uint(unit), 0, requestedBy(c)); err != nil {
+		c.JSON(legacyStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": fmt.Sprintf("scheduled watering for unit %d for now", unit),
+	})
+}
+
+// The status the original routes responded with for an error, they predate the not found and
+// conflict responses of /api/v1 and used bad request for both
+func legacyStatus(err error) int {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return http.StatusInternalServerError
+	}
+	if apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusConflict {
+		return http.StatusBadRequest
+	}
+	return apiErr.Status
+}
+
+// Route GET: Serve the stored history of a unit for charts, route is
+// /api/history?unit=1&metric=soil_moisture&hours=24 or /api/history?unit=1&metric=water_volume&days=7
+func (cs *ControlSystem) RouteGETHistory(c *gin.Context) {
+	unit, err := strconv.Atoi(c.Query("unit"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid or missing unit",
+		})
+		return
 	}
+	rmu, ok := cs.unitConfig(uint(unit))
 	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"msg": "unit number does not exist",
 		})
 		return
 	}
-	cs.systemTiming.NextWateringTime[uint(unit)] = time.Now()
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid number of hours",
+		})
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid number of days",
+		})
+		return
+	}
+
+	metric := c.DefaultQuery("metric", "soil_moisture")
+	data, err := cs.unitHistory(rmu, metric, hours, days)
+	if err != nil {
+		c.JSON(legacyStatus(err), gin.H{
+			"msg": err.Error(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"msg": fmt.Sprintf("scheduled watering for unit %d for now", unit),
+		"unit":   rmu.UnitNumber,
+		"name":   rmu.UnitName,
+		"metric": metric,
+		"data":   data,
 	})
 }
+
+// Route GET: Serve the record of past waterings, route is /api/watering-history?unit=1&hours=168,
+// every unit is included if no unit is given
+func (cs *ControlSystem) RouteGETWateringHistory(c *gin.Context) {
+	history, ok := cs.storage().(db.HistoryReader)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"msg": "storage backend does not support history queries",
+		})
+		return
+	}
+
+	unitName := ""
+	if unitStr := c.Query("unit"); unitStr != "" {
+		unit, err := strconv.Atoi(unitStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"msg": "non-numeric unit given",
+			})
+			return
+		}
+		rmu, ok := cs.unitConfig(uint(unit))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"msg": "unit number does not exist",
+			})
+			return
+		}
+		unitName = rmu.UnitName
+	}
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "168"))
+	if err != nil || hours <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "invalid number of hours",
+		})
+		return
+	}
+
+	events, err := history.WateringHistory(unitName, time.Duration(hours)*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"msg": fmt.Sprintf("could not query watering history: %s", err.Error()),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// Route GET: The connectivity state of every remote unit
+func (cs *ControlSystem) RouteGETConnectivity(c *gin.Context) {
+	c.JSON(http.StatusOK, cs.unitLinkStatuses())
+}
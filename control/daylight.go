@@ -0,0 +1,117 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/weather"
+	"fmt"
+	"time"
+)
+
+// The parts of the day a warning can refer to
+const (
+	periodDay   = "day"
+	periodNight = "night"
+)
+
+// Get sunrise and sunset for the calendar day of t. The weather observation is used when it is for
+// the same day and not stale, otherwise they are calculated from the configured coordinates
+func (cs *ControlSystem) sunTimes(t time.Time) (weather.SunTimes, bool) {
+	if obs, ok := cs.weatherHandler.LastObservation(); ok && !cs.weatherIsStale() {
+		st := obs.Result.SunTimes()
+		y1, m1, d1 := st.Sunrise.In(t.Location()).Date()
+		y2, m2, d2 := t.Date()
+		if y1 == y2 && m1 == m2 && d1 == d2 {
+			return st, true
+		}
+	}
+	return weather.SolarTimes(cs.currentConfig().WeatherAPIConfig.Latitude, cs.currentConfig().WeatherAPIConfig.Longitude, t)
+}
+
+// Whether it is currently daytime or night-time at the site
+func (cs *ControlSystem) currentPeriod() string {
+	now := time.Now()
+	st, ok := cs.sunTimes(now)
+	if !ok {
+		// Polar day or night, there is no sensible answer so treat it as day
+		return periodDay
+	}
+	if st.IsDaytime(now) {
+		return periodDay
+	}
+	return periodNight
+}
+
+// Get the watering windows for a unit, its own if it has any, otherwise the system ones
+func (cs *ControlSystem) wateringWindows(unitNumber uint) []config.WateringWindow {
+	for _, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		if rmu.UnitNumber == unitNumber && len(rmu.WateringWindows) > 0 {
+			return rmu.WateringWindows
+		}
+	}
+	return cs.currentConfig().WateringWindows
+}
+
+// Work out the start and end of a watering window on the calendar day of t
+func (cs *ControlSystem) windowOnDay(w config.WateringWindow, t time.Time) (time.Time, time.Time, error) {
+	st, ok := cs.sunTimes(t)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("sun does not rise or set on %s", t.Format(time.DateOnly))
+	}
+	var event time.Time
+	switch w.Event {
+	case config.SolarEventSunrise:
+		event = st.Sunrise
+	case config.SolarEventSunset:
+		event = st.Sunset
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown solar event %q", w.Event)
+	}
+	start := event.Add(time.Duration(w.OffsetMinutes) * time.Minute)
+	return start, start.Add(time.Duration(w.DurationMinutes) * time.Minute), nil
+}
+
+// Get the earliest time at or after now that a unit may start watering. If the unit has no
+// watering windows it can start straight away
+func (cs *ControlSystem) nextWateringStart(unitNumber uint) time.Time {
+	now := time.Now()
+	windows := cs.wateringWindows(unitNumber)
+	if len(windows) == 0 {
+		return now
+	}
+
+	var next time.Time
+	// Yesterday's window may still be open if it runs past midnight
+	for day := -1; day <= 1; day++ {
+		t := now.AddDate(0, 0, day)
+		for _, w := range windows {
+			start, end, err := cs.windowOnDay(w, t)
+			if err != nil {
+				cs.logger.Warn(fmt.Sprintf("could not work out watering window for unit %d: %s", unitNumber, err.Error()))
+				continue
+			}
+			if !end.After(now) {
+				continue
+			}
+			if start.Before(now) {
+				return now // We are inside a window
+			}
+			if next.IsZero() || start.Before(next) {
+				next = start
+			}
+		}
+	}
+	if next.IsZero() {
+		// No window could be worked out, rather water than let the plants dry out
+		return now
+	}
+	return next
+}
+
+// Mark each warning with whether it was raised during the day or night
+func (cs *ControlSystem) withPeriod(ws []warning) []warning {
+	period := cs.currentPeriod()
+	for i := range ws {
+		ws[i].Period = period
+	}
+	return ws
+}
@@ -0,0 +1,227 @@
+package control
+
+import (
+	"as2controlv2/events"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// How often a comment is sent down an idle event stream, so proxies don't close it
+const streamKeepAlive = 15 * time.Second
+
+// Get the bus that events are published on, so other parts of the system can publish to it
+func (cs *ControlSystem) Events() *events.Bus {
+	return cs.events
+}
+
+// Publish an event for a unit
+func (cs *ControlSystem) publishUnitEvent(eventType string, unitNumber uint, data interface{}) {
+	cs.events.Publish(eventType, cs.unitName(unitNumber), data)
+}
+
+// The key a warning is tracked under between checks. Forecast warnings have values in their
+// message that change as the forecast does, so they are tracked by type instead
+func warningKey(w warning) string {
+	if w.Type != "" {
+		return w.Name + "|" + w.Type
+	}
+	return w.Name + "|" + w.Msg
+}
+
+// Compare the current warnings against the last check, publishing the ones that were raised or
+// cleared in between. Called from the scheduler loop, so it works from the loop's state as it is now
+func (cs *ControlSystem) publishWarningChanges() {
+	current := cs.warningsFor(cs.snapshot())
+	active := make(map[string]warning, len(current))
+	for _, w := range current {
+		key := warningKey(w)
+		active[key] = w
+		if _, ok := cs.activeWarnings[key]; !ok {
+			cs.events.Publish(events.TypeWarningRaised, cs.warningUnit(w), w)
+		}
+	}
+	for key, w := range cs.activeWarnings {
+		if _, ok := active[key]; !ok {
+			cs.events.Publish(events.TypeWarningCleared, cs.warningUnit(w), w)
+			// If it is raised again it needs acknowledging again
+			cs.acknowledgedMu.Lock()
+			delete(cs.acknowledged, key)
+			cs.acknowledgedMu.Unlock()
+		}
+	}
+	cs.activeWarnings = active
+}
+
+// The unit a warning is for, empty for warnings about the whole system
+func (cs *ControlSystem) warningUnit(w warning) string {
+	if _, ok := cs.findUnit(w.Name); ok {
+		return w.Name
+	}
+	return ""
+}
+
+// Work out which events a client wants from the request. Units can be given by number or name
+// and are converted to names, which is what events carry
+func (cs *ControlSystem) eventFilter(c *gin.Context) events.Filter {
+	var filter events.Filter
+	for _, id := range splitList(c.Query("unit")) {
+		if rmu, ok := cs.findUnit(id); ok {
+			filter.Units = append(filter.Units, rmu.UnitName)
+		} else {
+			filter.Units = append(filter.Units, id)
+		}
+	}
+	filter.Types = splitList(c.Query("type"))
+	return filter
+}
+
+// The last event a client has seen, from the Last-Event-ID header browsers send when they
+// reconnect, or the last_event_id query for clients that can't set headers
+func lastEventID(c *gin.Context) uint64 {
+	id := c.GetHeader("Last-Event-ID")
+	if id == "" {
+		id = c.Query("last_event_id")
+	}
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return n
+}
+
+// Split a comma separated query value, ignoring empty entries
+func splitList(s string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Route GET: Stream events as Server-Sent Events, route is /api/events?unit=1,2&type=reading
+func (cs *ControlSystem) RouteGETEvents(c *gin.Context) {
+	sub, backlog := cs.events.Subscribe(cs.eventFilter(c), lastEventID(c))
+	defer sub.Cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	write := func(e events.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	for _, e := range backlog {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// We fell behind, the client will reconnect and resume
+				return
+			}
+			if err := write(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// Whether a page from an origin may open the event WebSocket. Browsers send cookies and the like
+// with cross-site WebSockets and don't check CORS, so only pages from this host or an allowed
+// origin can. Clients that send no Origin at all aren't browsers, so are let through
+func (cs *ControlSystem) originAllowed(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, allowed := range cs.currentConfig().API.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route GET: Stream events over a WebSocket as JSON messages, taking the same query as /api/events
+func (cs *ControlSystem) RouteGETEventsWebSocket(c *gin.Context) {
+	filter := cs.eventFilter(c)
+	lastID := lastEventID(c)
+	server := websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			if !cs.originAllowed(r.Header.Get("Origin"), r.Host) {
+				return fmt.Errorf("origin %q is not allowed", r.Header.Get("Origin"))
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			sub, backlog := cs.events.Subscribe(filter, lastID)
+			defer sub.Cancel()
+
+			// Nothing is expected from the client, reading just tells us when it has gone away
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var msg string
+				for websocket.Message.Receive(ws, &msg) == nil {
+				}
+			}()
+
+			for _, e := range backlog {
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			}
+			for {
+				select {
+				case e, ok := <-sub.C:
+					if !ok {
+						return
+					}
+					if err := websocket.JSON.Send(ws, e); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
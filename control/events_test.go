@@ -0,0 +1,30 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	conf := config.MakeExampleConfig()
+	conf.API.AllowedOrigins = []string{"https://dashboard.example.com/"}
+	cs := &ControlSystem{}
+	cs.systemConfig.Store(&conf)
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "", want: true},
+		{origin: "http://controller.local:8080", want: true},
+		{origin: "https://dashboard.example.com", want: true},
+		{origin: "https://evil.example.com", want: false},
+		{origin: "http://controller.local", want: false},
+		{origin: "null", want: false},
+	}
+	for _, tt := range tests {
+		if got := cs.originAllowed(tt.origin, "controller.local:8080"); got != tt.want {
+			t.Errorf("origin %q allowed = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package control
+
+import (
+	"as2controlv2/db"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The states a subsystem can be in, from best to worst
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// The scheduler loop is considered stuck once it has not gone round for this long, plus
+// schedulerStallPerUnit for every unit since polling them all happens inside a single iteration
+const (
+	schedulerStallAfter   = 2 * time.Minute
+	schedulerStallPerUnit = 30 * time.Second
+)
+
+// Returned by the polling functions when the serial link could not be opened at startup
+var errSerialUnavailable = errors.New("serial link is unavailable")
+
+// The health of a single part of the system
+type subsystemHealth struct {
+	Name        string    `json:"name"`
+	Status      string    `json:"status"`
+	Required    bool      `json:"required"` // The system is not ready while a required subsystem is down
+	LastSuccess time.Time `json:"last_success"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+// The health of the whole system
+type healthReport struct {
+	Status     string            `json:"status"`
+	CheckedAt  time.Time         `json:"checked_at"`
+	Subsystems []subsystemHealth `json:"subsystems"`
+}
+
+// What the probes answer with. They need no token, so the unit names and errors in the full
+// report are left out, it is at /api/v1/health for viewers
+type probeResult struct {
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Mark the serial link as unavailable, so the system runs without polling or watering and
+// reports itself as not ready rather than failing on first use of the link
+func (cs *ControlSystem) SetSerialUnavailable(err error) {
+	cs.healthMu.Lock()
+	defer cs.healthMu.Unlock()
+	cs.serialErr = err
+}
+
+// Whether the serial link can be used
+func (cs *ControlSystem) serialAvailable() bool {
+	cs.healthMu.Lock()
+	defer cs.healthMu.Unlock()
+	return cs.serialErr == nil
+}
+
+// Record that the scheduler loop has gone round
+func (cs *ControlSystem) heartbeat() {
+	cs.lastLoop.Store(time.Now().UnixNano())
+}
+
+// Record the result of a weather fetch
+func (cs *ControlSystem) recordWeatherResult(err error) {
+	cs.healthMu.Lock()
+	defer cs.healthMu.Unlock()
+	cs.weatherErr = err
+}
+
+// Work out the health of every subsystem
+func (cs *ControlSystem) healthReport() healthReport {
+	report := healthReport{CheckedAt: time.Now()}
+	report.Subsystems = append(report.Subsystems, cs.schedulerHealth(), cs.serialHealth())
+	report.Subsystems = append(report.Subsystems, cs.storageHealth()...)
+	report.Subsystems = append(report.Subsystems, cs.weatherHealth())
+	report.Subsystems = append(report.Subsystems, cs.unitHealth()...)
+
+	report.Status = healthOK
+	for _, s := range report.Subsystems {
+		if s.Status == healthDown && s.Required {
+			report.Status = healthDown
+			break
+		}
+		if s.Status != healthOK {
+			report.Status = healthDegraded
+		}
+	}
+	return report
+}
+
+// The scheduler loop is healthy as long as it keeps going round
+func (cs *ControlSystem) schedulerHealth() subsystemHealth {
+	h := subsystemHealth{Name: "scheduler", Status: healthOK, Required: true}
+	nanos := cs.lastLoop.Load()
+	if nanos == 0 {
+		h.Status = healthDown
+		h.Detail = "scheduler loop has not started"
+		return h
+	}
+	h.LastSuccess = time.Unix(0, nanos)
+	stallAfter := schedulerStallAfter + time.Duration(len(cs.currentConfig().RemoteUnitConfigs))*schedulerStallPerUnit
+	if age := time.Since(h.LastSuccess); age > stallAfter {
+		h.Status = healthDown
+		h.Detail = fmt.Sprintf("scheduler loop has not run for %s", age.Round(time.Second))
+	}
+	return h
+}
+
+// The serial link is healthy if it opened and some unit has answered over it recently
+func (cs *ControlSystem) serialHealth() subsystemHealth {
+	h := subsystemHealth{Name: "serial", Status: healthOK, Required: true}
+	cs.healthMu.Lock()
+	serialErr := cs.serialErr
+	cs.healthMu.Unlock()
+	if serialErr != nil {
+		h.Status = healthDown
+		h.Detail = serialErr.Error()
+		return h
+	}
+
+	anyOnline, anyPolled := false, false
+	for _, l := range cs.unitLinkStatuses() {
+		if l.LastSuccess.After(h.LastSuccess) {
+			h.LastSuccess = l.LastSuccess
+		}
+		if l.State != linkUnknown {
+			anyPolled = true
+		}
+		if l.State == linkOnline || l.State == linkDegraded {
+			anyOnline = true
+		}
+	}
+	if anyPolled && !anyOnline {
+		h.Status = healthDegraded
+		h.Detail = "no remote unit is answering over the link"
+	}
+	return h
+}
+
+// Each storage backend, from the result of its last write
+func (cs *ControlSystem) storageHealth() []subsystemHealth {
+	reporter, ok := cs.storage().(db.HealthReporter)
+	if !ok {
+		return nil
+	}
+	statuses := reporter.BackendHealth()
+	healths := make([]subsystemHealth, 0, len(statuses))
+	for _, s := range statuses {
+		h := subsystemHealth{
+			Name:        "storage:" + s.Backend,
+			Status:      healthOK,
+			Required:    true,
+			LastSuccess: s.LastSuccess,
+		}
+		if !s.Healthy {
+			// Queued writes are kept, so a backend we are queueing for only degrades the system
+			h.Status = healthDown
+			if s.Backend == db.BackendInfluxDB {
+				h.Status = healthDegraded
+			}
+			h.Detail = fmt.Sprintf("%s, %d points queued", s.LastError, s.QueueDepth)
+		}
+		healths = append(healths, h)
+	}
+	return healths
+}
+
+// The weather provider is healthy while we have an observation that isn't stale
+func (cs *ControlSystem) weatherHealth() subsystemHealth {
+	h := subsystemHealth{Name: "weather", Status: healthOK}
+	obs, ok := cs.weatherHandler.LastObservation()
+	cs.healthMu.Lock()
+	weatherErr := cs.weatherErr
+	cs.healthMu.Unlock()
+	if ok {
+		h.LastSuccess = obs.FetchedAt
+	}
+	switch {
+	case !ok && weatherErr != nil:
+		h.Status = healthDown
+		h.Detail = weatherErr.Error()
+	case !ok:
+		h.Status = healthDegraded
+		h.Detail = "no weather observation yet"
+	case obs.Age() > cs.weatherHandler.StaleAfter():
+		h.Status = healthDegraded
+		h.Detail = fmt.Sprintf("weather observation is %s old", obs.Age().Round(time.Second))
+	case weatherErr != nil:
+		h.Status = healthDegraded
+		h.Detail = weatherErr.Error()
+	}
+	return h
+}
+
+// Each remote unit, from its link state
+func (cs *ControlSystem) unitHealth() []subsystemHealth {
+	links := cs.unitLinkStatuses()
+	healths := make([]subsystemHealth, 0, len(links))
+	for _, l := range links {
+		h := subsystemHealth{
+			Name:        "unit:" + l.UnitName,
+			Status:      healthOK,
+			LastSuccess: l.LastSuccess,
+			Detail:      l.LastError,
+		}
+		switch l.State {
+		case linkOffline:
+			h.Status = healthDown
+		case linkDegraded, linkUnknown:
+			h.Status = healthDegraded
+		}
+		healths = append(healths, h)
+	}
+	return healths
+}
+
+// Route GET: Liveness, only fails if the scheduler loop has stopped going round
+func (cs *ControlSystem) RouteGETHealthz(c *gin.Context) {
+	report := cs.healthReport()
+	code := http.StatusOK
+	if cs.schedulerHealth().Status == healthDown {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, probeResult{Status: report.Status, CheckedAt: report.CheckedAt})
+}
+
+// Route GET: Readiness, fails while any required subsystem is down
+func (cs *ControlSystem) RouteGETReadyz(c *gin.Context) {
+	report := cs.healthReport()
+	code := http.StatusOK
+	if report.Status == healthDown {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, probeResult{Status: report.Status, CheckedAt: report.CheckedAt})
+}
@@ -0,0 +1,46 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/serial"
+	"as2controlv2/weather"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The probes give only the overall status, the details of each subsystem can hold unit names
+// and errors so they are left to the authorised health route
+func TestProbesHideDetail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := config.MakeExampleConfig()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cs := ControlSystemInit(logger, conf, db.NewMemorySink(), weather.WeatherInit(conf.WeatherAPIConfig), serial.SerialConnection{}, nil)
+	cs.SetSerialUnavailable(errors.New("open /dev/ttyUSB0: no such file or directory"))
+	cs.heartbeat()
+
+	r := gin.New()
+	r.GET("/healthz", cs.RouteGETHealthz)
+	r.GET("/readyz", cs.RouteGETReadyz)
+	for path, code := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code {
+			t.Errorf("%s: status %d, want %d", path, w.Code, code)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != 2 || body["status"] != healthDown {
+			t.Errorf("%s answered %v, want only the status and when it was checked", path, body)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"fmt"
+	"time"
+)
+
+// How often the drying rate of each unit is worked out again from the stored history
+const dryingRateRefresh = 15 * time.Minute
+
+// How far ahead a zone is allowed to be projected to dry out before it is watered early
+const dryingLookahead = 6 * time.Hour
+
+// How fast a unit's soil moisture is dropping
+type dryingRate struct {
+	PercentPerHour float64   // Positive when the soil is drying out
+	CalculatedAt   time.Time // Zero until the first calculation has finished
+	Pending        bool      // A calculation is running in the background
+}
+
+// Work out the drying rate of a unit in the background, at most every 15 minutes. The history
+// query is never waited on, decisions use whatever rate was last worked out
+func (cs *ControlSystem) refreshDryingRate(rmu config.RemoteUnitConfig) {
+	history, ok := cs.storage().(db.HistoryReader)
+	if !ok {
+		return
+	}
+
+	cs.historyMu.Lock()
+	rate := cs.dryingRates[rmu.UnitNumber]
+	if rate.Pending || time.Since(rate.CalculatedAt) < dryingRateRefresh {
+		cs.historyMu.Unlock()
+		return
+	}
+	rate.Pending = true
+	cs.dryingRates[rmu.UnitNumber] = rate
+	// Look back to the last watering, as the trend before it is meaningless
+	since := 24 * time.Hour
+	if last, ok := cs.lastWateredAt[rmu.UnitNumber]; ok {
+		since = min(max(time.Since(last), time.Hour), 72*time.Hour)
+	}
+	cs.historyMu.Unlock()
+
+	go func() {
+		samples, err := history.SoilMoistureHistory(rmu.UnitName, since)
+		cs.historyMu.Lock()
+		defer cs.historyMu.Unlock()
+		rate := dryingRate{CalculatedAt: time.Now()}
+		if err != nil {
+			cs.logger.Warn(fmt.Sprintf("could not get soil moisture history for unit %d: %s", rmu.UnitNumber, err.Error()))
+		} else {
+			rate.PercentPerHour = -slopePerHour(samples)
+		}
+		cs.dryingRates[rmu.UnitNumber] = rate
+	}()
+}
+
+// Whether a unit is drying fast enough that it will drop below the threshold within the lookahead
+func (cs *ControlSystem) willDryOut(unitNumber uint, soilMoisture float64) bool {
+	cs.historyMu.Lock()
+	rate, ok := cs.dryingRates[unitNumber]
+	cs.historyMu.Unlock()
+	if !ok || rate.CalculatedAt.IsZero() || rate.PercentPerHour <= 0 {
+		return false
+	}
+	hoursLeft := (soilMoisture - cs.wateringPolicy(unitNumber).ThresholdPercent) / rate.PercentPerHour
+	return hoursLeft <= dryingLookahead.Hours()
+}
+
+// Least squares slope of a set of samples, in units per hour. Zero if there aren't enough samples
+func slopePerHour(samples []db.Sample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	origin := samples[0].Time
+	n := float64(len(samples))
+	sumX, sumY, sumXY, sumXX := 0.0, 0.0, 0.0, 0.0
+	for _, s := range samples {
+		x := s.Time.Sub(origin).Hours()
+		sumX += x
+		sumY += s.Value
+		sumXY += x * s.Value
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
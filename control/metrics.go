@@ -0,0 +1,100 @@
+package control
+
+import (
+	"as2controlv2/metrics"
+	"as2controlv2/weather"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	metrics.Default.Describe("as2_unit_poll_duration_seconds", metrics.TypeSummary, "How long polling each remote unit takes")
+	metrics.Default.Describe("as2_unit_polls_total", metrics.TypeCounter, "Polls of each remote unit, by result")
+	metrics.Default.Describe("as2_ble_switch_duration_seconds", metrics.TypeSummary, "How long switching the Bluetooth module to each unit takes")
+	metrics.Default.Describe("as2_ble_switches_total", metrics.TypeCounter, "Switches of the Bluetooth module to each unit, by result")
+	metrics.Default.Describe("as2_db_queue_depth", metrics.TypeGauge, "Points waiting in the write queue")
+	metrics.Default.Describe("as2_db_queue_dropped_total", metrics.TypeCounter, "Points dropped because the write queue was full")
+	metrics.Default.Describe("as2_active_valves", metrics.TypeGauge, "Units that are currently watering")
+	metrics.Default.Describe("as2_valve_open", metrics.TypeGauge, "Whether each unit is currently watering")
+	metrics.Default.Describe("as2_scheduled_waterings", metrics.TypeGauge, "Waterings waiting to start")
+	metrics.Default.Describe("as2_unit_link_up", metrics.TypeGauge, "Whether each unit is online")
+	metrics.Default.Describe("as2_sensor_value", metrics.TypeGauge, "The current averaged reading of each unit, by metric")
+	metrics.Default.Describe("as2_weather_temperature_celsius", metrics.TypeGauge, "The last observed outside temperature")
+}
+
+// Register the gauges that are worked out from the control system state on each scrape
+func (cs *ControlSystem) registerMetrics(r *metrics.Registry) {
+	r.OnCollect(func(r *metrics.Registry) {
+		// Only the published state is read, the scheduler loop may be changing its own
+		state := cs.state()
+		if state.Buffered {
+			r.Set("as2_db_queue_depth", nil, float64(state.QueueDepth))
+			r.Set("as2_db_queue_dropped_total", nil, float64(state.QueueDropped))
+		}
+		r.Set("as2_active_valves", nil, float64(len(state.Active)))
+		r.Set("as2_scheduled_waterings", nil, float64(len(state.Pending)))
+		if state.HaveObservation {
+			r.Set("as2_weather_temperature_celsius", nil, weather.KelvinToCelsius(state.Observation.Result.Main.TempKelvin))
+		}
+
+		r.Reset("as2_valve_open")
+		r.Reset("as2_unit_link_up")
+		r.Reset("as2_sensor_value")
+		for i, rmu := range state.Units {
+			labels := metrics.Labels{"unit": strconv.Itoa(int(rmu.UnitNumber)), "name": rmu.UnitName}
+			_, watering := state.Active[rmu.UnitNumber]
+			r.Set("as2_valve_open", labels, boolToFloat(watering))
+			link, ok := state.Links[rmu.UnitNumber]
+			r.Set("as2_unit_link_up", labels, boolToFloat(ok && link.State == linkOnline))
+			// Nothing to report until the unit has been polled
+			if i >= len(state.SensorAverages) || link.LastSuccess.IsZero() {
+				continue
+			}
+			values := state.SensorAverages[i]
+			for metric, value := range map[string]float64{
+				"temperature":       values.Temperature,
+				"humidity":          values.Humidity,
+				"soil_moisture":     values.SoilMoisture,
+				"soil_moisture_raw": values.SoilMoistureRaw,
+				"flow_rate":         values.FlowRate,
+				"vpd_kpa":           values.VapourPressureDeficit,
+			} {
+				r.Set("as2_sensor_value", metrics.Labels{"unit": labels["unit"], "name": rmu.UnitName, "metric": metric}, value)
+			}
+			if values.DewPoint != nil {
+				r.Set("as2_sensor_value", metrics.Labels{"unit": labels["unit"], "name": rmu.UnitName, "metric": "dew_point"}, *values.DewPoint)
+			}
+		}
+	})
+}
+
+// Record how long an operation on a unit took and whether it worked
+func observeUnitOperation(durationName, countName string, unitNumber uint, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	unit := strconv.Itoa(int(unitNumber))
+	metrics.Default.Observe(durationName, metrics.Labels{"unit": unit}, time.Since(start).Seconds())
+	metrics.Default.Inc(countName, metrics.Labels{"unit": unit, "result": result})
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Route GET: The controller's own metrics in the Prometheus text format
+func (cs *ControlSystem) RouteGETMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := metrics.Default.Write(c.Writer); err != nil {
+		cs.logger.Error(fmt.Sprintf("could not write metrics: %s", err.Error()))
+	}
+}
@@ -0,0 +1,171 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The version of the API described by the document
+const apiVersion = "1.0.0"
+
+// Generate the OpenAPI 3 document for the routes under the given prefix. Schemas come from the
+// request and response types by reflection, using their json tags
+func OpenAPIDocument(prefix string, routes []APIRoute) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range routes {
+		path, params := openAPIPath(prefix + rt.Path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		parameters := make([]interface{}, 0)
+		for _, p := range params {
+			parameters = append(parameters, map[string]interface{}{
+				"name": p, "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range rt.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]interface{}{"type": q.Type},
+			})
+		}
+
+		status := rt.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if rt.Stream != "" {
+			success["content"] = map[string]interface{}{
+				rt.Stream: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		} else if rt.Response != nil {
+			success["content"] = jsonContent(schemaOf(reflect.TypeOf(rt.Response)))
+		}
+		responses := map[string]interface{}{strconv.Itoa(status): success}
+		for _, code := range append([]int{http.StatusUnauthorized, http.StatusForbidden}, rt.Errors...) {
+			responses[strconv.Itoa(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content":     jsonContent(map[string]interface{}{"$ref": "#/components/schemas/Error"}),
+			}
+		}
+
+		op := map[string]interface{}{
+			"summary":     rt.Summary,
+			"description": fmt.Sprintf("Needs a token with the %s role, when tokens are configured", rt.Role),
+			"parameters":  parameters,
+			"responses":   responses,
+			"security":    []interface{}{map[string]interface{}{"bearer": []string{}}},
+		}
+		if rt.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": false,
+				"content":  jsonContent(schemaOf(reflect.TypeOf(rt.Request))),
+			}
+		}
+		paths[path][strings.ToLower(rt.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "as2controlv2",
+			"version": apiVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": schemaOf(reflect.TypeOf(errorEnvelope{})),
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// Route GET: The OpenAPI document for /api/v1
+func (cs *ControlSystem) RouteGETOpenAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, OpenAPIDocument("/api/v1", cs.V1Routes()))
+}
+
+// Convert a gin path to an OpenAPI one, returning the path parameters
+func openAPIPath(path string) (string, []string) {
+	parts := strings.Split(path, "/")
+	params := make([]string, 0)
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			params = append(params, part[1:])
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// Work out the schema of a type from its json tags
+func schemaOf(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		addStructProperties(t, properties)
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	// Interfaces can hold anything
+	return map[string]interface{}{}
+}
+
+// Add the json fields of a struct to the properties, including those of embedded structs
+func addStructProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructProperties(f.Type, properties)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOf(f.Type)
+	}
+}
@@ -0,0 +1,170 @@
+package control
+
+import (
+	"as2controlv2/auth"
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/serial"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Parts of the config that are only read at startup
+var restartOnlyConfig = []string{"state_dir", "api.trusted_proxies"}
+
+// Re-read the config file and apply whatever changed in it. by is what prompted the reload, such
+// as the hangup signal. The token file is re-read even if the config is unchanged
+func (cs *ControlSystem) ReloadConfig(ctx context.Context, by string) (config.Version, error) {
+	if cs.configStore == nil {
+		return config.Version{}, newAPIError(http.StatusNotImplemented, codeNotSupported, "the config can't be changed at runtime, see the log for why")
+	}
+	path := cs.configStore.Path()
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return config.Version{}, newAPIError(http.StatusInternalServerError, codeInternal, "could not read %s: %s", path, err.Error())
+	}
+	conf, problems := config.Check(bytes, config.FormatOf(path))
+	if config.HasErrors(problems) {
+		e := newAPIError(http.StatusBadRequest, codeInvalidConfig, "%s has errors", path)
+		e.Problems = problems
+		return config.Version{}, e
+	}
+	for _, p := range problems {
+		cs.logger.Warn(fmt.Sprintf("config warning, %s", p.String()))
+	}
+	resolved, err := config.Resolve(conf)
+	if err != nil {
+		return config.Version{}, newAPIError(http.StatusBadRequest, codeInvalidConfig, "%s", err.Error())
+	}
+	tokens, err := auth.StoreInit(resolved.API)
+	if err != nil {
+		return config.Version{}, newAPIError(http.StatusBadRequest, codeInvalidConfig, "could not load the API tokens: %s", err.Error())
+	}
+	location, err := lookupWeatherLocation(resolved)
+	if err != nil {
+		return config.Version{}, err
+	}
+	v, err := cs.submit(ctx, configChange{by: by, summary: fmt.Sprintf("reload %s", path), replace: &conf, location: location})
+	if err != nil {
+		return v, err
+	}
+	cs.SetTokens(tokens)
+	return v, nil
+}
+
+// Bring up the subsystems whose settings changed. Each one is set up with the new settings before
+// anything is swapped over, so if one fails everything is left as it was
+func (cs *ControlSystem) reinitSubsystems(next config.Config, changes []config.Change) error {
+	for _, key := range restartOnlyConfig {
+		if config.Changed(changes, key) {
+			cs.logger.Warn(fmt.Sprintf("%s changed, it only takes effect after a restart", key))
+		}
+	}
+
+	var tokens *auth.Store
+	if config.Changed(changes, "api") {
+		var err error
+		if tokens, err = auth.StoreInit(next.API); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidConfig, "could not load the API tokens: %s", err.Error())
+		}
+	}
+
+	var conn *serial.SerialConnection
+	var connErr error
+	serialChanged := config.Changed(changes, "serial_config")
+	if serialChanged {
+		c, err := serial.SerialConnectionInit(next.SerialConfig, cs.logger)
+		if err != nil && cs.serialAvailable() {
+			// Don't give up a working link for one that doesn't
+			return newAPIError(http.StatusBadRequest, codeInvalidConfig, "could not open serial port %s, keeping the current one: %s", next.SerialConfig.Port, err.Error())
+		}
+		conn, connErr = &c, err
+	}
+
+	if config.Changed(changes, "influxdb_config") || config.Changed(changes, "storage") {
+		if err := cs.reinitStorage(next); err != nil {
+			if connErr == nil && conn != nil {
+				conn.Close()
+			}
+			return err
+		}
+	}
+
+	// Nothing from here on can fail
+	if serialChanged {
+		cs.replaceSerial(*conn, connErr)
+	}
+	if tokens != nil {
+		cs.SetTokens(tokens)
+	}
+	if config.Changed(changes, "weather_api_config") {
+		cs.weatherHandler.Reconfigure(next.WeatherAPIConfig)
+	}
+	if config.Changed(changes, "remote_configs") && cs.calibrations != nil {
+		cs.calibrations.Reconfigure(next)
+	}
+	return nil
+}
+
+// Swap the storage backends for ones with new settings. The new ones are set up first, so the old
+// ones keep running if they can't be. An InfluxDB queue at the same path is taken over by the new
+// one, anything written to the old one in the meantime is passed on to it
+func (cs *ControlSystem) reinitStorage(next config.Config) error {
+	sink, err := db.SinkInit(next, cs.logger)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidConfig, "could not set up storage, keeping the current settings: %s", err.Error())
+	}
+	cs.storageMu.Lock()
+	old := cs.dbHandler
+	cs.dbHandler = sink
+	cs.storageMu.Unlock()
+	if err := old.Close(); err != nil {
+		cs.logger.Warn(fmt.Sprintf("could not close the old storage cleanly: %s", err.Error()))
+	}
+	cs.logger.Info("storage reconnected with the new settings")
+	return nil
+}
+
+// Swap the serial link for one opened with new settings. Active waterings carry on, and are
+// switched off over the new link when they are due
+func (cs *ControlSystem) replaceSerial(conn serial.SerialConnection, err error) {
+	if cs.serialAvailable() {
+		if err := cs.serialHandler.Close(); err != nil {
+			cs.logger.Warn(fmt.Sprintf("could not close the old serial port: %s", err.Error()))
+		}
+	}
+	cs.serialHandler = conn
+	cs.SetSerialUnavailable(err)
+	if err != nil {
+		cs.logger.Error(fmt.Sprintf("serial link still unavailable with the new settings: %s", err.Error()))
+		return
+	}
+	for unitNumber := range cs.activeWaterings {
+		cs.logger.Info(fmt.Sprintf("unit %d is watering, it will be switched off over the new serial link", unitNumber))
+	}
+	cs.logger.Info("serial link reopened with the new settings")
+}
+
+// Bring fetches forward when their interval is shortened, or the weather source changed, rather
+// than waiting out the old interval
+func (cs *ControlSystem) rescheduleFetches(next config.Config, changes []config.Change) {
+	now := time.Now()
+	sooner := func(t *time.Time, seconds uint) {
+		if at := now.Add(time.Duration(seconds) * time.Second); at.Before(*t) {
+			*t = at
+		}
+	}
+	sooner(&cs.systemTiming.NextRemoteUnitFetchTime, next.RemoteIntervalSeconds)
+	sooner(&cs.systemTiming.NextWeatherReportFetchTime, next.WeatherIntervalSeconds)
+	sooner(&cs.systemTiming.NextForecastFetchTime, next.WeatherIntervalSeconds)
+	if config.Changed(changes, "weather_api_config") {
+		cs.systemTiming.NextWeatherReportFetchTime = now
+		cs.systemTiming.NextForecastFetchTime = now
+	}
+	if config.Changed(changes, "serial_config") {
+		cs.systemTiming.NextRemoteUnitFetchTime = now
+	}
+}
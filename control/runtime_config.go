@@ -0,0 +1,476 @@
+package control
+
+import (
+	"as2controlv2/auth"
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/events"
+	"as2controlv2/weather"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a config change waits for the scheduler loop to pick it up
+const configChangeTimeout = 30 * time.Second
+
+// A change to the config, waiting for the scheduler loop to apply it. Changes are applied between
+// iterations of the loop, so it never sees half of one
+type configChange struct {
+	ctx     context.Context
+	by      string
+	summary string
+	change  func(*config.Config) error
+	replace *config.Config // Set instead of change for a config re-read from the file
+	// Where the weather location of the new config is, looked up before it was submitted as the
+	// loop can't wait on the network. Nil if it has no location or keeps the current one
+	location *weather.GeocodeResult
+	done     chan configResult
+}
+
+// The outcome of a config change
+type configResult struct {
+	version config.Version
+	err     error
+}
+
+// Use a store to change the config at runtime, without one the config can only be read
+func (cs *ControlSystem) SetConfigStore(store *config.Store) {
+	cs.configStore = store
+}
+
+// Apply any config changes that are waiting, called from the scheduler loop
+func (cs *ControlSystem) applyConfigChanges() {
+	for {
+		select {
+		case req := <-cs.configChanges:
+			if err := req.ctx.Err(); err != nil {
+				// The client has given up on it
+				req.done <- configResult{err: err}
+				continue
+			}
+			applied := false
+			apply := func(next config.Config) error {
+				if err := cs.applyConfig(next, req.location); err != nil {
+					return err
+				}
+				applied = true
+				return nil
+			}
+			var v config.Version
+			var err error
+			if req.replace != nil {
+				v, err = cs.configStore.Replace(req.by, req.summary, *req.replace, apply)
+			} else {
+				v, err = cs.configStore.Update(req.by, req.summary, req.change, apply)
+			}
+			if applied {
+				cs.logger.Info(fmt.Sprintf("applied config version %d from %s: %s", v.Version, v.By, v.Summary))
+				for _, change := range v.Changes {
+					cs.logger.Info(fmt.Sprintf("config changed: %s", change))
+				}
+				cs.events.Publish(events.TypeConfigChanged, "", v)
+				cs.publishState(true)
+			}
+			req.done <- configResult{version: v, err: err}
+		default:
+			return
+		}
+	}
+}
+
+// Hand a config change to the scheduler loop and wait for it to be applied
+func (cs *ControlSystem) submitConfigChange(ctx context.Context, by, summary string, change func(*config.Config) error) (config.Version, error) {
+	return cs.submit(ctx, configChange{by: by, summary: summary, change: change})
+}
+
+func (cs *ControlSystem) submit(ctx context.Context, req configChange) (config.Version, error) {
+	if cs.configStore == nil {
+		return config.Version{}, newAPIError(http.StatusNotImplemented, codeNotSupported, "the config can't be changed at runtime, see the log for why")
+	}
+	ctx, cancel := context.WithTimeout(ctx, configChangeTimeout)
+	defer cancel()
+	req.ctx = ctx
+	req.done = make(chan configResult, 1)
+	select {
+	case cs.configChanges <- req:
+	case <-ctx.Done():
+		return config.Version{}, newAPIError(http.StatusServiceUnavailable, codeSchedulerBusy, "the scheduler did not pick up the change, try again")
+	}
+	res := <-req.done
+	var invalid *config.ValidationError
+	if errors.As(res.err, &invalid) {
+		return res.version, &apiError{
+			Status:   http.StatusBadRequest,
+			Code:     codeInvalidConfig,
+			Message:  "the change would leave the config invalid",
+			Problems: invalid.Problems,
+		}
+	}
+	return res.version, res.err
+}
+
+// Put a new config into effect. Nothing is changed unless all of it can be
+func (cs *ControlSystem) applyConfig(next config.Config, location *weather.GeocodeResult) error {
+	units := make(map[uint]config.RemoteUnitConfig, len(next.RemoteUnitConfigs))
+	for _, rmu := range next.RemoteUnitConfigs {
+		units[rmu.UnitNumber] = rmu
+	}
+	// A unit can't be taken away part way through watering, it would never be switched off
+	for unitNumber := range cs.activeWaterings {
+		if _, ok := units[unitNumber]; !ok {
+			return newAPIError(http.StatusConflict, codeWateringActive, "unit %d is watering, stop it before removing it", unitNumber)
+		}
+	}
+	if err := cs.placeWeatherLocation(&next.WeatherAPIConfig, location); err != nil {
+		return err
+	}
+	changes := config.Diff(*cs.currentConfig(), next)
+	if err := cs.reinitSubsystems(next, changes); err != nil {
+		return err
+	}
+	cs.rescheduleFetches(next, changes)
+
+	// The averages are kept in config order, so they move with their unit
+	averages := make([]db.CurrentLocalValues, len(next.RemoteUnitConfigs))
+	for i, rmu := range next.RemoteUnitConfigs {
+		for j, old := range cs.currentConfig().RemoteUnitConfigs {
+			if old.UnitNumber == rmu.UnitNumber {
+				averages[i] = cs.currentSensorAverages[j]
+			}
+		}
+	}
+	// Pending waterings for units that are gone or disabled are dropped
+	for unitNumber := range cs.systemTiming.NextWateringTime {
+		if rmu, ok := units[unitNumber]; !ok || rmu.Disabled {
+			cs.logger.Info(fmt.Sprintf("dropping pending watering for unit %d as it is no longer enabled", unitNumber))
+			delete(cs.systemTiming.NextWateringTime, unitNumber)
+			delete(cs.systemTiming.WateringRequests, unitNumber)
+		}
+	}
+	cs.linksMu.Lock()
+	for unitNumber, l := range cs.unitLinks {
+		if rmu, ok := units[unitNumber]; ok {
+			l.UnitName = rmu.UnitName
+		} else {
+			delete(cs.unitLinks, unitNumber)
+		}
+	}
+	cs.linksMu.Unlock()
+	// The units and their averages are published together once the change has been applied
+	cs.currentSensorAverages = averages
+	cs.systemConfig.Store(&next)
+	return nil
+}
+
+// Look up the coordinates of the weather location of a config, before it is submitted to the
+// scheduler loop. The cache is used if it has them, as it was at startup
+func lookupWeatherLocation(conf config.Config) (*weather.GeocodeResult, error) {
+	location, ok, err := weather.ResolveLocation(&conf.WeatherAPIConfig, conf.StateDir(), false)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidConfig, "could not resolve the weather location: %s", err.Error())
+	}
+	if !ok {
+		return nil, nil
+	}
+	return &location, nil
+}
+
+// Set the coordinates of the weather location in a config that is about to be applied. A config
+// that keeps the location keeps the coordinates it was running with
+func (cs *ControlSystem) placeWeatherLocation(conf *config.OpenWeatherMapConfig, location *weather.GeocodeResult) error {
+	if conf.Location == "" && conf.Postcode == "" {
+		// Only coordinates are configured
+		return nil
+	}
+	if location != nil {
+		conf.Latitude, conf.Longitude = location.Latitude, location.Longitude
+		return nil
+	}
+	current := cs.currentConfig().WeatherAPIConfig
+	if conf.Location != current.Location || conf.Postcode != current.Postcode {
+		return newAPIError(http.StatusBadRequest, codeInvalidConfig, "the weather location changed, reload the config to look it up")
+	}
+	conf.Latitude, conf.Longitude = current.Latitude, current.Longitude
+	return nil
+}
+
+// Find a unit in a config by number, for changing it
+func configUnit(conf *config.Config, unitNumber uint) (*config.RemoteUnitConfig, error) {
+	for i := range conf.RemoteUnitConfigs {
+		if conf.RemoteUnitConfigs[i].UnitNumber == unitNumber {
+			return &conf.RemoteUnitConfigs[i], nil
+		}
+	}
+	return nil, newAPIError(http.StatusNotFound, codeUnitNotFound, "unit %d does not exist", unitNumber)
+}
+
+// Add a unit
+func (cs *ControlSystem) addUnit(ctx context.Context, by string, rmu config.RemoteUnitConfig) (config.Version, error) {
+	return cs.submitConfigChange(ctx, by, fmt.Sprintf("add unit %d (%s)", rmu.UnitNumber, rmu.UnitName), func(conf *config.Config) error {
+		if _, err := configUnit(conf, rmu.UnitNumber); err == nil {
+			return newAPIError(http.StatusConflict, codeUnitExists, "unit %d already exists", rmu.UnitNumber)
+		}
+		conf.RemoteUnitConfigs = append(conf.RemoteUnitConfigs, rmu)
+		return nil
+	})
+}
+
+// Replace the config of a unit, which can change its name and number
+func (cs *ControlSystem) updateUnit(ctx context.Context, by string, unitNumber uint, rmu config.RemoteUnitConfig) (config.Version, error) {
+	return cs.submitConfigChange(ctx, by, fmt.Sprintf("update unit %d", unitNumber), func(conf *config.Config) error {
+		existing, err := configUnit(conf, unitNumber)
+		if err != nil {
+			return err
+		}
+		*existing = rmu
+		return nil
+	})
+}
+
+// Remove a unit
+func (cs *ControlSystem) removeUnit(ctx context.Context, by string, unitNumber uint) (config.Version, error) {
+	return cs.submitConfigChange(ctx, by, fmt.Sprintf("remove unit %d", unitNumber), func(conf *config.Config) error {
+		if _, err := configUnit(conf, unitNumber); err != nil {
+			return err
+		}
+		units := make([]config.RemoteUnitConfig, 0, len(conf.RemoteUnitConfigs)-1)
+		for _, rmu := range conf.RemoteUnitConfigs {
+			if rmu.UnitNumber != unitNumber {
+				units = append(units, rmu)
+			}
+		}
+		conf.RemoteUnitConfigs = units
+		return nil
+	})
+}
+
+// Enable or disable a unit. A disabled unit that is watering is still polled until it finishes
+func (cs *ControlSystem) setUnitEnabled(ctx context.Context, by string, unitNumber uint, enabled bool) (config.Version, error) {
+	summary := fmt.Sprintf("enable unit %d", unitNumber)
+	if !enabled {
+		summary = fmt.Sprintf("disable unit %d", unitNumber)
+	}
+	return cs.submitConfigChange(ctx, by, summary, func(conf *config.Config) error {
+		rmu, err := configUnit(conf, unitNumber)
+		if err != nil {
+			return err
+		}
+		rmu.Disabled = !enabled
+		return nil
+	})
+}
+
+// Roll the config back to an earlier version, which is recorded as a new version. It is loaded
+// first so its weather location can be looked up
+func (cs *ControlSystem) rollbackConfig(ctx context.Context, by string, version int) (config.Version, error) {
+	if cs.configStore == nil {
+		return config.Version{}, newAPIError(http.StatusNotImplemented, codeNotSupported, "the config can't be changed at runtime, see the log for why")
+	}
+	old, err := cs.configStore.Load(version)
+	if errors.Is(err, config.ErrUnknownVersion) {
+		return config.Version{}, newAPIError(http.StatusNotFound, codeNotFound, "config version %d does not exist", version)
+	}
+	if err != nil {
+		return config.Version{}, err
+	}
+	resolved, err := config.Resolve(old)
+	if err != nil {
+		return config.Version{}, newAPIError(http.StatusBadRequest, codeInvalidConfig, "%s", err.Error())
+	}
+	location, err := lookupWeatherLocation(resolved)
+	if err != nil {
+		return config.Version{}, err
+	}
+	return cs.submit(ctx, configChange{
+		by:      by,
+		summary: fmt.Sprintf("roll back to version %d", version),
+		change: func(conf *config.Config) error {
+			*conf = old
+			return nil
+		},
+		location: location,
+	})
+}
+
+// The config routes of the versioned API
+func (cs *ControlSystem) configRoutes() []APIRoute {
+	changeErrors := []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusNotImplemented, http.StatusServiceUnavailable}
+	return []APIRoute{
+		{
+			Method: http.MethodGet, Path: "/config/units", Role: auth.RoleViewer, Summary: "The config of every unit",
+			Handler: cs.v1GETConfigUnits, Response: []config.RemoteUnitConfig{},
+		},
+		{
+			Method: http.MethodPost, Path: "/config/units", Role: auth.RoleAdmin, Summary: "Add a unit",
+			Handler: cs.v1POSTConfigUnit, Request: config.RemoteUnitConfig{}, Response: config.Version{}, Status: http.StatusCreated,
+			Errors: changeErrors,
+		},
+		{
+			Method: http.MethodPut, Path: "/config/units/:id", Role: auth.RoleAdmin, Summary: "Replace the config of a unit, including its name and number",
+			Handler: cs.v1PUTConfigUnit, Request: config.RemoteUnitConfig{}, Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodDelete, Path: "/config/units/:id", Role: auth.RoleAdmin, Summary: "Remove a unit",
+			Handler: cs.v1DELETEConfigUnit, Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodPost, Path: "/config/units/:id/enable", Role: auth.RoleAdmin, Summary: "Enable a unit",
+			Handler: cs.v1POSTEnableUnit(true), Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodPost, Path: "/config/units/:id/disable", Role: auth.RoleAdmin, Summary: "Stop polling and watering a unit, without removing it",
+			Handler: cs.v1POSTEnableUnit(false), Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodGet, Path: "/config/watering-policy", Role: auth.RoleViewer, Summary: "The system watering policy, units can override it",
+			Handler: cs.v1GETWateringPolicy, Response: config.WateringPolicy{},
+		},
+		{
+			Method: http.MethodPut, Path: "/config/watering-policy", Role: auth.RoleAdmin, Summary: "Replace the system watering policy",
+			Handler: cs.v1PUTWateringPolicy, Request: config.WateringPolicy{}, Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodGet, Path: "/config/weather-warnings", Role: auth.RoleViewer, Summary: "The weather warning thresholds and actions",
+			Handler: cs.v1GETWeatherWarnings, Response: config.WeatherWarningConfig{},
+		},
+		{
+			Method: http.MethodPut, Path: "/config/weather-warnings", Role: auth.RoleAdmin, Summary: "Replace the weather warning thresholds and actions",
+			Handler: cs.v1PUTWeatherWarnings, Request: config.WeatherWarningConfig{}, Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodPost, Path: "/config/reload", Role: auth.RoleAdmin, Summary: "Re-read the config file and apply what changed in it",
+			Handler: cs.v1POSTReload, Response: config.Version{}, Errors: changeErrors,
+		},
+		{
+			Method: http.MethodGet, Path: "/config/versions", Role: auth.RoleViewer, Summary: "Every applied version of the config, oldest first",
+			Handler: cs.v1GETConfigVersions, Response: []config.Version{}, Errors: []int{http.StatusNotImplemented},
+		},
+		{
+			Method: http.MethodPost, Path: "/config/versions/:version/rollback", Role: auth.RoleAdmin, Summary: "Apply an earlier version of the config again",
+			Handler: cs.v1POSTRollback, Response: config.Version{}, Errors: changeErrors,
+		},
+	}
+}
+
+// Respond with the version a change made, or its error
+func respondConfigChange(c *gin.Context, status int, v config.Version, err error) {
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(status, v)
+}
+
+func (cs *ControlSystem) v1GETConfigUnits(c *gin.Context) {
+	c.JSON(http.StatusOK, cs.currentConfig().RemoteUnitConfigs)
+}
+
+func (cs *ControlSystem) v1POSTConfigUnit(c *gin.Context) {
+	var rmu config.RemoteUnitConfig
+	if err := c.ShouldBindJSON(&rmu); err != nil {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: %s", err.Error()))
+		return
+	}
+	v, err := cs.addUnit(c.Request.Context(), requestedBy(c), rmu)
+	respondConfigChange(c, http.StatusCreated, v, err)
+}
+
+func (cs *ControlSystem) v1PUTConfigUnit(c *gin.Context) {
+	existing, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	var rmu config.RemoteUnitConfig
+	if err := c.ShouldBindJSON(&rmu); err != nil {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: %s", err.Error()))
+		return
+	}
+	v, err := cs.updateUnit(c.Request.Context(), requestedBy(c), existing.UnitNumber, rmu)
+	respondConfigChange(c, http.StatusOK, v, err)
+}
+
+func (cs *ControlSystem) v1DELETEConfigUnit(c *gin.Context) {
+	existing, err := cs.pathUnit(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	v, err := cs.removeUnit(c.Request.Context(), requestedBy(c), existing.UnitNumber)
+	respondConfigChange(c, http.StatusOK, v, err)
+}
+
+func (cs *ControlSystem) v1POSTEnableUnit(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, err := cs.pathUnit(c)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		v, err := cs.setUnitEnabled(c.Request.Context(), requestedBy(c), existing.UnitNumber, enabled)
+		respondConfigChange(c, http.StatusOK, v, err)
+	}
+}
+
+func (cs *ControlSystem) v1GETWateringPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, cs.currentConfig().WateringPolicy.WithDefaults())
+}
+
+func (cs *ControlSystem) v1PUTWateringPolicy(c *gin.Context) {
+	var policy config.WateringPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: %s", err.Error()))
+		return
+	}
+	v, err := cs.submitConfigChange(c.Request.Context(), requestedBy(c), "set the watering policy", func(conf *config.Config) error {
+		conf.WateringPolicy = policy
+		return nil
+	})
+	respondConfigChange(c, http.StatusOK, v, err)
+}
+
+func (cs *ControlSystem) v1GETWeatherWarnings(c *gin.Context) {
+	c.JSON(http.StatusOK, cs.currentConfig().WeatherWarnings.WithDefaults())
+}
+
+func (cs *ControlSystem) v1PUTWeatherWarnings(c *gin.Context) {
+	var warnings config.WeatherWarningConfig
+	if err := c.ShouldBindJSON(&warnings); err != nil {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: %s", err.Error()))
+		return
+	}
+	v, err := cs.submitConfigChange(c.Request.Context(), requestedBy(c), "set the weather warnings", func(conf *config.Config) error {
+		conf.WeatherWarnings = warnings
+		return nil
+	})
+	respondConfigChange(c, http.StatusOK, v, err)
+}
+
+func (cs *ControlSystem) v1POSTReload(c *gin.Context) {
+	v, err := cs.ReloadConfig(c.Request.Context(), requestedBy(c))
+	respondConfigChange(c, http.StatusOK, v, err)
+}
+
+func (cs *ControlSystem) v1GETConfigVersions(c *gin.Context) {
+	if cs.configStore == nil {
+		respondError(c, newAPIError(http.StatusNotImplemented, codeNotSupported, "the config is not versioned, see the log for why"))
+		return
+	}
+	c.JSON(http.StatusOK, cs.configStore.Versions())
+}
+
+func (cs *ControlSystem) v1POSTRollback(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version <= 0 {
+		respondError(c, newAPIError(http.StatusBadRequest, codeInvalidRequest, "version must be a positive integer"))
+		return
+	}
+	v, err := cs.rollbackConfig(c.Request.Context(), requestedBy(c), version)
+	respondConfigChange(c, http.StatusOK, v, err)
+}
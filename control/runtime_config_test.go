@@ -0,0 +1,28 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/weather"
+	"testing"
+)
+
+// The loop never looks a location up, it keeps the running coordinates or uses the ones it is given
+func TestPlaceWeatherLocation(t *testing.T) {
+	conf := config.MakeExampleConfig()
+	conf.WeatherAPIConfig.Latitude, conf.WeatherAPIConfig.Longitude = -19.25, 146.82
+	cs := &ControlSystem{}
+	cs.systemConfig.Store(&conf)
+
+	same := config.OpenWeatherMapConfig{Location: conf.WeatherAPIConfig.Location}
+	if err := cs.placeWeatherLocation(&same, nil); err != nil || same.Latitude != -19.25 || same.Longitude != 146.82 {
+		t.Errorf("same location placed at %g,%g with %v, want the running coordinates", same.Latitude, same.Longitude, err)
+	}
+
+	moved := config.OpenWeatherMapConfig{Location: "Cairns,QLD,AU"}
+	if err := cs.placeWeatherLocation(&moved, nil); err == nil {
+		t.Error("a new location was placed without being looked up")
+	}
+	if err := cs.placeWeatherLocation(&moved, &weather.GeocodeResult{Latitude: -16.92, Longitude: 145.77}); err != nil || moved.Latitude != -16.92 {
+		t.Errorf("looked up location placed at %g,%g with %v", moved.Latitude, moved.Longitude, err)
+	}
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/weather"
+	"fmt"
+	"time"
+)
+
+// How often the scheduler loop publishes its state, at most. Anything the loop does for the API
+// is published straight away so the API sees its own changes
+const statePublishInterval = 100 * time.Millisecond
+
+// A copy of what the scheduler loop is doing, for the API and the metrics collector to read.
+// The loop's own maps are only touched by the loop, everything else reads this instead
+type schedulerState struct {
+	PublishedAt     time.Time
+	Units           []config.RemoteUnitConfig
+	SensorAverages  []db.CurrentLocalValues // In the same order as the units
+	Links           map[uint]unitLink
+	Pending         map[uint]pendingWatering
+	Active          map[uint]activeWatering
+	HeldUntil       time.Time // Automatic watering is held off until this time by a weather action
+	HoldReason      string
+	Weather         weather.CurrentWeatherResult // The weather the loop is working from
+	Observation     weather.Observation
+	HaveObservation bool
+	Buffered        bool // Whether storage has a write queue, the depth and drops are zero if not
+	QueueDepth      int
+	QueueDropped    uint64
+}
+
+// A watering waiting to start
+type pendingWatering struct {
+	At      time.Time
+	Request WateringRequest
+}
+
+// A watering that is running
+type activeWatering struct {
+	wateringRun
+	Until time.Time
+}
+
+// Whether automatic watering was held off when the state was published
+func (s *schedulerState) held() bool {
+	return time.Now().Before(s.HeldUntil)
+}
+
+// The name of a unit as it was configured when the state was published
+func (s *schedulerState) unitName(unitNumber uint) string {
+	for _, rmu := range s.Units {
+		if rmu.UnitNumber == unitNumber {
+			return rmu.UnitName
+		}
+	}
+	return fmt.Sprintf("unit_%d", unitNumber)
+}
+
+// Get the last state the scheduler loop published
+func (cs *ControlSystem) state() *schedulerState {
+	return cs.published.Load()
+}
+
+// Copy the loop's state out for the API, unless it has been published recently. Called from the
+// scheduler loop only
+func (cs *ControlSystem) publishState(force bool) {
+	if last := cs.published.Load(); !force && last != nil && time.Since(last.PublishedAt) < statePublishInterval {
+		return
+	}
+	cs.published.Store(cs.snapshot())
+}
+
+// Copy the loop's state as it is now. Called from the scheduler loop only, the API reads the
+// published copy
+func (cs *ControlSystem) snapshot() *schedulerState {
+	units := append([]config.RemoteUnitConfig(nil), cs.currentConfig().RemoteUnitConfigs...)
+	// The averages are copied with the units they belong to, so the API can index one by the other
+	averages := make([]db.CurrentLocalValues, len(units))
+	copy(averages, cs.currentSensorAverages)
+	s := &schedulerState{
+		PublishedAt:    time.Now(),
+		Units:          units,
+		SensorAverages: averages,
+		Links:          cs.linkSnapshot(),
+		Pending:        make(map[uint]pendingWatering, len(cs.systemTiming.NextWateringTime)),
+		Active:         make(map[uint]activeWatering, len(cs.activeWaterings)),
+		HeldUntil:      cs.wateringHeldUntil,
+		HoldReason:     cs.wateringHoldReason,
+		Weather:        cs.currentWeatherValues,
+	}
+	for unitNumber, at := range cs.systemTiming.NextWateringTime {
+		s.Pending[unitNumber] = pendingWatering{At: at, Request: cs.wateringRequest(unitNumber)}
+	}
+	for unitNumber, run := range cs.activeWaterings {
+		s.Active[unitNumber] = activeWatering{wateringRun: *run, Until: cs.systemTiming.WateringUntilTime[unitNumber]}
+	}
+	s.Observation, s.HaveObservation = cs.weatherHandler.LastObservation()
+	if b, ok := cs.storage().(db.Buffered); ok {
+		s.Buffered = true
+		s.QueueDepth = b.QueueDepth()
+		s.QueueDropped = b.QueueDropped()
+	}
+	return s
+}
@@ -0,0 +1,238 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/serial"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The result of the last successful poll of a unit
+type unitPoll struct {
+	At       time.Time
+	Averaged db.CurrentLocalValues
+	Raw      []serial.SensorReading
+}
+
+// The averaged readings of a unit, as served by the API
+type unitReadings struct {
+	Temperature           float64  `json:"temperature"`
+	Humidity              float64  `json:"humidity"`
+	SoilMoisture          float64  `json:"soil_moisture"`
+	SoilMoistureRaw       float64  `json:"soil_moisture_raw"`
+	FlowRate              float64  `json:"flow_rate"`
+	WaterOn               float64  `json:"water_on"`
+	VapourPressureDeficit float64  `json:"vpd_kpa"`
+	DewPoint              *float64 `json:"dew_point,omitempty"` // Left out when it is undefined
+}
+
+// The state of a unit's valve
+type valveState struct {
+	Open         bool      `json:"open"`
+	Since        time.Time `json:"since"`
+	Until        time.Time `json:"until"`
+	Trigger      string    `json:"trigger,omitempty"`
+	RequestedBy  string    `json:"requested_by,omitempty"`
+	VolumeLitres float64   `json:"volume_litres,omitempty"`
+}
+
+// The watering window a unit is in, or the next one if it is outside all of them
+type windowState struct {
+	Open  bool      `json:"open"`
+	Event string    `json:"event"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Everything the controller knows about a unit
+type unitStatus struct {
+	Name              string                `json:"name"`
+	Number            uint                  `json:"number"`
+	Readings          *unitReadings         `json:"readings"` // Null until the unit has been polled
+	RawReadings       map[string]float64    `json:"raw_readings,omitempty"`
+	LastReading       time.Time             `json:"last_reading"`
+	ReadingAgeSeconds float64               `json:"reading_age_seconds,omitempty"`
+	Link              unitLink              `json:"link"`
+	Valve             valveState            `json:"valve"`
+	WateringWindow    *windowState          `json:"watering_window"` // Null if the unit can water at any time
+	MapPosition       *config.MapPosition   `json:"map_position,omitempty"`
+	Disabled          bool                  `json:"disabled,omitempty"` // Not polled or watered automatically
+	WateringPolicy    config.WateringPolicy `json:"watering_policy"`    // With the unit's overrides applied
+}
+
+// A pending or active watering
+type scheduleEntry struct {
+	UnitName        string    `json:"unit_name"`
+	UnitNumber      uint      `json:"unit_number"`
+	State           string    `json:"state"` // pending or active
+	Start           time.Time `json:"start"`
+	Until           time.Time `json:"until"` // Active waterings only
+	DurationSeconds float64   `json:"duration_seconds"`
+	Trigger         string    `json:"trigger"`      // Why it was scheduled
+	RequestedBy     string    `json:"requested_by"` // Who or what scheduled it
+}
+
+// Keep the result of a poll for the API
+func (cs *ControlSystem) recordPoll(unitNumber uint, raw []serial.SensorReading, averaged db.CurrentLocalValues) {
+	cs.lastPollsMu.Lock()
+	defer cs.lastPollsMu.Unlock()
+	cs.lastPolls[unitNumber] = unitPoll{At: time.Now(), Averaged: averaged, Raw: raw}
+}
+
+// Convert the averaged values of a unit for serving
+func readingsOf(v db.CurrentLocalValues) unitReadings {
+	return unitReadings{
+		Temperature:           v.Temperature,
+		Humidity:              v.Humidity,
+		SoilMoisture:          v.SoilMoisture,
+		SoilMoistureRaw:       v.SoilMoistureRaw,
+		FlowRate:              v.FlowRate,
+		WaterOn:               v.WaterOn,
+		VapourPressureDeficit: v.VapourPressureDeficit,
+		DewPoint:              v.DewPoint,
+	}
+}
+
+// Work out the status of a single unit
+func (cs *ControlSystem) unitStatus(rmu config.RemoteUnitConfig) unitStatus {
+	status := unitStatus{
+		Name:           rmu.UnitName,
+		Number:         rmu.UnitNumber,
+		Link:           cs.linkStatus(rmu.UnitNumber),
+		MapPosition:    rmu.MapPosition,
+		Disabled:       rmu.Disabled,
+		WateringPolicy: cs.wateringPolicy(rmu.UnitNumber),
+	}
+
+	cs.lastPollsMu.Lock()
+	poll, polled := cs.lastPolls[rmu.UnitNumber]
+	cs.lastPollsMu.Unlock()
+	if polled {
+		readings := readingsOf(poll.Averaged)
+		status.Readings = &readings
+		status.RawReadings = make(map[string]float64, len(poll.Raw))
+		for _, r := range poll.Raw {
+			status.RawReadings[r.Name] = r.Value
+		}
+		status.LastReading = poll.At
+		status.ReadingAgeSeconds = time.Since(poll.At).Seconds()
+	}
+
+	if run, ok := cs.state().Active[rmu.UnitNumber]; ok {
+		status.Valve = valveState{
+			Open:         true,
+			Since:        run.Start,
+			Until:        run.Until,
+			Trigger:      run.Trigger,
+			RequestedBy:  run.RequestedBy,
+			VolumeLitres: run.volumeLitres,
+		}
+	}
+	status.WateringWindow = cs.wateringWindowState(rmu.UnitNumber)
+	return status
+}
+
+// Get the watering window a unit is currently in, otherwise the next one to open. Nil if the
+// unit has no windows or none could be worked out
+func (cs *ControlSystem) wateringWindowState(unitNumber uint) *windowState {
+	now := time.Now()
+	var next *windowState
+	for day := -1; day <= 1; day++ {
+		for _, w := range cs.wateringWindows(unitNumber) {
+			start, end, err := cs.windowOnDay(w, now.AddDate(0, 0, day))
+			if err != nil || !end.After(now) {
+				continue
+			}
+			if !start.After(now) {
+				return &windowState{Open: true, Event: w.Event, Start: start, End: end}
+			}
+			if next == nil || start.Before(next.Start) {
+				next = &windowState{Event: w.Event, Start: start, End: end}
+			}
+		}
+	}
+	return next
+}
+
+// Every pending and active watering, in the order they start
+func (s *schedulerState) schedule() []scheduleEntry {
+	entries := make([]scheduleEntry, 0)
+	for unitNumber, pending := range s.Pending {
+		entries = append(entries, scheduleEntry{
+			UnitName:        s.unitName(unitNumber),
+			UnitNumber:      unitNumber,
+			State:           "pending",
+			Start:           pending.At,
+			DurationSeconds: pending.Request.Duration.Seconds(),
+			Trigger:         pending.Request.Trigger,
+			RequestedBy:     pending.Request.RequestedBy,
+		})
+	}
+	for unitNumber, run := range s.Active {
+		entries = append(entries, scheduleEntry{
+			UnitName:        s.unitName(unitNumber),
+			UnitNumber:      unitNumber,
+			State:           "active",
+			Start:           run.Start,
+			Until:           run.Until,
+			DurationSeconds: run.Duration.Seconds(),
+			Trigger:         run.Trigger,
+			RequestedBy:     run.RequestedBy,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Start.Before(entries[j].Start) })
+	return entries
+}
+
+// Find a configured unit by its number or name
+func (cs *ControlSystem) findUnit(id string) (config.RemoteUnitConfig, bool) {
+	if number, err := strconv.Atoi(id); err == nil {
+		return cs.unitConfig(uint(number))
+	}
+	for _, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		if rmu.UnitName == id {
+			return rmu, true
+		}
+	}
+	return config.RemoteUnitConfig{}, false
+}
+
+// Route GET: The status of every unit
+func (cs *ControlSystem) RouteGETUnits(c *gin.Context) {
+	statuses := make([]unitStatus, 0, len(cs.currentConfig().RemoteUnitConfigs))
+	for _, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		statuses = append(statuses, cs.unitStatus(rmu))
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
+// Route GET: The status of a single unit, route is /api/units/:id where id is its number or name
+func (cs *ControlSystem) RouteGETUnit(c *gin.Context) {
+	rmu, ok := cs.findUnit(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg": fmt.Sprintf("no unit %q", c.Param("id")),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, cs.unitStatus(rmu))
+}
+
+// Route GET: Every pending and active watering, with why it was scheduled and by whom
+func (cs *ControlSystem) RouteGETSchedule(c *gin.Context) {
+	state := cs.state()
+	response := gin.H{
+		"waterings": state.schedule(),
+	}
+	if state.held() {
+		response["held_until"] = state.HeldUntil
+		response["held_reason"] = state.HoldReason
+	}
+	c.JSON(http.StatusOK, response)
+}
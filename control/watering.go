@@ -0,0 +1,138 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/events"
+	"fmt"
+	"time"
+)
+
+// Who requested automatic waterings
+const requestedByController = "controller"
+
+// Why a watering was scheduled, kept from when it is scheduled until it finishes
+type WateringRequest struct {
+	Trigger     string        // One of the db trigger constants
+	RequestedBy string        // Who or what asked for it, such as the controller or an API client
+	Duration    time.Duration // How long to water for, the default if zero
+}
+
+// A watering that is currently running
+type wateringRun struct {
+	WateringRequest
+	Start          time.Time
+	EndReason      string // Set when something other than the timer ends the watering
+	volumeLitres   float64
+	lastFlowSample time.Time
+}
+
+// Schedule a unit to be watered at the given time
+func (cs *ControlSystem) scheduleWatering(unitNumber uint, at time.Time, req WateringRequest) {
+	if req.Duration == 0 {
+		req.Duration = cs.wateringPolicy(unitNumber).Duration()
+	}
+	cs.systemTiming.NextWateringTime[unitNumber] = at
+	cs.systemTiming.WateringRequests[unitNumber] = req
+	cs.publishUnitEvent(events.TypeWateringScheduled, unitNumber, scheduleEntry{
+		UnitName:        cs.unitName(unitNumber),
+		UnitNumber:      unitNumber,
+		State:           "pending",
+		Start:           at,
+		DurationSeconds: req.Duration.Seconds(),
+		Trigger:         req.Trigger,
+		RequestedBy:     req.RequestedBy,
+	})
+}
+
+// The watering policy of a unit, the system one with any of the unit's overrides
+func (cs *ControlSystem) wateringPolicy(unitNumber uint) config.WateringPolicy {
+	policy := cs.currentConfig().WateringPolicy.WithDefaults()
+	if rmu, ok := cs.unitConfig(unitNumber); ok {
+		policy = policy.Override(rmu.WateringPolicy)
+	}
+	return policy
+}
+
+// Get the request for a pending watering, anything scheduled without one is treated as automatic
+func (cs *ControlSystem) wateringRequest(unitNumber uint) WateringRequest {
+	req, ok := cs.systemTiming.WateringRequests[unitNumber]
+	if !ok {
+		req = WateringRequest{Trigger: db.TriggerThreshold, RequestedBy: requestedByController}
+	}
+	if req.Duration == 0 {
+		req.Duration = cs.wateringPolicy(unitNumber).Duration()
+	}
+	return req
+}
+
+// Update a running watering from the latest poll of its unit. The flow rate is taken to be in
+// litres per minute and is integrated between polls
+func (cs *ControlSystem) updateWateringRun(unitNumber uint, values db.CurrentLocalValues) {
+	run, ok := cs.activeWaterings[unitNumber]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	run.volumeLitres += values.FlowRate * now.Sub(run.lastFlowSample).Minutes()
+	run.lastFlowSample = now
+
+	if values.SoilMoisture >= cs.wateringPolicy(unitNumber).TargetPercent && run.EndReason == "" {
+		cs.logger.Info(fmt.Sprintf("unit %d reached its target soil moisture, stopping watering", unitNumber))
+		run.EndReason = db.EndTargetReached
+		cs.systemTiming.WateringUntilTime[unitNumber] = now
+	}
+}
+
+// Write the record of a watering that has just been turned off
+func (cs *ControlSystem) finishWateringRun(unitNumber uint) {
+	run, ok := cs.activeWaterings[unitNumber]
+	if !ok {
+		return
+	}
+	delete(cs.activeWaterings, unitNumber)
+
+	endReason := run.EndReason
+	if endReason == "" {
+		endReason = db.EndTimer
+	}
+	now := time.Now()
+	cs.writeWateringEvent(db.WateringEvent{
+		UnitName:          cs.unitName(unitNumber),
+		UnitNumber:        unitNumber,
+		Start:             run.Start,
+		End:               now,
+		CommandedDuration: run.Duration,
+		ActualDuration:    now.Sub(run.Start),
+		VolumeLitres:      run.volumeLitres,
+		Trigger:           run.Trigger,
+		RequestedBy:       run.RequestedBy,
+		EndReason:         endReason,
+	})
+}
+
+// Record a watering that could not be started, and drop its request
+func (cs *ControlSystem) recordWateringFault(unitNumber uint, req WateringRequest) {
+	delete(cs.systemTiming.NextWateringTime, unitNumber)
+	delete(cs.systemTiming.WateringRequests, unitNumber)
+	now := time.Now()
+	cs.writeWateringEvent(db.WateringEvent{
+		UnitName:          cs.unitName(unitNumber),
+		UnitNumber:        unitNumber,
+		Start:             now,
+		End:               now,
+		CommandedDuration: req.Duration,
+		Trigger:           req.Trigger,
+		RequestedBy:       req.RequestedBy,
+		EndReason:         db.EndFault,
+	})
+}
+
+// Write a watering record to storage, failures are only logged. Every record is the end of a
+// watering, so it is published as stopped
+func (cs *ControlSystem) writeWateringEvent(e db.WateringEvent) {
+	cs.publishUnitEvent(events.TypeWateringStopped, e.UnitNumber, e)
+	if err := cs.storage().WriteWateringEvent(cs.currentConfig().Name, e); err != nil {
+		cs.logger.Error(fmt.Sprintf("could not write watering record for unit %d: %s", e.UnitNumber, err.Error()))
+	}
+}
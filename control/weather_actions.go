@@ -0,0 +1,245 @@
+package control
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/db"
+	"as2controlv2/weather"
+	"fmt"
+	"time"
+)
+
+// The weather warning types that can trigger an action, these are the keys of the actions config
+const (
+	weatherWarningHeatwave  = "heatwave"
+	weatherWarningFrost     = "frost"
+	weatherWarningHeavyRain = "heavy_rain"
+	weatherWarningHighWind  = "high_wind"
+)
+
+// Once an action has been taken for a warning type, don't take it again for this long, otherwise a
+// forecast heatwave would water every 30 seconds
+const weatherActionCooldown = 12 * time.Hour
+
+// How long a skip action holds automatic watering off, it is extended while the warning stays active
+const weatherHoldDuration = time.Hour
+
+// How long before an expected frost that frost protection watering is started
+const frostProtectionLead = time.Hour
+
+// Generate the typed warnings from the current weather observation
+func (cs *ControlSystem) generateObservedWeatherWarnings(s *schedulerState, stale bool) []warning {
+	conf := cs.currentConfig().WeatherWarnings.WithDefaults()
+	current := s.Weather
+	ws := make([]warning, 0)
+
+	tempC := weather.KelvinToCelsius(current.Main.TempKelvin)
+	if tempC <= *conf.FrostTempC {
+		ws = append(ws, warning{
+			Name:  "Frost",
+			Value: tempC,
+			Msg:   "It is currently cold enough for frost",
+			Type:  weatherWarningFrost,
+			Stale: stale,
+		})
+	}
+
+	rain := max(current.Rain.OneHour, current.Rain.ThreeHour)
+	if rain >= *conf.HeavyRainMM {
+		ws = append(ws, warning{
+			Name:  "Heavy Rain",
+			Value: rain,
+			Msg:   "It is currently raining heavily",
+			Type:  weatherWarningHeavyRain,
+			Stale: stale,
+		})
+	}
+
+	// Wind only matters if we are about to water, as the spray will be blown away
+	if current.Wind.Speed >= *conf.HighWindMS {
+		for unit, p := range s.Pending {
+			if p.At.After(time.Now().Add(time.Hour)) {
+				continue
+			}
+			ws = append(ws, warning{
+				Name:  s.unitName(unit),
+				Value: current.Wind.Speed,
+				Msg:   fmt.Sprintf("Wind is high and unit %d is about to be watered", unit),
+				Type:  weatherWarningHighWind,
+				Stale: stale,
+			})
+		}
+	}
+	return ws
+}
+
+// Generate the typed warnings from the forecast, looking ahead the configured number of hours
+func (cs *ControlSystem) generateForecastWarnings(s *schedulerState) []warning {
+	conf := cs.currentConfig().WeatherWarnings.WithDefaults()
+	ws := make([]warning, 0)
+	fc, ok := cs.weatherHandler.LastForecast()
+	if !ok {
+		return ws
+	}
+	stale := fc.IsStale(cs.weatherHandler.StaleAfter())
+	entries := fc.Result.Within(time.Duration(conf.ForecastHours) * time.Hour)
+
+	// Find the first period that crosses each threshold, and the worst value over the window
+	var heatAt, frostAt, rainAt *time.Time
+	maxTemp, minTemp, maxRain := 0.0, 0.0, 0.0
+	for i, e := range entries {
+		t := e.Time()
+		high := weather.KelvinToCelsius(e.Main.TempMaxKelvin)
+		low := weather.KelvinToCelsius(e.Main.TempMinKelvin)
+		if i == 0 || high > maxTemp {
+			maxTemp = high
+		}
+		if i == 0 || low < minTemp {
+			minTemp = low
+		}
+		maxRain = max(maxRain, e.Rain.ThreeHour)
+		if heatAt == nil && high >= *conf.HeatwaveTempC {
+			heatAt = &t
+		}
+		if frostAt == nil && low <= *conf.FrostTempC {
+			frostAt = &t
+		}
+		if rainAt == nil && e.Rain.ThreeHour >= *conf.HeavyRainMM {
+			rainAt = &t
+		}
+	}
+
+	if heatAt != nil {
+		ws = append(ws, warning{
+			Name:       "Forecast Heatwave",
+			Value:      maxTemp,
+			Msg:        fmt.Sprintf("Temperatures of %.1f degrees are forecast in the next %d hours", maxTemp, conf.ForecastHours),
+			Type:       weatherWarningHeatwave,
+			ExpectedAt: heatAt,
+			Stale:      stale,
+		})
+	}
+	if frostAt != nil {
+		ws = append(ws, warning{
+			Name:       "Forecast Frost",
+			Value:      minTemp,
+			Msg:        fmt.Sprintf("Temperatures of %.1f degrees are forecast, there is a risk of frost", minTemp),
+			Type:       weatherWarningFrost,
+			ExpectedAt: frostAt,
+			Stale:      stale,
+		})
+	}
+	if rainAt != nil {
+		ws = append(ws, warning{
+			Name:       "Forecast Heavy Rain",
+			Value:      maxRain,
+			Msg:        fmt.Sprintf("Up to %.1fmm of rain in 3 hours is forecast", maxRain),
+			Type:       weatherWarningHeavyRain,
+			ExpectedAt: rainAt,
+			Stale:      stale,
+		})
+	}
+
+	// Check the wind for each watering that is planned
+	for unit, p := range s.Pending {
+		e, ok := fc.Result.At(p.At)
+		if !ok || e.Wind.Speed < *conf.HighWindMS {
+			continue
+		}
+		at := p.At
+		ws = append(ws, warning{
+			Name:       s.unitName(unit),
+			Value:      e.Wind.Speed,
+			Msg:        fmt.Sprintf("Wind of %.1fm/s is forecast while unit %d is planned to be watered", e.Wind.Speed, unit),
+			Type:       weatherWarningHighWind,
+			ExpectedAt: &at,
+			Stale:      stale,
+		})
+	}
+	return ws
+}
+
+// Take the configured action for each active weather warning. Warnings based on stale data are
+// not acted on
+func (cs *ControlSystem) CheckWeatherActions() {
+	conf := cs.currentConfig().WeatherWarnings.WithDefaults()
+	for _, w := range cs.generateWeatherWarnings(cs.snapshot()) {
+		if w.Type == "" || w.Stale {
+			continue
+		}
+		action, ok := conf.Actions[w.Type]
+		if !ok || action == config.WeatherActionNone {
+			continue
+		}
+
+		switch action {
+		case config.WeatherActionSkipWatering:
+			cs.holdWatering(w.Type)
+		case config.WeatherActionPreWater:
+			if cs.weatherActionDue(w.Type) {
+				cs.logger.Info(fmt.Sprintf("pre-watering all units ahead of %s warning", w.Type))
+				cs.scheduleAllUnits(time.Now(), WateringRequest{Trigger: db.TriggerPreWater, RequestedBy: "weather:" + w.Type})
+			}
+		case config.WeatherActionFrostProtect:
+			if cs.weatherActionDue(w.Type) {
+				at := time.Now()
+				if w.ExpectedAt != nil && w.ExpectedAt.Add(-frostProtectionLead).After(at) {
+					at = w.ExpectedAt.Add(-frostProtectionLead)
+				}
+				cs.logger.Info(fmt.Sprintf("scheduling frost protection watering for all units at %s", at.Format(time.RFC3339)))
+				cs.scheduleAllUnits(at, WateringRequest{Trigger: db.TriggerFrostProtect, RequestedBy: "weather:" + w.Type})
+			}
+		default:
+			cs.logger.Warn(fmt.Sprintf("unknown weather action %q for warning %s", action, w.Type))
+		}
+	}
+}
+
+// Check whether an action can be taken for a warning type, and record that it has been if so
+func (cs *ControlSystem) weatherActionDue(warningType string) bool {
+	if last, ok := cs.lastWeatherActions[warningType]; ok && time.Since(last) < weatherActionCooldown {
+		return false
+	}
+	cs.lastWeatherActions[warningType] = time.Now()
+	return true
+}
+
+// Hold automatic watering off, and drop any automatic watering that is waiting to start. Waterings
+// someone asked for are left to go ahead
+func (cs *ControlSystem) holdWatering(reason string) {
+	if !cs.wateringIsHeld() {
+		cs.logger.Info(fmt.Sprintf("holding automatic watering because of %s warning", reason))
+	}
+	cs.wateringHeldUntil = time.Now().Add(weatherHoldDuration)
+	cs.wateringHoldReason = reason
+	for unit := range cs.systemTiming.NextWateringTime {
+		if cs.wateringRequest(unit).Trigger == db.TriggerManual {
+			continue
+		}
+		cs.logger.Info(fmt.Sprintf("skipping planned watering for unit %d because of %s warning", unit, reason))
+		cs.writeEvent("watering_skipped", unit, map[string]interface{}{"reason": reason})
+		delete(cs.systemTiming.NextWateringTime, unit)
+		delete(cs.systemTiming.WateringRequests, unit)
+	}
+}
+
+// Whether automatic watering is currently being held off by a weather action
+func (cs *ControlSystem) wateringIsHeld() bool {
+	return time.Now().Before(cs.wateringHeldUntil)
+}
+
+// Schedule every configured unit for watering at the given time, unless it is already planned
+// or watering
+func (cs *ControlSystem) scheduleAllUnits(at time.Time, req WateringRequest) {
+	for _, rmu := range cs.currentConfig().RemoteUnitConfigs {
+		if rmu.Disabled {
+			continue
+		}
+		if _, ok := cs.systemTiming.NextWateringTime[rmu.UnitNumber]; ok {
+			continue
+		}
+		if _, ok := cs.systemTiming.WateringUntilTime[rmu.UnitNumber]; ok {
+			continue
+		}
+		cs.scheduleWatering(rmu.UnitNumber, at, req)
+	}
+}
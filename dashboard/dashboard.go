@@ -0,0 +1,28 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The dashboard pages, built into the binary so nothing needs installing alongside it
+//
+//go:embed static
+var static embed.FS
+
+// Serve the dashboard under /dashboard/. The pages themselves are open, the API calls they make
+// carry the token the user enters
+func Register(r *gin.Engine) {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		// The directory is embedded at build time so this can't happen
+		panic(err)
+	}
+	r.StaticFS("/dashboard", http.FS(files))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard/")
+	})
+}
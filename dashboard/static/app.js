@@ -0,0 +1,255 @@
+// The controller dashboard. Everything comes from /api/v1, the event stream is used to know when
+// to refresh rather than patching the page from each event
+"use strict";
+
+const api = "/api/v1";
+const tokenKey = "as2control.token";
+const horizonHours = 24;
+
+let token = localStorage.getItem(tokenKey) || "";
+let stream = null;
+let refreshTimer = null;
+
+function headers(extra) {
+	const h = Object.assign({}, extra);
+	if (token) {
+		h["Authorization"] = "Bearer " + token;
+	}
+	return h;
+}
+
+async function request(method, path, body) {
+	const opts = { method: method, headers: headers(body ? { "Content-Type": "application/json" } : {}) };
+	if (body) {
+		opts.body = JSON.stringify(body);
+	}
+	const res = await fetch(api + path, opts);
+	const data = await res.json().catch(() => null);
+	if (!res.ok) {
+		const msg = data && data.error ? data.error.message : res.statusText;
+		throw new Error(msg);
+	}
+	return data;
+}
+
+function showError(err) {
+	const el = document.getElementById("error");
+	if (!err) {
+		el.hidden = true;
+		return;
+	}
+	el.textContent = err.message || String(err);
+	el.hidden = false;
+}
+
+function el(tag, attrs, ...children) {
+	const node = document.createElement(tag);
+	for (const [k, v] of Object.entries(attrs || {})) {
+		if (k === "onclick") {
+			node.addEventListener("click", v);
+		} else if (k === "style") {
+			Object.assign(node.style, v);
+		} else {
+			node.setAttribute(k, v);
+		}
+	}
+	for (const child of children) {
+		if (child !== null && child !== undefined) {
+			node.append(child);
+		}
+	}
+	return node;
+}
+
+function fixed(value, digits, unit) {
+	return typeof value === "number" ? value.toFixed(digits) + unit : "–";
+}
+
+function time(iso) {
+	const d = new Date(iso);
+	return isNaN(d) || d.getFullYear() < 2000 ? "–" : d.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+}
+
+// Run a command, then refresh so the page shows its effect
+async function command(method, path, body) {
+	try {
+		await request(method, path, body);
+		showError(null);
+	} catch (err) {
+		showError(err);
+	}
+	refresh();
+}
+
+function renderMap(units) {
+	const map = document.getElementById("map");
+	map.replaceChildren();
+	const cols = Math.ceil(Math.sqrt(units.length)) || 1;
+	const rows = Math.ceil(units.length / cols) || 1;
+	units.forEach((u, i) => {
+		// Units without a position are spread evenly over the map
+		const pos = u.map_position || {
+			x: ((i % cols) + 0.5) * 100 / cols,
+			y: (Math.floor(i / cols) + 0.5) * 100 / rows,
+		};
+		const classes = ["zone"];
+		if (u.valve.open) classes.push("watering");
+		if (u.link.state === "offline") classes.push("offline");
+		map.append(el("div", { class: classes.join(" "), style: { left: pos.x + "%", top: pos.y + "%" } },
+			el("strong", {}, u.name), el("br"),
+			u.readings ? fixed(u.readings.soil_moisture, 1, "%") : "no reading"));
+	});
+}
+
+function renderUnits(units) {
+	const container = document.getElementById("units");
+	container.replaceChildren();
+	for (const u of units) {
+		const r = u.readings || {};
+		const valve = u.valve.open ? "open until " + time(u.valve.until) : "closed";
+		const window = u.watering_window
+			? (u.watering_window.open ? "open until " : "opens ") + time(u.watering_window.open ? u.watering_window.end : u.watering_window.start)
+			: "any time";
+		container.append(el("div", { class: "card" },
+			el("h3", {}, u.name, el("span", { class: "badge " + u.link.state }, u.link.state)),
+			el("dl", {},
+				el("dt", {}, "Soil moisture"), el("dd", {}, fixed(r.soil_moisture, 1, "%")),
+				el("dt", {}, "Temperature"), el("dd", {}, fixed(r.temperature, 1, "°C")),
+				el("dt", {}, "Humidity"), el("dd", {}, fixed(r.humidity, 0, "%")),
+				el("dt", {}, "VPD"), el("dd", {}, fixed(r.vpd_kpa, 2, " kPa")),
+				el("dt", {}, "Flow"), el("dd", {}, fixed(r.flow_rate, 1, " L/min")),
+				el("dt", {}, "Valve"), el("dd", {}, valve),
+				el("dt", {}, "Window"), el("dd", {}, window),
+				el("dt", {}, "Last reading"), el("dd", {}, time(u.last_reading))),
+			el("div", { class: "controls" },
+				el("button", { onclick: () => waterNow(u) }, "Water"),
+				el("button", { onclick: () => command("DELETE", "/units/" + u.number + "/watering") }, "Cancel"),
+				el("button", { onclick: () => delay(u) }, "Delay"))));
+	}
+}
+
+function waterNow(u) {
+	const minutes = prompt("Water " + u.name + " for how many minutes? Leave empty for the configured duration", "");
+	if (minutes === null) {
+		return;
+	}
+	const body = minutes.trim() === "" ? {} : { duration_seconds: Math.round(parseFloat(minutes) * 60) };
+	command("POST", "/units/" + u.number + "/watering", body);
+}
+
+function delay(u) {
+	const minutes = prompt("Delay the next watering of " + u.name + " by how many minutes?", "60");
+	if (minutes === null) {
+		return;
+	}
+	command("POST", "/units/" + u.number + "/watering/delay", { minutes: parseInt(minutes, 10) });
+}
+
+function renderSchedule(schedule, units) {
+	const timeline = document.getElementById("timeline");
+	timeline.replaceChildren();
+	if (schedule.held_until) {
+		const reason = (schedule.held_reason || "weather").replace(/_/g, " ");
+		timeline.append(el("p", { class: "held" },
+			"Automatic watering is held until " + time(schedule.held_until) + " because of a " + reason + " warning"));
+	}
+	const start = Date.now();
+	const span = horizonHours * 3600 * 1000;
+	const upcoming = schedule.waterings.filter((e) => new Date(e.start).getTime() < start + span);
+	if (upcoming.length === 0) {
+		timeline.append(el("p", { class: "empty" }, "Nothing scheduled in the next " + horizonHours + " hours"));
+		return;
+	}
+	for (const u of units) {
+		const lane = el("div", { class: "lane" }, el("span", { class: "label" }, u.name));
+		for (const e of upcoming.filter((e) => e.unit_number === u.number)) {
+			const from = Math.max(new Date(e.start).getTime(), start);
+			const left = (from - start) / span * 100;
+			const width = e.duration_seconds * 1000 / span * 100;
+			lane.append(el("div", {
+				class: "slot " + e.state,
+				title: e.state + " " + time(e.start) + " for " + Math.round(e.duration_seconds / 60) + " min (" + e.trigger + ")",
+				style: { left: left + "%", width: width + "%" },
+			}));
+		}
+		timeline.append(lane);
+	}
+	timeline.append(el("div", { class: "axis" },
+		el("span", {}, "now"), el("span", {}, "+" + horizonHours / 2 + "h"), el("span", {}, "+" + horizonHours + "h")));
+}
+
+function renderWarnings(warnings) {
+	const list = document.getElementById("warnings");
+	list.replaceChildren();
+	if (warnings.length === 0) {
+		list.append(el("li", { class: "empty" }, "No warnings"));
+		return;
+	}
+	for (const w of warnings) {
+		const ack = w.acknowledged
+			? el("span", { class: "badge" }, "acknowledged")
+			: el("button", { onclick: () => command("POST", "/warnings/acknowledge", { key: w.key }) }, "Acknowledge");
+		list.append(el("li", { class: w.acknowledged ? "acknowledged" : "" },
+			el("span", {}, el("strong", {}, w.name), " ", w.message), ack));
+	}
+}
+
+async function refresh() {
+	try {
+		const [units, schedule, warnings] = await Promise.all([
+			request("GET", "/units"),
+			request("GET", "/schedule"),
+			request("GET", "/warnings"),
+		]);
+		renderMap(units);
+		renderUnits(units);
+		renderSchedule(schedule, units);
+		renderWarnings(warnings);
+	} catch (err) {
+		showError(err);
+	}
+}
+
+// Events arrive in bursts during a poll, so refresh once they settle
+function refreshSoon() {
+	clearTimeout(refreshTimer);
+	refreshTimer = setTimeout(refresh, 500);
+}
+
+function connect() {
+	if (stream) {
+		stream.close();
+	}
+	// EventSource can't set headers, so the token goes in the query
+	const query = token ? "?access_token=" + encodeURIComponent(token) : "";
+	stream = new EventSource(api + "/events" + query);
+	const badge = document.getElementById("connection");
+	stream.onopen = () => {
+		badge.textContent = "live";
+		badge.className = "badge online";
+	};
+	stream.onerror = () => {
+		badge.textContent = "reconnecting";
+		badge.className = "badge degraded";
+	};
+	stream.onmessage = refreshSoon;
+	for (const type of ["reading", "warning_raised", "warning_cleared", "warning_acknowledged", "watering_scheduled",
+		"watering_started", "watering_stopped", "unit_online", "unit_offline", "config_changed"]) {
+		stream.addEventListener(type, refreshSoon);
+	}
+}
+
+document.getElementById("token").value = token;
+document.getElementById("token-form").addEventListener("submit", (e) => {
+	e.preventDefault();
+	token = document.getElementById("token").value.trim();
+	localStorage.setItem(tokenKey, token);
+	showError(null);
+	refresh();
+	connect();
+});
+
+refresh();
+connect();
+// The reading ages and windows move on even when nothing happens
+setInterval(refresh, 60 * 1000);
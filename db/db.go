@@ -2,20 +2,29 @@ package db
 
 import (
 	"as2controlv2/config"
+	"as2controlv2/metrics"
 	"as2controlv2/weather"
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	influxAPI "github.com/influxdata/influxdb-client-go/v2/api"
+	influxHTTP "github.com/influxdata/influxdb-client-go/v2/api/http"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
 // DB Connection to InfluxDB
 type DBConnection struct {
+	typedSink
 	client   influxdb2.Client
 	writeAPI influxAPI.WriteAPIBlocking
+	queryAPI influxAPI.QueryAPI
+	bucket   string
 }
 
 // Tags for a given metric
@@ -28,106 +37,139 @@ type Tags struct {
 type CurrentLocalValues struct {
 	Temperature  float64
 	Humidity     float64
-	SoilMoisture float64
+	SoilMoisture float64 // Calibrated volumetric water content where the sensors have curves
 	FlowRate     float64
 	WaterOn      float64
+
+	// The soil moisture averaged from the uncalibrated sensor readings
+	SoilMoistureRaw float64
+
+	// Derived from the temperature and humidity
+	VapourPressureDeficit float64
+	DewPoint              *float64 // Nil when it is undefined, such as when the humidity reads zero
 }
 
 // Establish a connection to InfluxDB
-func DBInit(conf config.InfluxDBConfig) (DBConnection, error) {
+func DBInit(conf config.InfluxDBConfig) (*DBConnection, error) {
 	client := influxdb2.NewClient(conf.URL, conf.Token)
 
 	// Open a write API
 	writeAPI := client.WriteAPIBlocking(conf.Organisation, conf.Bucket)
-	conn := DBConnection{
+	conn := &DBConnection{
 		client:   client,
 		writeAPI: writeAPI,
+		queryAPI: client.QueryAPI(conf.Organisation),
+		bucket:   conf.Bucket,
 	}
+	conn.typedSink = typedSink{writePoint: conn.WritePoint}
 	return conn, nil
 }
 
-// This method is intended to write a sensor metric to InfluxDB
-func (db *DBConnection) WriteSensorMetric(measurementName string, value float64, tags Tags) error {
-	// Make the tags
-	tagsMap := map[string]string{
-		"system_name":      tags.SystemName,
-		"remote_unit_name": tags.RemoteUnitName,
+// Check that InfluxDB is up and accepting requests
+func (db *DBConnection) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ok, err := db.client.Ping(ctx)
+	if err != nil {
+		return err
 	}
-
-	fieldsMap := map[string]interface{}{
-		"value": value,
+	if !ok {
+		return errors.New("InfluxDB did not respond to ping")
 	}
+	return nil
+}
 
-	// Make the fields
-	point := write.NewPoint(measurementName, tagsMap, fieldsMap, time.Now())
+// Write a single point to InfluxDB
+func (db *DBConnection) WritePoint(p Point) error {
+	point := write.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
 	if err := db.writeAPI.WritePoint(context.Background(), point); err != nil {
+		metrics.Default.Inc("as2_db_write_errors_total", metrics.Labels{"backend": BackendInfluxDB})
+		if refused(err) {
+			return fmt.Errorf("%w: %w", ErrRejected, err)
+		}
 		return err
 	}
 	return nil
 }
 
-// This method is intended to tell the user that a remote unit is not connected
-func (db *DBConnection) WriteStatusMetric(tags Tags, status uint) error {
-	tagsMap := map[string]string{
-		"system_name":      tags.SystemName,
-		"remote_unit_name": tags.RemoteUnitName,
+// Whether InfluxDB refused a write because of the point itself, such as a field type conflict. A
+// bad token, a missing bucket or rate limiting would refuse every point, so those are retried
+// until they are fixed rather than every point being set aside
+func refused(err error) bool {
+	var httpErr *influxHTTP.Error
+	if !errors.As(err, &httpErr) || httpErr.StatusCode < 400 || httpErr.StatusCode >= 500 {
+		return false
 	}
-	fieldsMap := map[string]interface{}{
-		"status": status,
+	switch httpErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
 	}
-
-	// Write these values
-	point := write.NewPoint("remote_unit_status", tagsMap, fieldsMap, time.Now())
-	if err := db.writeAPI.WritePoint(context.Background(), point); err != nil {
-		return err
-	}
-	return nil
+	return true
 }
 
-// Write a current weather prediction from Openweather map
-func (db *DBConnection) WriteCurrentWeatherData( /*Need to implement*/ ) error {
-	return errors.New("not yet implemented")
+// Write a current weather observation from OpenWeatherMap. The point is timestamped with the
+// observation time, so fetching the same observation again overwrites it rather than duplicating it
+func (db *DBConnection) WriteCurrentWeatherData(wr weather.CurrentWeatherResult) error {
+	return db.WritePoint(weatherPoint(wr))
 }
 
-// Write the metrics for a single unit
-func (db *DBConnection) WriteUnitMetrics(measurementName string, localValues CurrentLocalValues, tags Tags) error {
-	tagsMap := map[string]string{
-		"system_name":      tags.SystemName,
-		"remote_unit_name": tags.RemoteUnitName,
-	}
-	fieldsMap := map[string]interface{}{
-		"temperature":   localValues.Temperature,
-		"humidity":      localValues.Humidity,
-		"soil_moisture": localValues.SoilMoisture,
-		"flow_rate":     localValues.FlowRate,
-		"water_on":      localValues.WaterOn,
-	}
-	point := write.NewPoint(measurementName, tagsMap, fieldsMap, time.Now())
-	if err := db.writeAPI.WritePoint(context.Background(), point); err != nil {
-		return err
-	}
+// Close the connection to InfluxDB
+func (db *DBConnection) Close() error {
+	db.client.Close()
 	return nil
 }
 
-// Write the weather metrics to InfluxDB
-func (db *DBConnection) WriteWeatherMetrics(wr weather.CurrentWeatherResult) error {
+// Make the tags for a weather observation, the primary condition is used as a tag so it can be
+// grouped on
+func weatherTags(wr weather.CurrentWeatherResult) map[string]string {
 	tags := map[string]string{
 		"location": wr.Name,
+		"country":  wr.Sys.Country,
+	}
+	if len(wr.Weather) > 0 {
+		tags["condition_id"] = strconv.Itoa(wr.Weather[0].ID)
+		tags["condition_main"] = wr.Weather[0].Main
 	}
+	return tags
+}
 
+// Make the fields for a weather observation, temperatures are converted to Celsius
+func weatherFields(wr weather.CurrentWeatherResult) map[string]interface{} {
 	fields := map[string]interface{}{
-		"temperature":            wr.Main.TempKelvin - 272.15,
-		"temperature_feels_like": wr.Main.TempFeelsLikeKelvin - 272.15,
-		"temperature_max":        wr.Main.TempMaxKelvin - 272.15,
-		"temperature_min":        wr.Main.TempMinKelvin - 272.15,
+		"latitude":               wr.Coord.Latitude,
+		"longitude":              wr.Coord.Longitude,
+		"base":                   wr.Base,
+		"temperature":            weather.KelvinToCelsius(wr.Main.TempKelvin),
+		"temperature_feels_like": weather.KelvinToCelsius(wr.Main.TempFeelsLikeKelvin),
+		"temperature_max":        weather.KelvinToCelsius(wr.Main.TempMaxKelvin),
+		"temperature_min":        weather.KelvinToCelsius(wr.Main.TempMinKelvin),
 		"pressure":               wr.Main.PressurehPa,
+		"sea_level_pressure":     wr.Main.SeaLevelPressure,
+		"ground_level_pressure":  wr.Main.GroundLevelPressure,
 		"humidity":               wr.Main.HumidityPercent,
-		"cloud_coverage":         wr.Clouds.All,
+		"visibility_m":           int64(wr.Visibility),
 		"wind_speed_ms":          wr.Wind.Speed,
+		"wind_direction_deg":     wr.Wind.Deg,
+		"wind_gust_ms":           wr.Wind.Gust,
+		"cloud_coverage":         wr.Clouds.All,
+		"rain_1h_mm":             wr.Rain.OneHour,
+		"rain_3h_mm":             wr.Rain.ThreeHour,
+		"sunrise":                int64(wr.Sys.Sunrise),
+		"sunset":                 int64(wr.Sys.Sunset),
+		"timezone_offset_s":      int64(wr.Timezone),
+		"location_id":            int64(wr.ID),
 	}
-	point := write.NewPoint("weather", tags, fields, time.Now())
-	if err := db.writeAPI.WritePoint(context.Background(), point); err != nil {
-		return err
+	if len(wr.Weather) > 0 {
+		fields["condition_description"] = wr.Weather[0].Description
+		fields["condition_icon"] = wr.Weather[0].Icon
 	}
-	return nil
+	// Any further conditions are kept as a list, OpenWeatherMap puts the primary one first
+	if len(wr.Weather) > 1 {
+		ids := make([]string, len(wr.Weather))
+		for i, w := range wr.Weather {
+			ids[i] = strconv.Itoa(w.ID)
+		}
+		fields["condition_ids"] = strings.Join(ids, ",")
+	}
+	return fields
 }
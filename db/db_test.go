@@ -0,0 +1,35 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	influxHTTP "github.com/influxdata/influxdb-client-go/v2/api/http"
+)
+
+// Only problems with the point itself are refusals, anything that would refuse every point is retried
+func TestRefused(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&influxHTTP.Error{StatusCode: http.StatusBadRequest}, true},
+		{&influxHTTP.Error{StatusCode: http.StatusUnprocessableEntity}, true},
+		{&influxHTTP.Error{StatusCode: http.StatusRequestEntityTooLarge}, true},
+		{fmt.Errorf("writing: %w", &influxHTTP.Error{StatusCode: http.StatusBadRequest}), true},
+		{&influxHTTP.Error{StatusCode: http.StatusUnauthorized}, false},
+		{&influxHTTP.Error{StatusCode: http.StatusForbidden}, false},
+		{&influxHTTP.Error{StatusCode: http.StatusNotFound}, false},
+		{&influxHTTP.Error{StatusCode: http.StatusTooManyRequests}, false},
+		{&influxHTTP.Error{StatusCode: http.StatusServiceUnavailable}, false},
+		{influxHTTP.NewError(errors.New("connection refused")), false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := refused(tt.err); got != tt.want {
+			t.Errorf("refused(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
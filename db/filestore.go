@@ -0,0 +1,112 @@
+package db
+
+import (
+	"as2controlv2/metrics"
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A local append-only store, one JSON point per line. This is for small installs that don't run
+// InfluxDB, so it favours simplicity over query speed
+type FileStore struct {
+	typedSink
+	path string
+	file *os.File
+	mu   sync.Mutex
+
+	lastErr     error     // The error from the last write, nil if it succeeded
+	lastSuccess time.Time // When a point was last written
+}
+
+// Open the file store at the given path, creating it if it doesn't exist
+func FileStoreInit(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStore{path: path, file: f}
+	fs.typedSink = typedSink{writePoint: fs.WritePoint}
+	return fs, nil
+}
+
+// Append a point to the store
+func (fs *FileStore) WritePoint(p Point) error {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, err = fs.file.Write(append(bytes, '\n')); err != nil {
+		metrics.Default.Inc("as2_db_write_errors_total", metrics.Labels{"backend": BackendFile})
+		fs.lastErr = err
+		return err
+	}
+	fs.lastErr = nil
+	fs.lastSuccess = time.Now()
+	return nil
+}
+
+// Get every point in a measurement between start (inclusive) and end (exclusive) that has all of
+// the given tags, sorted by time. An empty measurement matches all of them
+func (fs *FileStore) Query(measurement string, start, end time.Time, tags map[string]string) ([]Point, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	points := make([]Point, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var p Point
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			// A partly written line from a crash, skip it
+			continue
+		}
+		if measurement != "" && p.Measurement != measurement {
+			continue
+		}
+		if p.Time.Before(start) || !p.Time.Before(end) {
+			continue
+		}
+		if !hasTags(p, tags) {
+			continue
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// Close the store
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}
+
+// Whether a point has every one of the given tags
+func hasTags(p Point, tags map[string]string) bool {
+	for k, v := range tags {
+		if p.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
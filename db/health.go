@@ -0,0 +1,70 @@
+package db
+
+import "time"
+
+// The health of a single storage backend
+type BackendStatus struct {
+	Backend     string    `json:"backend"`
+	Healthy     bool      `json:"healthy"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	QueueDepth  int       `json:"queue_depth,omitempty"`
+}
+
+// Implemented by sinks that can report whether their backends are working
+type HealthReporter interface {
+	BackendHealth() []BackendStatus
+}
+
+// The health of InfluxDB behind the queue, from the result of the last write to it
+func (q *QueuedSink) BackendHealth() []BackendStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := BackendStatus{
+		Backend:     backendName(q.inner),
+		Healthy:     q.lastErr == nil,
+		LastSuccess: q.lastSuccess,
+		QueueDepth:  len(q.pending),
+	}
+	if q.lastErr != nil {
+		status.LastError = q.lastErr.Error()
+	}
+	return []BackendStatus{status}
+}
+
+// The health of the file store, from the result of the last write to it
+func (fs *FileStore) BackendHealth() []BackendStatus {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	status := BackendStatus{
+		Backend:     BackendFile,
+		Healthy:     fs.lastErr == nil,
+		LastSuccess: fs.lastSuccess,
+	}
+	if fs.lastErr != nil {
+		status.LastError = fs.lastErr.Error()
+	}
+	return []BackendStatus{status}
+}
+
+// The health of every sink that can report it
+func (m *MultiSink) BackendHealth() []BackendStatus {
+	statuses := make([]BackendStatus, 0, len(m.sinks))
+	for _, s := range m.sinks {
+		if h, ok := s.(HealthReporter); ok {
+			statuses = append(statuses, h.BackendHealth()...)
+		}
+	}
+	return statuses
+}
+
+// The configured name of the backend a sink writes to
+func backendName(s MetricsSink) string {
+	switch s.(type) {
+	case *DBConnection:
+		return BackendInfluxDB
+	case *FileStore:
+		return BackendFile
+	}
+	return "unknown"
+}
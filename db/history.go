@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Read queries over the stored history, for trend aware decisions and charts
+type HistoryReader interface {
+	SoilMoistureHistory(unitName string, since time.Duration) ([]Sample, error)
+	DailyWaterVolume(unitName string, days int) ([]Sample, error)
+	DailyTemperatureRange(unitName string, days int) ([]DailyRange, error)
+	WateringHistory(unitName string, since time.Duration) ([]WateringEvent, error)
+}
+
+// Returned when none of the storage backends can answer history queries
+var ErrNoHistory = errors.New("storage backend does not support history queries")
+
+// A single value at a point in time
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// The minimum and maximum of a value over a day
+type DailyRange struct {
+	Day time.Time `json:"day"`
+	Min float64   `json:"min"`
+	Max float64   `json:"max"`
+}
+
+// Get the soil moisture of a unit over the last period, oldest first
+func (db *DBConnection) SoilMoistureHistory(unitName string, since time.Duration) ([]Sample, error) {
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: -%ds)
+  |> filter(fn: (r) => r._measurement == %s and r._field == "soil_moisture")
+  |> sort(columns: ["_time"])`, strconv.Quote(db.bucket), int(since.Seconds()), strconv.Quote(unitName))
+	return db.querySamples(flux)
+}
+
+// Get the water delivered to a unit each day, from integrating the flow rate over each minute, so
+// this is in litres when the flow rate is in litres per minute
+func (db *DBConnection) DailyWaterVolume(unitName string, days int) ([]Sample, error) {
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: -%dd)
+  |> filter(fn: (r) => r._measurement == %s and r._field == "flow_rate")
+  |> aggregateWindow(every: 1d, fn: (column, tables=<-) => tables |> integral(unit: 1m, column: column), createEmpty: false)`,
+		strconv.Quote(db.bucket), days, strconv.Quote(unitName))
+	return db.querySamples(flux)
+}
+
+// Get the minimum and maximum temperature of a unit each day
+func (db *DBConnection) DailyTemperatureRange(unitName string, days int) ([]DailyRange, error) {
+	query := func(fn string) ([]Sample, error) {
+		return db.querySamples(fmt.Sprintf(`from(bucket: %s)
+  |> range(start: -%dd)
+  |> filter(fn: (r) => r._measurement == %s and r._field == "temperature")
+  |> aggregateWindow(every: 1d, fn: %s, createEmpty: false)`,
+			strconv.Quote(db.bucket), days, strconv.Quote(unitName), fn))
+	}
+	mins, err := query("min")
+	if err != nil {
+		return nil, err
+	}
+	maxes, err := query("max")
+	if err != nil {
+		return nil, err
+	}
+
+	// Both queries use the same windows, so line them up on time
+	ranges := make(map[time.Time]*DailyRange)
+	for _, s := range mins {
+		ranges[s.Time] = &DailyRange{Day: s.Time, Min: s.Value, Max: s.Value}
+	}
+	for _, s := range maxes {
+		if r, ok := ranges[s.Time]; ok {
+			r.Max = s.Value
+		}
+	}
+	return sortedRanges(ranges), nil
+}
+
+// Run a Flux query and read every record back as a sample
+func (db *DBConnection) querySamples(flux string) ([]Sample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := db.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	samples := make([]Sample, 0)
+	for result.Next() {
+		value, ok := toFloat(result.Record().Value())
+		if !ok {
+			continue
+		}
+		samples = append(samples, Sample{Time: result.Record().Time(), Value: value})
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return samples, nil
+}
+
+// Run a Flux query that has been pivoted so each record is a whole point
+func (db *DBConnection) queryPivoted(flux string) ([]Point, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := db.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	points := make([]Point, 0)
+	for result.Next() {
+		p := Point{
+			Measurement: result.Record().Measurement(),
+			Tags:        make(map[string]string),
+			Fields:      make(map[string]interface{}),
+			Time:        result.Record().Time(),
+		}
+		for k, v := range result.Record().Values() {
+			// Skip the columns Flux adds itself
+			if k == "result" || k == "table" || len(k) > 0 && k[0] == '_' {
+				continue
+			}
+			// After a pivot tags and fields are both just columns, so strings could be either
+			if s, ok := v.(string); ok {
+				p.Tags[k] = s
+			}
+			p.Fields[k] = v
+		}
+		points = append(points, p)
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return points, nil
+}
+
+// Get the soil moisture of a unit over the last period, oldest first
+func (fs *FileStore) SoilMoistureHistory(unitName string, since time.Duration) ([]Sample, error) {
+	points, err := fs.Query(unitName, time.Now().Add(-since), time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return fieldSamples(points, "soil_moisture"), nil
+}
+
+// Get the water delivered to a unit each day, from integrating the flow rate over each minute
+func (fs *FileStore) DailyWaterVolume(unitName string, days int) ([]Sample, error) {
+	points, err := fs.Query(unitName, startOfDay(time.Now()).AddDate(0, 0, -days+1), time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+	samples := fieldSamples(points, "flow_rate")
+
+	// Trapezoidal integral within each day, readings either side of midnight are not joined up
+	volumes := make(map[time.Time]float64)
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1], samples[i]
+		day := startOfDay(cur.Time)
+		if !startOfDay(prev.Time).Equal(day) {
+			continue
+		}
+		minutes := cur.Time.Sub(prev.Time).Minutes()
+		volumes[day] += (prev.Value + cur.Value) / 2 * minutes
+	}
+	result := make([]Sample, 0, len(volumes))
+	for day, v := range volumes {
+		result = append(result, Sample{Time: day, Value: v})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+// Get the minimum and maximum temperature of a unit each day
+func (fs *FileStore) DailyTemperatureRange(unitName string, days int) ([]DailyRange, error) {
+	points, err := fs.Query(unitName, startOfDay(time.Now()).AddDate(0, 0, -days+1), time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make(map[time.Time]*DailyRange)
+	for _, s := range fieldSamples(points, "temperature") {
+		day := startOfDay(s.Time)
+		r, ok := ranges[day]
+		if !ok {
+			ranges[day] = &DailyRange{Day: day, Min: s.Value, Max: s.Value}
+			continue
+		}
+		r.Min = min(r.Min, s.Value)
+		r.Max = max(r.Max, s.Value)
+	}
+	return sortedRanges(ranges), nil
+}
+
+// History queries go straight to the sink behind the queue, anything still queued won't show up
+func (q *QueuedSink) SoilMoistureHistory(unitName string, since time.Duration) ([]Sample, error) {
+	if h, ok := q.inner.(HistoryReader); ok {
+		return h.SoilMoistureHistory(unitName, since)
+	}
+	return nil, ErrNoHistory
+}
+
+// History queries go straight to the sink behind the queue, anything still queued won't show up
+func (q *QueuedSink) DailyWaterVolume(unitName string, days int) ([]Sample, error) {
+	if h, ok := q.inner.(HistoryReader); ok {
+		return h.DailyWaterVolume(unitName, days)
+	}
+	return nil, ErrNoHistory
+}
+
+// History queries go straight to the sink behind the queue, anything still queued won't show up
+func (q *QueuedSink) DailyTemperatureRange(unitName string, days int) ([]DailyRange, error) {
+	if h, ok := q.inner.(HistoryReader); ok {
+		return h.DailyTemperatureRange(unitName, days)
+	}
+	return nil, ErrNoHistory
+}
+
+// Answered by the first sink that can answer history queries
+func (m *MultiSink) SoilMoistureHistory(unitName string, since time.Duration) ([]Sample, error) {
+	if h, ok := m.historyReader(); ok {
+		return h.SoilMoistureHistory(unitName, since)
+	}
+	return nil, ErrNoHistory
+}
+
+// Answered by the first sink that can answer history queries
+func (m *MultiSink) DailyWaterVolume(unitName string, days int) ([]Sample, error) {
+	if h, ok := m.historyReader(); ok {
+		return h.DailyWaterVolume(unitName, days)
+	}
+	return nil, ErrNoHistory
+}
+
+// Answered by the first sink that can answer history queries
+func (m *MultiSink) DailyTemperatureRange(unitName string, days int) ([]DailyRange, error) {
+	if h, ok := m.historyReader(); ok {
+		return h.DailyTemperatureRange(unitName, days)
+	}
+	return nil, ErrNoHistory
+}
+
+// Find the first sink that can answer history queries
+func (m *MultiSink) historyReader() (HistoryReader, bool) {
+	for _, s := range m.sinks {
+		if h, ok := s.(HistoryReader); ok {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// Pull a single field out of a set of points, skipping points that don't have it
+func fieldSamples(points []Point, field string) []Sample {
+	samples := make([]Sample, 0, len(points))
+	for _, p := range points {
+		if v, ok := toFloat(p.Fields[field]); ok {
+			samples = append(samples, Sample{Time: p.Time, Value: v})
+		}
+	}
+	return samples
+}
+
+// Sort a set of daily ranges by day
+func sortedRanges(ranges map[time.Time]*DailyRange) []DailyRange {
+	result := make([]DailyRange, 0, len(ranges))
+	for _, r := range ranges {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Day.Before(result[j].Day) })
+	return result
+}
+
+// Midnight at the start of the local day of t
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Convert a stored value to a float, values read back from JSON or InfluxDB can be any number type
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	}
+	return 0, false
+}
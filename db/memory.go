@@ -0,0 +1,39 @@
+package db
+
+import "sync"
+
+// Keeps every point written to it in memory, so tests can check exactly what was written
+type MemorySink struct {
+	typedSink
+	points []Point
+	mu     sync.Mutex
+}
+
+// Make an empty in memory sink
+func NewMemorySink() *MemorySink {
+	m := &MemorySink{}
+	m.typedSink = typedSink{writePoint: m.WritePoint}
+	return m
+}
+
+// Record a point
+func (m *MemorySink) WritePoint(p Point) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.points = append(m.points, p)
+	return nil
+}
+
+// Get a copy of every point written so far
+func (m *MemorySink) Points() []Point {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	points := make([]Point, len(m.points))
+	copy(points, m.points)
+	return points
+}
+
+// Nothing to close
+func (m *MemorySink) Close() error {
+	return nil
+}
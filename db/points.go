@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Range queries over the raw points in storage, for exporting
+type PointReader interface {
+	Query(measurement string, start, end time.Time, tags map[string]string) ([]Point, error)
+}
+
+// Returned when none of the storage backends can answer range queries
+var ErrNoPointReader = errors.New("storage backend does not support range queries")
+
+// Format a point as InfluxDB line protocol, with nanosecond timestamps
+func (p Point) LineProtocol() string {
+	return write.PointToLineProtocol(write.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time), time.Nanosecond)
+}
+
+// Get every point in a measurement between start (inclusive) and end (exclusive) that has all of
+// the given tags, sorted by time
+func (db *DBConnection) Query(measurement string, start, end time.Time, tags map[string]string) ([]Point, error) {
+	filters := []string{fmt.Sprintf("r._measurement == %s", strconv.Quote(measurement))}
+	for k, v := range tags {
+		filters = append(filters, fmt.Sprintf("r[%s] == %s", strconv.Quote(k), strconv.Quote(v)))
+	}
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => %s)`, strconv.Quote(db.bucket), start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano), strings.Join(filters, " and "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	result, err := db.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	// Each record is a single field, so join them back up into points by time and tag set
+	points := make(map[string]*Point)
+	for result.Next() {
+		record := result.Record()
+		tagSet := make(map[string]string)
+		keyParts := []string{record.Time().Format(time.RFC3339Nano)}
+		for k, v := range record.Values() {
+			if k == "result" || k == "table" || strings.HasPrefix(k, "_") {
+				continue
+			}
+			if s, ok := v.(string); ok {
+				tagSet[k] = s
+				keyParts = append(keyParts, k+"="+s)
+			}
+		}
+		sort.Strings(keyParts[1:])
+		key := strings.Join(keyParts, ",")
+		p, ok := points[key]
+		if !ok {
+			p = &Point{
+				Measurement: record.Measurement(),
+				Tags:        tagSet,
+				Fields:      make(map[string]interface{}),
+				Time:        record.Time(),
+			}
+			points[key] = p
+		}
+		p.Fields[record.Field()] = record.Value()
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	sorted := make([]Point, 0, len(points))
+	for _, p := range points {
+		sorted = append(sorted, *p)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+	return sorted, nil
+}
+
+// Range queries go straight to the sink behind the queue, anything still queued won't show up
+func (q *QueuedSink) Query(measurement string, start, end time.Time, tags map[string]string) ([]Point, error) {
+	if r, ok := q.inner.(PointReader); ok {
+		return r.Query(measurement, start, end, tags)
+	}
+	return nil, ErrNoPointReader
+}
+
+// Answered by the first sink that can answer range queries
+func (m *MultiSink) Query(measurement string, start, end time.Time, tags map[string]string) ([]Point, error) {
+	for _, s := range m.sinks {
+		if r, ok := s.(PointReader); ok {
+			return r.Query(measurement, start, end, tags)
+		}
+	}
+	return nil, ErrNoPointReader
+}
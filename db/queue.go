@@ -0,0 +1,539 @@
+package db
+
+import (
+	"as2controlv2/metrics"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff between attempts to drain the queue while the backend is unreachable
+const (
+	queueMinBackoff = time.Second
+	queueMaxBackoff = 5 * time.Minute
+)
+
+// The queue size used when one is not configured
+const defaultQueueMaxPoints = 100000
+
+// Returned by a backend for a point it will never accept, such as one with a field of a different
+// type to the one it already has. Queued points that get it are set aside rather than retried, as
+// they would otherwise hold up everything behind them for good
+var ErrRejected = errors.New("point rejected by the storage backend")
+
+func init() {
+	metrics.Default.Describe("as2_db_queue_rejected_total", metrics.TypeCounter, "Queued points the storage backend refused, set aside in the rejected file")
+}
+
+// The queues that are open by path, so a queue opened where one is already running takes it over
+// rather than both writing to the same file
+var (
+	openQueuesMu sync.Mutex
+	openQueues   = make(map[string]*QueuedSink)
+)
+
+// Implemented by sinks that buffer writes, so their backlog can be reported as a health signal
+type Buffered interface {
+	QueueDepth() int
+	QueueDropped() uint64
+}
+
+// A point waiting in the queue, the sequence number lets the drain loop remove exactly the
+// point it wrote even if older points were dropped in the meantime
+type queuedPoint struct {
+	seq   uint64
+	point Point
+}
+
+// A point as it is kept in the queue file. JSON only has the one kind of number, so the type of
+// each field is kept with it. Otherwise integers come back as floats after a restart, which
+// InfluxDB refuses as a different type to the field
+type queueRecord struct {
+	Point
+	FieldTypes map[string]string `json:"field_types,omitempty"`
+	Error      string            `json:"error,omitempty"` // Why the backend refused it, only in the rejected file
+}
+
+// The types a field can be kept as
+const (
+	fieldInt    = "int"
+	fieldUint   = "uint"
+	fieldFloat  = "float"
+	fieldBool   = "bool"
+	fieldString = "string"
+)
+
+// Puts every write into a durable on-disk queue and drains it into another sink in the
+// background, so writes never block on, or fail because of, an unreachable database
+type QueuedSink struct {
+	typedSink
+	inner        MetricsSink
+	logger       *slog.Logger
+	path         string
+	rejectedPath string // Where points the backend refuses are set aside
+	maxPoints    int
+
+	mu          sync.Mutex
+	file        *os.File
+	pending     []queuedPoint
+	nextSeq     uint64
+	staleLines  int    // Lines at the start of the file that have already been written or dropped
+	dropped     uint64 // Points thrown away because the queue was full
+	rejected    uint64 // Points the backend refused
+	lastErr     error
+	lastSuccess time.Time
+	successor   *QueuedSink // The queue that took this one over, writes are passed on to it
+
+	notify   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Wrap a sink in a durable queue stored at path. Anything left in the queue from a previous run
+// is loaded and drained first. If a queue is already open at the path its points are taken over
+// and drained into the new sink instead, see takeOver
+func QueuedSinkInit(inner MetricsSink, path string, maxPoints int, logger *slog.Logger) (*QueuedSink, error) {
+	if maxPoints <= 0 {
+		maxPoints = defaultQueueMaxPoints
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(path)
+	q := &QueuedSink{
+		inner:        inner,
+		logger:       logger,
+		path:         path,
+		rejectedPath: strings.TrimSuffix(path, ext) + ".rejected" + ext,
+		maxPoints:    maxPoints,
+		notify:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	q.typedSink = typedSink{writePoint: q.WritePoint}
+
+	openQueuesMu.Lock()
+	defer openQueuesMu.Unlock()
+	if old, ok := openQueues[queueKey(path)]; ok {
+		q.takeOver(old)
+	} else {
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+		if len(q.pending) > 0 {
+			logger.Info(fmt.Sprintf("loaded %d queued points from %s", len(q.pending), path))
+		}
+	}
+	openQueues[queueKey(path)] = q
+
+	q.wg.Add(1)
+	go q.drain()
+	return q, nil
+}
+
+// How a queue path is known in the open queues, so the same file is found however it is written
+func queueKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// Take the file and points over from a running queue at the same path, so storage can be set up
+// with new settings before the old ones are closed. The old queue stops draining, anything
+// written to it afterwards is passed on to this one. Can't fail, so must only be done once
+// nothing else setting up storage can
+func (q *QueuedSink) takeOver(old *QueuedSink) {
+	old.stop()
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	q.file, q.pending, q.nextSeq, q.staleLines = old.file, old.pending, old.nextSeq, old.staleLines
+	q.dropped, q.rejected, q.lastErr, q.lastSuccess = old.dropped, old.rejected, old.lastErr, old.lastSuccess
+	old.file, old.pending = nil, nil
+	old.successor = q
+
+	// The new settings may hold fewer points
+	if over := len(q.pending) - q.maxPoints; over > 0 {
+		q.pending = q.pending[over:]
+		q.staleLines += over
+		q.dropped += uint64(over)
+		q.compact()
+	}
+	q.logger.Info(fmt.Sprintf("took over %d queued points at %s", len(q.pending), q.path))
+}
+
+// Load any points left over from a previous run, then rewrite the file so it only holds them
+func (q *QueuedSink) load() error {
+	f, err := os.Open(q.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			p, err := decodeQueued(scanner.Bytes())
+			if err != nil {
+				// A partly written line from a crash, skip it
+				continue
+			}
+			q.pending = append(q.pending, queuedPoint{seq: q.nextSeq, point: p})
+			q.nextSeq++
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if over := len(q.pending) - q.maxPoints; over > 0 {
+			q.pending = q.pending[over:]
+			q.dropped += uint64(over)
+		}
+	}
+	return q.rewrite()
+}
+
+// Rewrite the queue file with only the pending points. Must be called with the lock held
+func (q *QueuedSink) rewrite() error {
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, qp := range q.pending {
+		bytes, err := encodeQueued(qp.point, "")
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(bytes)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(q.path)); err != nil {
+		return err
+	}
+	// The old file is kept open until now, so the queue can still be appended to if this fails
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0644)
+	q.staleLines = 0
+	return err
+}
+
+// Add a point to the queue. The oldest point is dropped if the queue is full
+func (q *QueuedSink) WritePoint(p Point) error {
+	bytes, err := encodeQueued(p, "")
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	if next := q.successor; next != nil {
+		q.mu.Unlock()
+		return next.WritePoint(p)
+	}
+	defer q.mu.Unlock()
+	if len(q.pending) >= q.maxPoints {
+		q.pending = q.pending[1:]
+		q.staleLines++
+		q.dropped++
+		if q.dropped == 1 || q.dropped%1000 == 0 {
+			q.logger.Warn(fmt.Sprintf("write queue is full, %d points dropped so far", q.dropped))
+		}
+		// The dropped points are still in the file, which would otherwise grow for as long as the
+		// backend is unreachable
+		q.compact()
+	}
+	// Synced so a point that was accepted survives a power cut
+	if _, err := q.file.Write(bytes); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, queuedPoint{seq: q.nextSeq, point: p})
+	q.nextSeq++
+
+	// Wake the drain loop up if it is waiting
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Drain the queue into the inner sink in order, backing off while it is failing
+func (q *QueuedSink) drain() {
+	defer q.wg.Done()
+	backoff := queueMinBackoff
+	for {
+		qp, ok := q.peek()
+		if !ok {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		err := q.inner.WritePoint(qp.point)
+		if errors.Is(err, ErrRejected) {
+			q.reject(qp, err)
+			continue
+		}
+		if err != nil {
+			q.recordFailure(err)
+			select {
+			case <-time.After(backoff):
+			case <-q.done:
+				return
+			}
+			backoff = min(backoff*2, queueMaxBackoff)
+			continue
+		}
+		backoff = queueMinBackoff
+		q.pop(qp.seq)
+	}
+}
+
+// Get the oldest point in the queue
+func (q *QueuedSink) peek() (queuedPoint, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return queuedPoint{}, false
+	}
+	return q.pending[0], true
+}
+
+// Remove a point that has been written, compacting the file once enough of it is stale
+func (q *QueuedSink) pop(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.lastErr != nil {
+		q.logger.Info(fmt.Sprintf("storage backend reachable again, draining %d queued points", len(q.pending)))
+		q.lastErr = nil
+	}
+	q.lastSuccess = time.Now()
+	if len(q.pending) == 0 || q.pending[0].seq != seq {
+		// Dropped while we were writing it
+		return
+	}
+	q.pending = q.pending[1:]
+	q.staleLines++
+	q.compact()
+}
+
+// Rewrite the queue file once it is empty or enough of it is stale, so it never holds much more
+// than the queue does. Must be called with the lock held
+func (q *QueuedSink) compact() {
+	if len(q.pending) > 0 && q.staleLines < max(q.maxPoints/2, 1) {
+		return
+	}
+	if err := q.rewrite(); err != nil {
+		q.logger.Error(fmt.Sprintf("could not compact write queue: %s", err.Error()))
+	}
+}
+
+// Set aside a point the backend refused, so the points behind it can be written
+func (q *QueuedSink) reject(qp queuedPoint, err error) {
+	q.mu.Lock()
+	q.rejected++
+	q.logger.Warn(fmt.Sprintf("storage backend refused a queued point, it has been moved to %s: %s", q.rejectedPath, err.Error()))
+	if err := appendRejected(q.rejectedPath, qp.point, err); err != nil {
+		q.logger.Error(fmt.Sprintf("could not keep the refused point, it is lost: %s", err.Error()))
+	}
+	q.mu.Unlock()
+	metrics.Default.Inc("as2_db_queue_rejected_total", nil)
+	// The backend answered, so it is reachable
+	q.pop(qp.seq)
+}
+
+// Record a failed write, only logging when the backend first becomes unreachable
+func (q *QueuedSink) recordFailure(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.lastErr == nil {
+		q.logger.Warn(fmt.Sprintf("storage backend unreachable, queueing writes: %s", err.Error()))
+	}
+	q.lastErr = err
+}
+
+// The number of points waiting to be written
+func (q *QueuedSink) QueueDepth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// The number of points dropped because the queue was full
+func (q *QueuedSink) QueueDropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// The number of points the backend refused, which were set aside in the rejected file
+func (q *QueuedSink) QueueRejected() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.rejected
+}
+
+// The last error from the inner sink, nil if the last write succeeded
+func (q *QueuedSink) LastError() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lastErr
+}
+
+// When a point was last written to the inner sink
+func (q *QueuedSink) LastSuccess() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lastSuccess
+}
+
+// Stop draining and close the queue and the inner sink. Anything still queued stays on disk
+// for the next run. A queue that was taken over only closes its inner sink, the file belongs
+// to the queue that took it
+func (q *QueuedSink) Close() error {
+	openQueuesMu.Lock()
+	if openQueues[queueKey(q.path)] == q {
+		delete(openQueues, queueKey(q.path))
+	}
+	openQueuesMu.Unlock()
+
+	q.stop()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var err error
+	if q.successor == nil {
+		err = q.file.Close()
+	}
+	return errors.Join(err, q.inner.Close())
+}
+
+// Stop the drain loop, waiting for a write in progress to finish
+func (q *QueuedSink) stop() {
+	q.stopOnce.Do(func() { close(q.done) })
+	q.wg.Wait()
+}
+
+// Encode a point as a line of the queue file, with the type of each of its fields
+func encodeQueued(p Point, rejection string) ([]byte, error) {
+	record := queueRecord{Point: p, FieldTypes: make(map[string]string, len(p.Fields)), Error: rejection}
+	for k, v := range p.Fields {
+		if t := fieldType(v); t != "" {
+			record.FieldTypes[k] = t
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Decode a line of the queue file, giving each field back the type it was queued with. Numbers
+// in lines from before the types were kept are floats, as they always were
+func decodeQueued(line []byte) (Point, error) {
+	var record queueRecord
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&record); err != nil {
+		return Point{}, err
+	}
+	for k, v := range record.Fields {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		var err error
+		switch record.FieldTypes[k] {
+		case fieldInt:
+			record.Fields[k], err = n.Int64()
+		case fieldUint:
+			record.Fields[k], err = strconv.ParseUint(n.String(), 10, 64)
+		default:
+			record.Fields[k], err = n.Float64()
+		}
+		if err != nil {
+			return Point{}, fmt.Errorf("field %s: %w", k, err)
+		}
+	}
+	return record.Point, nil
+}
+
+// The type a field value is kept as, empty for anything that isn't a plain value
+func fieldType(v interface{}) string {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fieldInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fieldUint
+	case reflect.Float32, reflect.Float64:
+		return fieldFloat
+	case reflect.Bool:
+		return fieldBool
+	case reflect.String:
+		return fieldString
+	}
+	return ""
+}
+
+// Add a refused point to the rejected file, with why it was refused
+func appendRejected(path string, p Point, rejection error) error {
+	line, err := encodeQueued(p, rejection.Error())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Sync a directory, so a file renamed into it survives a power cut
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
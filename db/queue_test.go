@@ -0,0 +1,257 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func testPoint(i int) Point {
+	return Point{
+		Measurement: "test",
+		Tags:        map[string]string{"unit": "1"},
+		Fields:      map[string]interface{}{"i": int64(i)},
+		Time:        time.Unix(int64(i), 0).UTC(),
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// Wait for the queue to drain into a memory sink
+func waitForPoints(t *testing.T, q *QueuedSink, m *MemorySink, n int) []Point {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.QueueDepth() > 0 || len(m.Points()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue did not drain, %d points left and %d written", q.QueueDepth(), len(m.Points()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return m.Points()
+}
+
+// A full queue drops its oldest points, from the file as well as memory
+func TestQueueBounded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	const maxPoints = 10
+	q, err := QueuedSinkInit(failingSink{NewMemorySink(), errors.New("unreachable")}, path, maxPoints, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := q.WritePoint(testPoint(i)); err != nil {
+			t.Fatal(err)
+		}
+		if lines := countLines(t, path); lines > maxPoints+maxPoints/2 {
+			t.Fatalf("queue file has %d lines after %d writes, the queue holds %d points", lines, i+1, maxPoints)
+		}
+	}
+	if depth := q.QueueDepth(); depth != maxPoints {
+		t.Errorf("depth = %d, want %d", depth, maxPoints)
+	}
+	if dropped := q.QueueDropped(); dropped != 1000-maxPoints {
+		t.Errorf("dropped = %d, want %d", dropped, 1000-maxPoints)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the newest points are left to drain on the next run
+	m := NewMemorySink()
+	q, err = QueuedSinkInit(m, path, maxPoints, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	points := waitForPoints(t, q, m, maxPoints)
+	if len(points) != maxPoints {
+		t.Fatalf("%d points drained, want %d", len(points), maxPoints)
+	}
+	for i, p := range points {
+		if want := testPoint(1000 - maxPoints + i); !p.Time.Equal(want.Time) {
+			t.Errorf("point %d is from %s, want %s", i, p.Time, want.Time)
+		}
+	}
+}
+
+// Fields come back from the queue file as the types they were queued as, so a restart can't
+// change what is written to the backend
+func TestQueueFieldTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	start := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	points := []Point{
+		statusPoint(Tags{SystemName: "test", RemoteUnitName: "unit_1"}, 2),
+		wateringEventPoint("test", WateringEvent{UnitName: "unit_1", UnitNumber: 1, Start: start, End: start.Add(time.Minute), CommandedDuration: time.Minute, ActualDuration: time.Minute, VolumeLitres: 2, Trigger: TriggerManual, RequestedBy: "test", EndReason: EndTimer}),
+		eventPoint("test", Tags{SystemName: "test"}, nil),
+		{Measurement: "test", Tags: map[string]string{}, Fields: map[string]interface{}{"whole_float": 20.0, "on": true, "name": "x", "small": uint8(3), "big": uint64(1 << 63)}, Time: start},
+	}
+	want := map[string]map[string]interface{}{
+		"remote_unit_status": {"status": uint64(2)},
+		"watering_events":    {"unit_number": int64(1), "end": start.Add(time.Minute).UnixNano(), "commanded_seconds": 60.0, "actual_seconds": 60.0, "volume_litres": 2.0, "requested_by": "test"},
+		"events":             {"count": int64(1)},
+		"test":               {"whole_float": 20.0, "on": true, "name": "x", "small": uint64(3), "big": uint64(1 << 63)},
+	}
+
+	q, err := QueuedSinkInit(failingSink{NewMemorySink(), errors.New("unreachable")}, path, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		if err := q.WritePoint(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMemorySink()
+	q, err = QueuedSinkInit(m, path, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	drained := waitForPoints(t, q, m, len(points))
+	for i, p := range drained {
+		if !reflect.DeepEqual(p.Fields, want[p.Measurement]) {
+			t.Errorf("%s fields are %#v, want %#v", p.Measurement, p.Fields, want[p.Measurement])
+		}
+		if p.LineProtocol() != points[i].LineProtocol() {
+			t.Errorf("%s is written as %q, was queued as %q", p.Measurement, p.LineProtocol(), points[i].LineProtocol())
+		}
+	}
+}
+
+// Queue files from before field types were kept still load, with their numbers as floats
+func TestQueueUntypedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	line := `{"measurement":"test","tags":{"unit":"1"},"fields":{"value":1.5,"status":2},"time":"2026-10-18T06:00:00Z"}` + "\n"
+	if err := os.WriteFile(path, []byte(line+"{\"partial\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemorySink()
+	q, err := QueuedSinkInit(m, path, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	drained := waitForPoints(t, q, m, 1)
+	if want := map[string]interface{}{"value": 1.5, "status": 2.0}; len(drained) != 1 || !reflect.DeepEqual(drained[0].Fields, want) {
+		t.Errorf("drained %#v, want one point with %#v", drained, want)
+	}
+}
+
+// A backend that refuses any point with a bad field
+type refusingSink struct {
+	*MemorySink
+}
+
+func (r refusingSink) WritePoint(p Point) error {
+	if _, ok := p.Fields["bad"]; ok {
+		return fmt.Errorf("%w: field type conflict", ErrRejected)
+	}
+	return r.MemorySink.WritePoint(p)
+}
+
+// A point the backend refuses is set aside, rather than holding up the points behind it
+func TestQueueRejected(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queue.jsonl")
+	m := NewMemorySink()
+	q, err := QueuedSinkInit(refusingSink{m}, path, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	bad := Point{Measurement: "test", Tags: map[string]string{}, Fields: map[string]interface{}{"bad": int64(1)}, Time: time.Unix(0, 0).UTC()}
+	for _, p := range []Point{bad, testPoint(1), testPoint(2)} {
+		if err := q.WritePoint(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if drained := waitForPoints(t, q, m, 2); len(drained) != 2 {
+		t.Fatalf("%d points written, want 2", len(drained))
+	}
+	if rejected := q.QueueRejected(); rejected != 1 {
+		t.Errorf("rejected = %d, want 1", rejected)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "queue.rejected.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := decodeQueued(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Fields, bad.Fields) {
+		t.Errorf("rejected point has fields %#v, want %#v", p.Fields, bad.Fields)
+	}
+	if !bytes.Contains(data, []byte("field type conflict")) {
+		t.Errorf("rejected file doesn't say why: %s", data)
+	}
+}
+
+// A queue opened where one is running takes its points over, so storage can be set up with new
+// settings before the old ones are closed
+func TestQueueTakeOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	old, err := QueuedSinkInit(failingSink{NewMemorySink(), errors.New("unreachable")}, path, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := old.WritePoint(testPoint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMemorySink()
+	q, err := QueuedSinkInit(m, path, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// Writes that were already on their way to the old queue aren't lost
+	if err := old.WritePoint(testPoint(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	points := waitForPoints(t, q, m, 4)
+	if len(points) != 4 {
+		t.Fatalf("%d points drained, want 4", len(points))
+	}
+	for i, p := range points {
+		if want := testPoint(i); !p.Time.Equal(want.Time) {
+			t.Errorf("point %d is from %s, want %s", i, p.Time, want.Time)
+		}
+	}
+
+	// The queue file still works after the old queue is closed
+	if err := q.WritePoint(testPoint(4)); err != nil {
+		t.Fatal(err)
+	}
+	if points := waitForPoints(t, q, m, 5); len(points) != 5 {
+		t.Errorf("%d points drained, want 5", len(points))
+	}
+}
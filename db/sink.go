@@ -0,0 +1,341 @@
+package db
+
+import (
+	"as2controlv2/config"
+	"as2controlv2/metrics"
+	"as2controlv2/weather"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Anything that metrics can be written to, InfluxDB being the main one
+type MetricsSink interface {
+	WritePoint(p Point) error
+	WriteUnitMetrics(measurementName string, localValues CurrentLocalValues, tags Tags) error
+	WriteSensorMetric(measurementName string, value float64, tags Tags) error
+	WriteWeatherMetrics(wr weather.CurrentWeatherResult) error
+	WriteStatusMetric(tags Tags, status uint) error
+	WriteEvent(eventName string, tags Tags, fields map[string]interface{}) error
+	WriteWateringEvent(systemName string, e WateringEvent) error
+	WriteGrowingDegreeDays(tags Tags, baseTempC float64, day time.Time, daily, accumulated float64) error
+	WriteSoilMoistureSensor(tags Tags, sensor string, raw, calibrated float64) error
+	Close() error
+}
+
+func init() {
+	metrics.Default.Describe("as2_db_write_errors_total", metrics.TypeCounter, "Failed writes to a storage backend")
+}
+
+// A single backend independent data point
+type Point struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// The storage backends that can be configured
+const (
+	BackendInfluxDB = "influxdb"
+	BackendFile     = "file"
+)
+
+// The files the file store and write queue use when a path is not configured, inside the state directory
+const (
+	defaultFileStoreName = "metrics.jsonl"
+	defaultQueueName     = "influxdb_queue.jsonl"
+)
+
+// Set up the storage backends in the config. If more than one is configured every write goes to
+// all of them. InfluxDB writes go through a durable queue so they survive it being unreachable.
+// A queue that is already open at the same path is taken over, so new settings can be set up
+// while the old ones are still in use
+func SinkInit(conf config.Config, logger *slog.Logger) (MetricsSink, error) {
+	backends := conf.Storage.Backends
+	if len(backends) == 0 {
+		backends = []string{BackendInfluxDB}
+	}
+
+	sinks := make([]MetricsSink, len(backends))
+	fail := func(err error) (MetricsSink, error) {
+		for _, s := range sinks {
+			if s != nil {
+				s.Close()
+			}
+		}
+		return nil, err
+	}
+	conns := make(map[int]*DBConnection)
+	for i, backend := range backends {
+		switch backend {
+		case BackendInfluxDB:
+			conn, err := DBInit(conf.DatabaseConfig)
+			if err != nil {
+				return fail(err)
+			}
+			if err := conn.Ping(); err != nil {
+				logger.Warn(fmt.Sprintf("InfluxDB is not reachable, writes will be queued until it is: %s", err.Error()))
+			}
+			conns[i] = conn
+		case BackendFile:
+			path := conf.Storage.FilePath
+			if path == "" {
+				path = filepath.Join(conf.StateDir(), defaultFileStoreName)
+			}
+			store, err := FileStoreInit(path)
+			if err != nil {
+				return fail(err)
+			}
+			sinks[i] = store
+		default:
+			return fail(fmt.Errorf("unknown storage backend %q", backend))
+		}
+	}
+	// The queues are opened last, once nothing else can fail, as taking one over stops the old one
+	for i, conn := range conns {
+		path := conf.Storage.QueuePath
+		if path == "" {
+			path = filepath.Join(conf.StateDir(), defaultQueueName)
+		}
+		queue, err := QueuedSinkInit(conn, path, int(conf.Storage.QueueMaxPoints), logger)
+		if err != nil {
+			// The connections that are already in a queue are closed with it
+			for j, c := range conns {
+				if sinks[j] == nil {
+					c.Close()
+				}
+			}
+			return fail(err)
+		}
+		sinks[i] = queue
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return NewMultiSink(sinks...), nil
+}
+
+// Open the first configured storage backend for range queries, without starting any
+// write queue. This is for reading history outside of the running system
+func ReaderInit(conf config.Config) (PointReader, error) {
+	backends := conf.Storage.Backends
+	if len(backends) == 0 {
+		backends = []string{BackendInfluxDB}
+	}
+	switch backends[0] {
+	case BackendInfluxDB:
+		return DBInit(conf.DatabaseConfig)
+	case BackendFile:
+		path := conf.Storage.FilePath
+		if path == "" {
+			path = filepath.Join(conf.StateDir(), defaultFileStoreName)
+		}
+		return FileStoreInit(path)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backends[0])
+}
+
+// Implements the typed MetricsSink methods on top of a single point writer, so that each backend
+// only has to know how to store a Point
+type typedSink struct {
+	writePoint func(Point) error
+}
+
+// Write a single sensor metric
+func (t typedSink) WriteSensorMetric(measurementName string, value float64, tags Tags) error {
+	return t.writePoint(sensorMetricPoint(measurementName, value, tags))
+}
+
+// Write the status of a remote unit
+func (t typedSink) WriteStatusMetric(tags Tags, status uint) error {
+	return t.writePoint(statusPoint(tags, status))
+}
+
+// Write the metrics for a single unit
+func (t typedSink) WriteUnitMetrics(measurementName string, localValues CurrentLocalValues, tags Tags) error {
+	return t.writePoint(unitMetricsPoint(measurementName, localValues, tags))
+}
+
+// Write a weather observation
+func (t typedSink) WriteWeatherMetrics(wr weather.CurrentWeatherResult) error {
+	return t.writePoint(weatherPoint(wr))
+}
+
+// Write the growing degree days of a unit for a single day
+func (t typedSink) WriteGrowingDegreeDays(tags Tags, baseTempC float64, day time.Time, daily, accumulated float64) error {
+	return t.writePoint(Point{
+		Measurement: "growing_degree_days",
+		Tags: map[string]string{
+			"system_name":      tags.SystemName,
+			"remote_unit_name": tags.RemoteUnitName,
+			"base_temp_c":      strconv.FormatFloat(baseTempC, 'f', -1, 64),
+		},
+		Fields: map[string]interface{}{
+			"daily":       daily,
+			"accumulated": accumulated,
+		},
+		Time: day,
+	})
+}
+
+// Write the raw and calibrated reading of a single soil moisture sensor
+func (t typedSink) WriteSoilMoistureSensor(tags Tags, sensor string, raw, calibrated float64) error {
+	pointTags := unitTags(tags)
+	pointTags["sensor"] = sensor
+	return t.writePoint(Point{
+		Measurement: "soil_moisture_sensor",
+		Tags:        pointTags,
+		Fields: map[string]interface{}{
+			"raw":        raw,
+			"calibrated": calibrated,
+		},
+		Time: time.Now(),
+	})
+}
+
+// Write an event, such as a watering starting
+func (t typedSink) WriteEvent(eventName string, tags Tags, fields map[string]interface{}) error {
+	return t.writePoint(eventPoint(eventName, tags, fields))
+}
+
+// Make the tags that every unit metric is written with
+func unitTags(tags Tags) map[string]string {
+	return map[string]string{
+		"system_name":      tags.SystemName,
+		"remote_unit_name": tags.RemoteUnitName,
+	}
+}
+
+// Make a point for a single sensor metric
+func sensorMetricPoint(measurementName string, value float64, tags Tags) Point {
+	return Point{
+		Measurement: measurementName,
+		Tags:        unitTags(tags),
+		Fields: map[string]interface{}{
+			"value": value,
+		},
+		Time: time.Now(),
+	}
+}
+
+// Make a point for the status of a remote unit
+func statusPoint(tags Tags, status uint) Point {
+	return Point{
+		Measurement: "remote_unit_status",
+		Tags:        unitTags(tags),
+		Fields: map[string]interface{}{
+			"status": status,
+		},
+		Time: time.Now(),
+	}
+}
+
+// Make a point for the averaged metrics of a unit
+func unitMetricsPoint(measurementName string, localValues CurrentLocalValues, tags Tags) Point {
+	fields := map[string]interface{}{
+		"temperature":       localValues.Temperature,
+		"humidity":          localValues.Humidity,
+		"soil_moisture":     localValues.SoilMoisture,
+		"soil_moisture_raw": localValues.SoilMoistureRaw,
+		"flow_rate":         localValues.FlowRate,
+		"water_on":          localValues.WaterOn,
+		"vpd_kpa":           localValues.VapourPressureDeficit,
+	}
+	if localValues.DewPoint != nil {
+		fields["dew_point"] = *localValues.DewPoint
+	}
+	return Point{
+		Measurement: measurementName,
+		Tags:        unitTags(tags),
+		Fields:      fields,
+		Time:        time.Now(),
+	}
+}
+
+// Make a point for a weather observation, timestamped with the observation time
+func weatherPoint(wr weather.CurrentWeatherResult) Point {
+	return Point{
+		Measurement: "weather",
+		Tags:        weatherTags(wr),
+		Fields:      weatherFields(wr),
+		Time:        time.Unix(int64(wr.DT), 0),
+	}
+}
+
+// Make a point for an event, all events go in the one measurement tagged by name
+func eventPoint(eventName string, tags Tags, fields map[string]interface{}) Point {
+	t := unitTags(tags)
+	t["event"] = eventName
+	if len(fields) == 0 {
+		// A point needs at least one field
+		fields = map[string]interface{}{"count": 1}
+	}
+	return Point{
+		Measurement: "events",
+		Tags:        t,
+		Fields:      fields,
+		Time:        time.Now(),
+	}
+}
+
+// Writes to several sinks at once
+type MultiSink struct {
+	typedSink
+	sinks []MetricsSink
+}
+
+// Make a sink that writes to every one of the given sinks
+func NewMultiSink(sinks ...MetricsSink) *MultiSink {
+	m := &MultiSink{sinks: sinks}
+	m.typedSink = typedSink{writePoint: m.WritePoint}
+	return m
+}
+
+// Write a point to every sink. Every sink is attempted even if an earlier one fails
+func (m *MultiSink) WritePoint(p Point) error {
+	errs := make([]error, 0)
+	for _, s := range m.sinks {
+		if err := s.WritePoint(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The total backlog of every buffered sink
+func (m *MultiSink) QueueDepth() int {
+	depth := 0
+	for _, s := range m.sinks {
+		if b, ok := s.(Buffered); ok {
+			depth += b.QueueDepth()
+		}
+	}
+	return depth
+}
+
+// The total number of points dropped by every buffered sink
+func (m *MultiSink) QueueDropped() uint64 {
+	var dropped uint64
+	for _, s := range m.sinks {
+		if b, ok := s.(Buffered); ok {
+			dropped += b.QueueDropped()
+		}
+	}
+	return dropped
+}
+
+// Close every sink
+func (m *MultiSink) Close() error {
+	errs := make([]error, 0)
+	for _, s := range m.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
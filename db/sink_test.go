@@ -0,0 +1,99 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A backend that is unreachable, every write to it fails
+type failingSink struct {
+	*MemorySink
+	err error
+}
+
+func (f failingSink) WritePoint(Point) error {
+	return f.err
+}
+
+// Every sink gets every write, even when one of them fails
+func TestMultiSink(t *testing.T) {
+	a, b := NewMemorySink(), NewMemorySink()
+	failed := errors.New("unreachable")
+	m := NewMultiSink(a, failingSink{NewMemorySink(), failed}, b)
+	err := m.WriteStatusMetric(Tags{SystemName: "test", RemoteUnitName: "unit_1"}, 2)
+	if !errors.Is(err, failed) {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+	for i, s := range []*MemorySink{a, b} {
+		points := s.Points()
+		if len(points) != 1 {
+			t.Fatalf("sink %d has %d points, want 1", i, len(points))
+		}
+		p := points[0]
+		if p.Measurement != "remote_unit_status" || p.Tags["remote_unit_name"] != "unit_1" || p.Fields["status"] != uint(2) {
+			t.Errorf("sink %d has %v", i, p)
+		}
+	}
+}
+
+// The file store keeps what is written across restarts, and can be queried by range and tags
+func TestFileStoreQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	fs, err := FileStoreInit(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		unit := "unit_1"
+		if i%2 == 1 {
+			unit = "unit_2"
+		}
+		p := Point{Measurement: "soil", Tags: map[string]string{"remote_unit_name": unit}, Fields: map[string]interface{}{"i": int64(i)}, Time: start.Add(time.Duration(i) * time.Hour)}
+		if err := fs.WritePoint(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.WritePoint(Point{Measurement: "weather", Tags: map[string]string{}, Fields: map[string]interface{}{"temp": 20.0}, Time: start}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = FileStoreInit(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	tests := []struct {
+		name        string
+		measurement string
+		start, end  time.Time
+		tags        map[string]string
+		want        int
+	}{
+		{name: "everything", start: start, end: start.Add(24 * time.Hour), want: 5},
+		{name: "measurement", measurement: "soil", start: start, end: start.Add(24 * time.Hour), want: 4},
+		{name: "end is exclusive", measurement: "soil", start: start, end: start.Add(2 * time.Hour), want: 2},
+		{name: "start is inclusive", measurement: "soil", start: start.Add(3 * time.Hour), end: start.Add(24 * time.Hour), want: 1},
+		{name: "tags", measurement: "soil", start: start, end: start.Add(24 * time.Hour), tags: map[string]string{"remote_unit_name": "unit_2"}, want: 2},
+		{name: "before", start: start.Add(-time.Hour), end: start, want: 0},
+	}
+	for _, tt := range tests {
+		points, err := fs.Query(tt.measurement, tt.start, tt.end, tt.tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != tt.want {
+			t.Errorf("%s: %d points, want %d", tt.name, len(points), tt.want)
+		}
+		for i := 1; i < len(points); i++ {
+			if points[i].Time.Before(points[i-1].Time) {
+				t.Errorf("%s: points are not in time order", tt.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// What caused a watering to happen
+const (
+	TriggerThreshold    = "threshold"     // Soil moisture dropped below the threshold
+	TriggerDryingTrend  = "drying_trend"  // Soil moisture was projected to drop below the threshold
+	TriggerManual       = "manual"        // Requested through the API
+	TriggerPreWater     = "pre_water"     // Ahead of forecast weather such as a heatwave
+	TriggerFrostProtect = "frost_protect" // Ahead of a forecast frost
+)
+
+// How a watering ended
+const (
+	EndTimer         = "timer"          // The commanded duration ran out
+	EndTargetReached = "target_reached" // Soil moisture reached the target
+	EndCancelled     = "cancelled"      // Cancelled through the API
+	EndFault         = "fault"          // The unit could not be commanded
+)
+
+// The record of a single watering of a zone
+type WateringEvent struct {
+	UnitName          string        `json:"unit_name"`
+	UnitNumber        uint          `json:"unit_number"`
+	Start             time.Time     `json:"start"`
+	End               time.Time     `json:"end"`
+	CommandedDuration time.Duration `json:"commanded_duration_ns"`
+	ActualDuration    time.Duration `json:"actual_duration_ns"`
+	VolumeLitres      float64       `json:"volume_litres"`
+	Trigger           string        `json:"trigger"`
+	RequestedBy       string        `json:"requested_by"`
+	EndReason         string        `json:"end_reason"`
+}
+
+// Write the record of a finished watering
+func (t typedSink) WriteWateringEvent(systemName string, e WateringEvent) error {
+	return t.writePoint(wateringEventPoint(systemName, e))
+}
+
+// Make a point for a watering record, timestamped with when the watering started
+func wateringEventPoint(systemName string, e WateringEvent) Point {
+	return Point{
+		Measurement: "watering_events",
+		Tags: map[string]string{
+			"system_name":      systemName,
+			"remote_unit_name": e.UnitName,
+			"trigger":          e.Trigger,
+			"end_reason":       e.EndReason,
+		},
+		Fields: map[string]interface{}{
+			"unit_number":       int64(e.UnitNumber),
+			"end":               e.End.UnixNano(),
+			"commanded_seconds": e.CommandedDuration.Seconds(),
+			"actual_seconds":    e.ActualDuration.Seconds(),
+			"volume_litres":     e.VolumeLitres,
+			"requested_by":      e.RequestedBy,
+		},
+		Time: e.Start,
+	}
+}
+
+// Turn a stored point back into a watering record
+func wateringEventFromPoint(p Point) WateringEvent {
+	e := WateringEvent{
+		UnitName:  p.Tags["remote_unit_name"],
+		Start:     p.Time,
+		Trigger:   p.Tags["trigger"],
+		EndReason: p.Tags["end_reason"],
+	}
+	if v, ok := toFloat(p.Fields["unit_number"]); ok {
+		e.UnitNumber = uint(v)
+	}
+	if v, ok := toFloat(p.Fields["end"]); ok {
+		e.End = time.Unix(0, int64(v))
+	}
+	if v, ok := toFloat(p.Fields["commanded_seconds"]); ok {
+		e.CommandedDuration = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := toFloat(p.Fields["actual_seconds"]); ok {
+		e.ActualDuration = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := toFloat(p.Fields["volume_litres"]); ok {
+		e.VolumeLitres = v
+	}
+	if v, ok := p.Fields["requested_by"].(string); ok {
+		e.RequestedBy = v
+	}
+	return e
+}
+
+// Get the waterings that started within the last period, for every unit if unitName is empty
+func (db *DBConnection) WateringHistory(unitName string, since time.Duration) ([]WateringEvent, error) {
+	filter := ""
+	if unitName != "" {
+		filter = fmt.Sprintf(` and r.remote_unit_name == %s`, strconv.Quote(unitName))
+	}
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: -%ds)
+  |> filter(fn: (r) => r._measurement == "watering_events"%s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"])`, strconv.Quote(db.bucket), int(since.Seconds()), filter)
+
+	points, err := db.queryPivoted(flux)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]WateringEvent, len(points))
+	for i, p := range points {
+		events[i] = wateringEventFromPoint(p)
+	}
+	return events, nil
+}
+
+// Get the waterings that started within the last period, for every unit if unitName is empty
+func (fs *FileStore) WateringHistory(unitName string, since time.Duration) ([]WateringEvent, error) {
+	tags := map[string]string{}
+	if unitName != "" {
+		tags["remote_unit_name"] = unitName
+	}
+	points, err := fs.Query("watering_events", time.Now().Add(-since), time.Now(), tags)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]WateringEvent, len(points))
+	for i, p := range points {
+		events[i] = wateringEventFromPoint(p)
+	}
+	return events, nil
+}
+
+// History queries go straight to the sink behind the queue, anything still queued won't show up
+func (q *QueuedSink) WateringHistory(unitName string, since time.Duration) ([]WateringEvent, error) {
+	if h, ok := q.inner.(HistoryReader); ok {
+		return h.WateringHistory(unitName, since)
+	}
+	return nil, ErrNoHistory
+}
+
+// Answered by the first sink that can answer history queries
+func (m *MultiSink) WateringHistory(unitName string, since time.Duration) ([]WateringEvent, error) {
+	if h, ok := m.historyReader(); ok {
+		return h.WateringHistory(unitName, since)
+	}
+	return nil, ErrNoHistory
+}
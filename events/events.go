@@ -0,0 +1,144 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// This package carries events from the control system to anything streaming them, keeping the
+// most recent ones so that a client that reconnects can pick up where it left off
+
+// The types of event
+const (
+	TypeReading             = "reading"
+	TypeWarningRaised       = "warning_raised"
+	TypeWarningCleared      = "warning_cleared"
+	TypeWarningAcknowledged = "warning_acknowledged"
+	TypeWateringScheduled   = "watering_scheduled"
+	TypeWateringStarted     = "watering_started"
+	TypeWateringStopped     = "watering_stopped"
+	TypeUnitOnline          = "unit_online"
+	TypeUnitOffline         = "unit_offline"
+	TypeConfigChanged       = "config_changed"
+)
+
+// How many events are kept for clients resuming from an earlier event
+const defaultHistorySize = 1000
+
+// How many events can be waiting for a slow subscriber before it is dropped
+const subscriberBuffer = 64
+
+// A single event
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Unit string      `json:"unit,omitempty"` // The zone the event is for, empty for system wide events
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Which events a subscriber wants, empty fields match everything
+type Filter struct {
+	Units []string
+	Types []string
+}
+
+// Whether an event passes the filter. System wide events are sent whatever units are asked for
+func (f Filter) Matches(e Event) bool {
+	return matchesAny(f.Types, e.Type) && (e.Unit == "" || matchesAny(f.Units, e.Unit))
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Hands events out to every subscriber
+type Bus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	history     []Event // Oldest first
+	historySize int
+	subscribers map[*Subscription]struct{}
+}
+
+// A subscriber's view of the bus
+type Subscription struct {
+	C      <-chan Event // Closed if the subscriber falls too far behind, or is cancelled
+	c      chan Event
+	filter Filter
+	bus    *Bus
+}
+
+// Make an empty bus
+func NewBus() *Bus {
+	return &Bus{
+		nextID:      1,
+		historySize: defaultHistorySize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish an event to every subscriber whose filter it matches. Subscribers that are not keeping
+// up are dropped rather than holding up the control loop
+func (b *Bus) Publish(eventType, unit string, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := Event{ID: b.nextID, Type: eventType, Unit: unit, Time: time.Now(), Data: data}
+	b.nextID++
+	b.history = append(b.history, e)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for s := range b.subscribers {
+		if !s.filter.Matches(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			delete(b.subscribers, s)
+			close(s.c)
+		}
+	}
+}
+
+// Subscribe to events matching the filter. The events after lastID that are still kept are
+// returned to be sent first, lastID of zero means only new events
+func (b *Bus) Subscribe(filter Filter, lastID uint64) (*Subscription, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	backlog := make([]Event, 0)
+	if lastID > 0 {
+		for _, e := range b.history {
+			if e.ID > lastID && filter.Matches(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.subscribers[s] = struct{}{}
+	return s, backlog
+}
+
+// Stop receiving events
+func (s *Subscription) Cancel() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,282 @@
+package export
+
+import (
+	"as2controlv2/db"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// This package pulls history out of storage and writes it in formats for spreadsheets or for
+// loading into another InfluxDB
+
+// The output formats that can be exported
+const (
+	FormatCSV          = "csv"
+	FormatJSONLines    = "jsonl"
+	FormatLineProtocol = "lp"
+)
+
+// The sets of data that can be exported
+const (
+	DataSensors  = "sensors"
+	DataWeather  = "weather"
+	DataWatering = "watering"
+)
+
+// What to export
+type Options struct {
+	Start      time.Time
+	End        time.Time
+	Zones      []string      // Unit names to export, every zone if empty
+	Data       []string      // Which of sensors, weather and watering to export
+	Format     string        // One of csv, jsonl or lp
+	Downsample time.Duration // Average sensor and weather readings over this period, zero to keep every reading
+}
+
+// Pull the requested data out of storage
+func Collect(reader db.PointReader, opts Options) ([]db.Point, error) {
+	points := make([]db.Point, 0)
+	for _, data := range opts.Data {
+		var got []db.Point
+		var err error
+		switch data {
+		case DataSensors:
+			// Each unit has its own measurement
+			for _, zone := range opts.Zones {
+				zonePoints, err := reader.Query(zone, opts.Start, opts.End, nil)
+				if err != nil {
+					return nil, fmt.Errorf("could not query sensors for %s: %w", zone, err)
+				}
+				got = append(got, zonePoints...)
+			}
+		case DataWeather:
+			got, err = reader.Query("weather", opts.Start, opts.End, nil)
+		case DataWatering:
+			for _, zone := range opts.Zones {
+				zonePoints, err := reader.Query("watering_events", opts.Start, opts.End, map[string]string{"remote_unit_name": zone})
+				if err != nil {
+					return nil, fmt.Errorf("could not query waterings for %s: %w", zone, err)
+				}
+				got = append(got, zonePoints...)
+			}
+		default:
+			return nil, fmt.Errorf("unknown data %q, valid data are sensors, weather and watering", data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not query %s: %w", data, err)
+		}
+
+		// Averaging watering records together would be meaningless
+		if opts.Downsample > 0 && data != DataWatering {
+			got = Downsample(got, opts.Downsample)
+		}
+		points = append(points, got...)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// Average points into buckets of the given period, per measurement and tag set. Numeric fields
+// are averaged, anything else keeps its last value. Integer fields are rounded to the nearest
+// integer so they keep their type in line protocol. Each bucket is timestamped with its start
+func Downsample(points []db.Point, period time.Duration) []db.Point {
+	type bucket struct {
+		point  db.Point
+		sums   map[string]float64
+		counts map[string]int
+		kinds  map[string]numberKind
+	}
+	buckets := make(map[string]*bucket)
+	order := make([]string, 0)
+	for _, p := range points {
+		start := p.Time.Truncate(period)
+		key := seriesKey(p) + "@" + start.Format(time.RFC3339Nano)
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{
+				point: db.Point{
+					Measurement: p.Measurement,
+					Tags:        p.Tags,
+					Fields:      make(map[string]interface{}),
+					Time:        start,
+				},
+				sums:   make(map[string]float64),
+				counts: make(map[string]int),
+				kinds:  make(map[string]numberKind),
+			}
+			buckets[key] = b
+			order = append(order, key)
+		}
+		for k, v := range p.Fields {
+			if f, ok := number(v); ok {
+				kind := kindOf(v)
+				if seen, ok := b.kinds[k]; ok && seen != kind {
+					// A field that is sometimes a float is averaged as one
+					kind = kindFloat
+				}
+				b.kinds[k] = kind
+				b.sums[k] += f
+				b.counts[k]++
+				continue
+			}
+			b.point.Fields[k] = v
+		}
+	}
+
+	result := make([]db.Point, 0, len(order))
+	for _, key := range order {
+		b := buckets[key]
+		for k, sum := range b.sums {
+			mean := sum / float64(b.counts[k])
+			switch b.kinds[k] {
+			case kindInt:
+				b.point.Fields[k] = int64(math.Round(mean))
+			case kindUint:
+				b.point.Fields[k] = uint64(math.Round(mean))
+			default:
+				b.point.Fields[k] = mean
+			}
+		}
+		result = append(result, b.point)
+	}
+	return result
+}
+
+// Write points in the given format
+func Write(w io.Writer, points []db.Point, format string) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, points)
+	case FormatJSONLines:
+		enc := json.NewEncoder(w)
+		for _, p := range points {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatLineProtocol:
+		for _, p := range points {
+			if _, err := io.WriteString(w, p.LineProtocol()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New("unknown format, valid formats are csv, jsonl and lp")
+}
+
+// Write points as CSV, one column per tag and field across every point
+func writeCSV(w io.Writer, points []db.Point) error {
+	tagSet := make(map[string]bool)
+	fieldSet := make(map[string]bool)
+	for _, p := range points {
+		for k := range p.Tags {
+			tagSet[k] = true
+		}
+		for k := range p.Fields {
+			fieldSet[k] = true
+		}
+	}
+	tags := sortedKeys(tagSet)
+	fields := sortedKeys(fieldSet)
+
+	cw := csv.NewWriter(w)
+	header := append([]string{"time", "measurement"}, tags...)
+	if err := cw.Write(append(header, fields...)); err != nil {
+		return err
+	}
+	for _, p := range points {
+		row := []string{p.Time.Format(time.RFC3339), p.Measurement}
+		for _, k := range tags {
+			row = append(row, p.Tags[k])
+		}
+		for _, k := range fields {
+			row = append(row, formatValue(p.Fields[k]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// A key that identifies the series a point belongs to
+func seriesKey(p db.Point) string {
+	key := p.Measurement
+	for _, k := range sortedKeys(p.Tags) {
+		key += "," + k + "=" + p.Tags[k]
+	}
+	return key
+}
+
+// Get the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The kinds of number a field can hold, which line protocol writes differently
+type numberKind int
+
+const (
+	kindFloat numberKind = iota
+	kindInt
+	kindUint
+)
+
+// The kind of number a numeric field holds
+func kindOf(v interface{}) numberKind {
+	switch v.(type) {
+	case int64, int:
+		return kindInt
+	case uint64, uint:
+		return kindUint
+	}
+	return kindFloat
+}
+
+// Convert a field to a float if it is a number
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Format a field for a CSV cell
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	if f, ok := number(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
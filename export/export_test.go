@@ -0,0 +1,35 @@
+package export
+
+import (
+	"as2controlv2/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Averaged integers stay integers, so a downsampled line protocol export can be loaded into a
+// bucket that already has the raw points
+func TestDownsampleKeepsIntegers(t *testing.T) {
+	start := time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)
+	points := make([]db.Point, 0)
+	for i, moisture := range []int64{30, 31, 33} {
+		points = append(points, db.Point{
+			Measurement: "soil",
+			Tags:        map[string]string{"remote_unit_name": "unit_1"},
+			Fields:      map[string]interface{}{"moisture": moisture, "temperature": 20.5 + float64(i), "state": "ok"},
+			Time:        start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+
+	got := Downsample(points, time.Hour)
+	if len(got) != 1 {
+		t.Fatalf("%d points, want 1", len(got))
+	}
+	fields := got[0].Fields
+	if fields["moisture"] != int64(31) || fields["temperature"] != 21.5 || fields["state"] != "ok" {
+		t.Errorf("fields = %v, want moisture 31, temperature 21.5 and state ok", fields)
+	}
+	if lp := got[0].LineProtocol(); !strings.Contains(lp, "moisture=31i") {
+		t.Errorf("line protocol %q does not have moisture as an integer", lp)
+	}
+}
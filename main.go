@@ -1,34 +1,67 @@
 package main
 
 import (
+	"as2controlv2/auth"
+	"as2controlv2/calibration"
 	"as2controlv2/config"
 	"as2controlv2/control"
+	"as2controlv2/dashboard"
 	"as2controlv2/db"
+	"as2controlv2/export"
 	"as2controlv2/serial"
 	"as2controlv2/weather"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// How often the config file is checked for changes while running
+const configWatchInterval = 2 * time.Second
+
 func CheckArgs(args []string) error {
 	if len(args) == 1 {
-		fmt.Println("as2controlv2 run <config file> | example | help")
+		fmt.Println("as2controlv2 run <config file> | validate <config file> [flags] | migrate-config <config file> [flags] | geocode <config file> | export <config file> [flags] | calibrate <config file> [flags] | token <name> <role> | example [json|yaml|toml] | help")
 		return errors.New("no args given")
 	}
-	if args[1] != "run" && args[1] != "example" && args[1] != "help" {
-		return errors.New("invalid use of program, valid args are 'run', 'example', or 'help'")
+	if args[1] != "run" && args[1] != "validate" && args[1] != "migrate-config" && args[1] != "geocode" && args[1] != "export" && args[1] != "calibrate" && args[1] != "token" && args[1] != "example" && args[1] != "help" {
+		return errors.New("invalid use of program, valid args are 'run', 'validate', 'migrate-config', 'geocode', 'export', 'calibrate', 'token', 'example', or 'help'")
 	}
 
 	if args[1] == "run" && len(args) != 3 {
 		return errors.New("invalid use of 'run' command, please provide a config file")
-	} else if len(args) == 3 {
+	} else if args[1] == "validate" && len(args) < 3 {
+		return errors.New("invalid use of 'validate' command, please provide a config file")
+	} else if args[1] == "migrate-config" && len(args) < 3 {
+		return errors.New("invalid use of 'migrate-config' command, please provide a config file")
+	} else if args[1] == "geocode" && len(args) != 3 {
+		return errors.New("invalid use of 'geocode' command, please provide a config file")
+	} else if args[1] == "export" && len(args) < 3 {
+		return errors.New("invalid use of 'export' command, please provide a config file")
+	} else if args[1] == "calibrate" && len(args) < 3 {
+		return errors.New("invalid use of 'calibrate' command, please provide a config file")
+	} else if args[1] == "example" {
+		if len(args) > 3 || (len(args) == 3 && !slices.Contains(config.Formats, args[2])) {
+			return errors.New("invalid use of 'example' command, the format can be json, yaml or toml")
+		}
+	} else if args[1] == "token" {
+		if len(args) != 4 || !auth.ValidRole(args[3]) {
+			return errors.New("invalid use of 'token' command, please provide a name and a role of viewer, operator or admin")
+		}
+	} else if len(args) >= 3 {
 		// Check that the file exists
 		if _, err := os.Stat(args[2]); err != os.ErrExist {
 			return err
@@ -38,22 +71,91 @@ func CheckArgs(args []string) error {
 	return nil
 }
 
+// Load the config file in whichever format it is in, with the environment overrides and secrets
+// resolved
 func LoadConfig(fileName string) (config.Config, error) {
-	bytes, err := os.ReadFile(fileName)
+	conf, err := config.LoadConfigFile(fileName)
 	if err != nil {
 		return config.Config{}, err
 	}
-	conf, err := config.LoadConfig(bytes)
+	return config.Resolve(conf)
+}
+
+// Load the config file, checking it as it is loaded. Every problem is printed, and the config is
+// only returned if none of them are errors. Both the config as written and the resolved one that
+// is run are returned
+func LoadCheckedConfig(fileName string) (config.Config, config.Config, error) {
+	bytes, err := os.ReadFile(fileName)
 	if err != nil {
-		return config.Config{}, err
+		return config.Config{}, config.Config{}, err
+	}
+	written, problems := config.Check(bytes, config.FormatOf(fileName))
+	PrintProblems(fileName, problems)
+	if config.HasErrors(problems) {
+		return config.Config{}, config.Config{}, fmt.Errorf("%s has errors, see 'validate %s'", fileName, fileName)
+	}
+	conf, err := config.Resolve(written)
+	if err != nil {
+		return config.Config{}, config.Config{}, err
 	}
-	return conf, nil
+	return written, conf, nil
+}
 
+// Print each problem with a config, errors first
+func PrintProblems(fileName string, problems []config.Problem) {
+	for _, warning := range []bool{false, true} {
+		for _, p := range problems {
+			if p.Warning != warning {
+				continue
+			}
+			level := "error"
+			if p.Warning {
+				level = "warning"
+			}
+			fmt.Printf("%s: %-7s %s\n", fileName, level, p.String())
+		}
+	}
 }
 
-func HandleExampleConfigArg() {
+// Check a config file without running it, printing every problem found. The exit status is 1 if
+// any are errors
+func HandleValidateArg(fileName string, args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	offline := flags.Bool("offline", false, "don't check the serial port, InfluxDB and OpenWeatherMap can be reached")
+	timeout := flags.Duration("timeout", 3*time.Second, "how long to wait for each server when checking it can be reached")
+	flags.Parse(args)
+
+	bytes, err := os.ReadFile(fileName)
+	if err != nil {
+		fmt.Println("could not read config: ", err.Error())
+		os.Exit(1)
+	}
+	written, problems := config.Check(bytes, config.FormatOf(fileName))
+	if !*offline && !config.HasErrors(problems) {
+		conf, err := config.Resolve(written)
+		if err != nil {
+			fmt.Println("could not resolve config: ", err.Error())
+			os.Exit(1)
+		}
+		problems = append(problems, config.CheckReachable(conf, *timeout)...)
+	}
+	PrintProblems(fileName, problems)
+
+	errs := 0
+	for _, p := range problems {
+		if !p.Warning {
+			errs++
+		}
+	}
+	fmt.Printf("%s: %d errors, %d warnings\n", fileName, errs, len(problems)-errs)
+	if errs > 0 {
+		os.Exit(1)
+	}
+}
+
+func HandleExampleConfigArg(format string) {
 	conf := config.MakeExampleConfig()
-	bytes, err := json.MarshalIndent(conf, "", "  ")
+	bytes, err := config.Encode(conf, format)
 	if err != nil {
 		fmt.Println("could not make example config")
 		os.Exit(1)
@@ -61,19 +163,271 @@ func HandleExampleConfigArg() {
 	fmt.Print(string(bytes))
 }
 
+// Upgrade a config file to the current schema version, printing what changed
+func HandleMigrateConfigArg(fileName string, args []string) {
+	flags := flag.NewFlagSet("migrate-config", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what would change without rewriting the file")
+	flags.Parse(args)
+
+	result, err := config.MigrateFile(fileName, *dryRun)
+	if err != nil {
+		fmt.Println("could not migrate config: ", err.Error())
+		os.Exit(1)
+	}
+	if len(result.Changes) == 0 {
+		fmt.Printf("%s is already schema version %d, nothing to change\n", fileName, config.CurrentSchemaVersion)
+		return
+	}
+	for _, m := range result.Migrations {
+		fmt.Printf("schema version %d to %d: %s\n", m.From, m.To, m.Summary)
+	}
+	fmt.Println("changes:")
+	for _, c := range result.Changes {
+		fmt.Printf("  %s\n", c.String())
+	}
+	if *dryRun {
+		fmt.Printf("dry run, %s was not changed\n", fileName)
+		return
+	}
+	fmt.Printf("%s migrated to schema version %d, the old file is kept as %s.bak\n", fileName, config.CurrentSchemaVersion, fileName)
+}
+
 func HandleHelpArg() {
 	fmt.Println(`as2controlv2 - Irrigation system control system
 args:
 		- help: Print the help information of the system
-		- example: print an example config to standard output
-		- run <config-file>: run the control system with the given config file`)
+		- example [json|yaml|toml]: print an example config to standard output, in JSON unless a format is given
+		- validate <config-file> [flags]: check the config file and print every problem with its path and a fix, see 'validate <config-file> -h'
+		- migrate-config <config-file> [flags]: upgrade the config file to the current schema version in place, keeping a backup, see 'migrate-config <config-file> -h'
+		- geocode <config-file>: look up the configured location and cache its coordinates
+		- export <config-file> [flags]: export sensor, weather and watering history, see 'export <config-file> -h'
+		- calibrate <config-file> [flags]: capture a soil moisture calibration point from a live poll, see 'calibrate <config-file> -h'
+		- token <name> <role>: make a new API token, printing it and the hashed entry for the config. Without any
+		  tokens every API request is refused, unless api.allow_anonymous is set to open the API to anyone
+		- run <config-file>: run the control system with the given config file, it is checked first and reloaded on SIGHUP or when the file changes
+
+config files can be JSON, YAML (.yaml or .yml) or TOML (.toml), with the same keys in each. Any value can be
+overridden by an environment variable named after its path, such as AS2_SERIAL_CONFIG_SERIAL_PORT or
+AS2_REMOTE_CONFIGS_0_NAME. Tokens and hashes can be given as file:<path> or env:<variable> to read them from a
+file or another environment variable, such as file:/run/secrets/influxdb_token`)
+}
+
+// Look up the location in the config, ignoring anything cached, and print the result
+func HandleGeocodeArg(fileName string) {
+	conf, err := LoadConfig(fileName)
+	if err != nil {
+		fmt.Println("could not load config: ", err.Error())
+		os.Exit(1)
+	}
+	loc, ok, err := weather.ResolveLocation(&conf.WeatherAPIConfig, conf.StateDir(), true)
+	if err != nil {
+		fmt.Println("could not geocode location: ", err.Error())
+		os.Exit(1)
+	}
+	if !ok {
+		fmt.Println("config has no location or postcode, using the configured coordinates")
+		os.Exit(0)
+	}
+	fmt.Printf("%s, %s %s: lat=%f lon=%f\n", loc.Name, loc.State, loc.Country, loc.Latitude, loc.Longitude)
+}
+
+// Export history from storage for a time range and set of zones
+func HandleExportArg(fileName string, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	from := flags.String("from", time.Now().Add(-24*time.Hour).Format(time.RFC3339), "start of the range, RFC3339 or YYYY-MM-DD")
+	to := flags.String("to", time.Now().Format(time.RFC3339), "end of the range, RFC3339 or YYYY-MM-DD")
+	zones := flags.String("zones", "", "comma separated unit names, defaults to every configured unit")
+	data := flags.String("data", "sensors,weather,watering", "comma separated data to export: sensors, weather, watering")
+	format := flags.String("format", export.FormatCSV, "output format: csv, jsonl or lp (line protocol)")
+	downsample := flags.Duration("downsample", 0, "average readings over this period, such as 1h")
+	out := flags.String("out", "", "file to write to, defaults to standard output")
+	flags.Parse(args)
+
+	conf, err := LoadConfig(fileName)
+	if err != nil {
+		fmt.Println("could not load config: ", err.Error())
+		os.Exit(1)
+	}
+	start, err := parseExportTime(*from)
+	if err != nil {
+		fmt.Println("invalid -from: ", err.Error())
+		os.Exit(1)
+	}
+	end, err := parseExportTime(*to)
+	if err != nil {
+		fmt.Println("invalid -to: ", err.Error())
+		os.Exit(1)
+	}
+
+	opts := export.Options{
+		Start:      start,
+		End:        end,
+		Data:       strings.Split(*data, ","),
+		Format:     *format,
+		Downsample: *downsample,
+	}
+	if *zones != "" {
+		opts.Zones = strings.Split(*zones, ",")
+	} else {
+		for _, rmu := range conf.RemoteUnitConfigs {
+			opts.Zones = append(opts.Zones, rmu.UnitName)
+		}
+	}
+
+	reader, err := db.ReaderInit(conf)
+	if err != nil {
+		fmt.Println("could not open storage: ", err.Error())
+		os.Exit(1)
+	}
+	points, err := export.Collect(reader, opts)
+	if err != nil {
+		fmt.Println("could not export: ", err.Error())
+		os.Exit(1)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			fmt.Println("could not create output file: ", err.Error())
+			os.Exit(1)
+		}
+		defer w.Close()
+	}
+	if err := export.Write(w, points, opts.Format); err != nil {
+		fmt.Println("could not write export: ", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Poll a unit directly and add a calibration point to each of its soil moisture sensors. This
+// needs the serial port, so the controller must be stopped, otherwise use /api/calibration/capture
+func HandleCalibrateArg(fileName string, args []string) {
+	flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	unit := flags.Uint("unit", 0, "number of the unit to poll")
+	point := flags.String("point", "", "reference point to capture: dry or saturated")
+	value := flags.String("value", "", "volumetric water content of the point in percent, overrides -point")
+	show := flags.Bool("show", false, "print the current curves instead of capturing a point")
+	flags.Parse(args)
+
+	conf, err := LoadConfig(fileName)
+	if err != nil {
+		fmt.Println("could not load config: ", err.Error())
+		os.Exit(1)
+	}
+	store, err := calibration.StoreInit(conf)
+	if err != nil {
+		fmt.Println("could not load calibration: ", err.Error())
+		os.Exit(1)
+	}
+	if *show {
+		bytes, _ := json.MarshalIndent(store.Curves(), "", "  ")
+		fmt.Println(string(bytes))
+		return
+	}
+
+	pointValue, err := control.CalibrationPointValue(*point, *value)
+	if err != nil {
+		fmt.Println("invalid point: ", err.Error())
+		os.Exit(1)
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	serialHandler, err := serial.SerialConnectionInit(conf.SerialConfig, logger)
+	if err != nil {
+		fmt.Println("could not open serial connection: ", err.Error())
+		os.Exit(1)
+	}
+	if err := serialHandler.SwitchDevice(*unit); err != nil {
+		fmt.Println("could not switch to unit: ", err.Error())
+		os.Exit(1)
+	}
+	readings, err := serialHandler.PollDevice(*unit)
+	if err != nil {
+		fmt.Println("could not poll unit: ", err.Error())
+		os.Exit(1)
+	}
+
+	captured := 0
+	for _, r := range readings {
+		if !strings.Contains(strings.ToLower(r.Name), "soil_moisture") || r.Value > 9000 {
+			continue
+		}
+		if err := store.AddPoint(*unit, r.Name, config.CalibrationPoint{Raw: r.Value, Value: pointValue}); err != nil {
+			fmt.Println("could not save calibration: ", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s: raw %.1f is %.1f%%\n", r.Name, r.Value, pointValue)
+		captured++
+	}
+	if captured == 0 {
+		fmt.Println("unit did not report any soil moisture readings")
+		os.Exit(1)
+	}
+}
+
+// Make a new API token. The token itself is only ever printed here, the config keeps its hash
+func HandleTokenArg(name, role string) {
+	token, err := auth.GenerateToken()
+	if err != nil {
+		fmt.Println("could not generate token: ", err.Error())
+		os.Exit(1)
+	}
+	entry, _ := json.MarshalIndent(config.APIToken{Name: name, Role: role, Hash: auth.HashToken(token)}, "", "  ")
+	fmt.Printf("token: %s\n\nadd this to api.tokens in the config or the token file:\n%s\n", token, entry)
+}
+
+// Parse a time given to export, either a full timestamp or just a date
+func parseExportTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
 }
 
 func SetupRoutes(r *gin.Engine, cs *control.ControlSystem) {
-	r.GET("/api/warnings", cs.RouteGETWarnings)
-	r.POST("/api/delay", cs.RoutePOSTDelayWatering)
-	r.POST("/api/cancel", cs.RoutePOSTCancelWatering)
-	r.POST("/api/water-now", cs.RoutePOSTWaterNow)
+	viewer := cs.Authorise(auth.RoleViewer)
+	operator := cs.Authorise(auth.RoleOperator)
+	admin := cs.Authorise(auth.RoleAdmin)
+
+	// The versioned API, its OpenAPI document is generated from the same routes
+	v1 := r.Group("/api/v1")
+	for _, rt := range cs.V1Routes() {
+		v1.Handle(rt.Method, rt.Path, cs.Authorise(rt.Role), rt.Handler)
+	}
+	v1.GET("/openapi.json", cs.RouteGETOpenAPI)
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/v1/") {
+			control.V1NotFound(c)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"msg": "not found"})
+	})
+
+	// The original routes, kept working for existing clients
+	r.GET("/api/warnings", control.Deprecated("/api/v1/warnings"), viewer, cs.RouteGETWarnings)
+	r.GET("/api/history", control.Deprecated("/api/v1/units/{id}/history"), viewer, cs.RouteGETHistory)
+	r.GET("/api/watering-history", control.Deprecated("/api/v1/waterings"), viewer, cs.RouteGETWateringHistory)
+	r.GET("/api/connectivity", control.Deprecated("/api/v1/connectivity"), viewer, cs.RouteGETConnectivity)
+	r.GET("/api/units", control.Deprecated("/api/v1/units"), viewer, cs.RouteGETUnits)
+	r.GET("/api/units/:id", control.Deprecated("/api/v1/units/{id}"), viewer, cs.RouteGETUnit)
+	r.GET("/api/schedule", control.Deprecated("/api/v1/schedule"), viewer, cs.RouteGETSchedule)
+	r.GET("/api/events", control.Deprecated("/api/v1/events"), viewer, cs.RouteGETEvents)
+	r.GET("/api/events/ws", control.Deprecated("/api/v1/events/ws"), viewer, cs.RouteGETEventsWebSocket)
+	r.GET("/api/calibration", control.Deprecated("/api/v1/calibration"), viewer, cs.RouteGETCalibration)
+	r.POST("/api/calibration/capture", control.Deprecated("/api/v1/units/{id}/calibration"), admin, cs.RoutePOSTCaptureCalibration)
+	r.DELETE("/api/calibration", control.Deprecated("/api/v1/units/{id}/calibration/{sensor}"), admin, cs.RouteDELETECalibration)
+	r.POST("/api/delay", control.Deprecated("/api/v1/units/{id}/watering/delay"), operator, cs.RoutePOSTDelayWatering)
+	r.POST("/api/cancel", control.Deprecated("/api/v1/units/{id}/watering"), operator, cs.RoutePOSTCancelWatering)
+	r.POST("/api/water-now", control.Deprecated("/api/v1/units/{id}/watering"), operator, cs.RoutePOSTWaterNow)
+
+	// Metrics need a viewer token. Probes are left open so orchestrators don't need one, they
+	// only give the overall status
+	r.GET("/metrics", viewer, cs.RouteGETMetrics)
+	r.GET("/healthz", cs.RouteGETHealthz)
+	r.GET("/readyz", cs.RouteGETReadyz)
+
+	// The built in dashboard, it uses /api/v1 with the token entered on the page
+	dashboard.Register(r)
 }
 
 func main() {
@@ -88,7 +442,11 @@ func main() {
 	}
 
 	if os.Args[1] == "example" {
-		HandleExampleConfigArg()
+		format := config.FormatJSON
+		if len(os.Args) == 3 {
+			format = os.Args[2]
+		}
+		HandleExampleConfigArg(format)
 		os.Exit(0)
 	}
 
@@ -97,12 +455,42 @@ func main() {
 		os.Exit(0)
 	}
 
+	if os.Args[1] == "validate" {
+		HandleValidateArg(os.Args[2], os.Args[3:])
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "migrate-config" {
+		HandleMigrateConfigArg(os.Args[2], os.Args[3:])
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "geocode" {
+		HandleGeocodeArg(os.Args[2])
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "export" {
+		HandleExportArg(os.Args[2], os.Args[3:])
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "token" {
+		HandleTokenArg(os.Args[2], os.Args[3])
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "calibrate" {
+		HandleCalibrateArg(os.Args[2], os.Args[3:])
+		os.Exit(0)
+	}
+
 	if os.Args[1] != "run" {
 		os.Exit(0)
 	}
 
-	// Load the config file
-	conf, err := LoadConfig(os.Args[2])
+	// Load the config file, refusing to run with one that has errors
+	written, conf, err := LoadCheckedConfig(os.Args[2])
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -114,24 +502,71 @@ func main() {
 	// as2controlv2 run <config-file>
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
 
-	// Load up the Datbase connection
-	dbHandler, err := db.DBInit(conf.DatabaseConfig)
+	// Keep the config as it is in the file, before anything is resolved into it, so changes
+	// through the API are written back the same way
+	configStore, configStoreErr := config.StoreInit(os.Args[2], written, conf)
+
+	// Load up the Datbase connection, or whichever storage backends are configured
+	dbHandler, err := db.SinkInit(conf, logger)
 	if err != nil {
 		fmt.Println("Error loading database config: ", err.Error())
 		os.Exit(1)
 	}
 
+	// Resolve the location to coordinates if the site is configured by name
+	location, resolved, err := weather.ResolveLocation(&conf.WeatherAPIConfig, conf.StateDir(), false)
+	if err != nil {
+		fmt.Println("Error resolving weather location: ", err.Error())
+		os.Exit(1)
+	}
+
 	// Load up the open weather map connection
 	weatherHandler := weather.WeatherInit(conf.WeatherAPIConfig)
+	if resolved {
+		if err := weatherHandler.VerifyLocation(location); err != nil {
+			logger.Warn(fmt.Sprintf("could not verify weather location: %s", err.Error()))
+		}
+	}
 
 	// Load the serial connection
-	serialHandler, err := serial.SerialConnectionInit(conf.SerialConfig, logger)
+	serialHandler, serialErr := serial.SerialConnectionInit(conf.SerialConfig, logger)
+	if serialErr != nil {
+		// Keep serving the API and history, nothing can be polled or watered until the serial
+		// settings are fixed and the config reloaded
+		fmt.Println("Error opening serial connection, running degraded without polling or watering: ", serialErr.Error())
+		logger.Error(fmt.Sprintf("serial link unavailable, the system is not ready: %s", serialErr.Error()))
+	}
+
+	// Load the soil moisture calibration curves
+	calibrations, err := calibration.StoreInit(conf)
 	if err != nil {
-		fmt.Println("Error loading serial connection config: ", err.Error())
+		fmt.Println("Error loading soil moisture calibration: ", err.Error())
+		os.Exit(1)
 	}
 
 	// Now enter the loop, spawn each process in a separate thread
-	controller := control.ControlSystemInit(logger, conf, dbHandler, weatherHandler, serialHandler)
+	controller := control.ControlSystemInit(logger, conf, dbHandler, weatherHandler, serialHandler, calibrations)
+	if serialErr != nil {
+		controller.SetSerialUnavailable(serialErr)
+	}
+
+	// Load the API tokens, without any the API refuses every request unless it is allowed to be open
+	tokens, err := auth.StoreInit(conf.API)
+	if err != nil {
+		fmt.Println("Error loading API tokens: ", err.Error())
+		os.Exit(1)
+	}
+	if tokens.Anonymous() {
+		logger.Warn("no API tokens are configured and api.allow_anonymous is set, the API is open to anyone who can reach it")
+	} else if !tokens.Enabled() {
+		logger.Warn("no API tokens are configured, every API request will be refused, add some with the token command or set api.allow_anonymous")
+	}
+	controller.SetTokens(tokens)
+	if configStoreErr != nil {
+		logger.Error(fmt.Sprintf("could not load the config history, the config can't be changed at runtime: %s", configStoreErr.Error()))
+	} else {
+		controller.SetConfigStore(configStore)
+	}
 	// Spawn the server on a different thread
 	// Define all the HTTP routes
 	gin.DisableConsoleColor()
@@ -140,12 +575,37 @@ func main() {
 		log.Println("Could not create log file for gin")
 	}
 	gin.DefaultWriter = io.MultiWriter(f)
-	r := gin.Default()
+	r := gin.New()
+	// Tokens in the query are taken off before the request is logged
+	r.Use(control.QueryToken(), gin.Logger(), gin.Recovery())
+	// Only trust the client address a proxy gives us if it is one of ours
+	if err := r.SetTrustedProxies(conf.API.TrustedProxies); err != nil {
+		fmt.Println("Error setting trusted proxies: ", err.Error())
+		os.Exit(1)
+	}
 	SetupRoutes(r, controller)
 	go func() { // This runs this function asyncronously, so we can sit in our main loop
 		log.Fatal(r.Run())
 	}()
 
+	// Reload the config on a hangup, or when the file is saved
+	reload := func(by string) {
+		v, err := controller.ReloadConfig(context.Background(), by)
+		if err != nil {
+			logger.Error(fmt.Sprintf("could not reload the config: %s", err.Error()))
+			return
+		}
+		logger.Info(fmt.Sprintf("config reloaded, running version %d", v.Version))
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reload("signal:SIGHUP")
+		}
+	}()
+	go config.WatchFile(os.Args[2], configWatchInterval, func() { reload("file") })
+
 	for {
 		// err := controller.FetchRemoteUnitReadings()
 		// if err != nil {
@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This package keeps the metrics about the controller itself, and writes them out in the
+// Prometheus text format. Every package records into Default, which is served on /metrics
+
+// The types of metric, as Prometheus names them
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+	TypeSummary = "summary" // Only the sum and count are kept
+)
+
+// Labels on a single series, such as the unit it is for
+type Labels map[string]string
+
+// The registry every package records into
+var Default = NewRegistry()
+
+// A set of metric families
+type Registry struct {
+	mu         sync.Mutex
+	families   map[string]*family
+	collectors []func(r *Registry)
+}
+
+// A named metric and all of its series
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series map[string]*series // Keyed by the formatted labels
+}
+
+// A single series of a metric
+type series struct {
+	labels string
+	value  float64
+	count  uint64 // Summaries only
+}
+
+// Make an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Give a metric its type and help text. Metrics recorded without being described are untyped
+func (r *Registry) Describe(name, typ, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name)
+	f.typ = typ
+	f.help = help
+}
+
+// Add to a counter
+func (r *Registry) Add(name string, labels Labels, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name).get(labels).value += delta
+}
+
+// Add one to a counter
+func (r *Registry) Inc(name string, labels Labels) {
+	r.Add(name, labels, 1)
+}
+
+// Set a gauge
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name).get(labels).value = value
+}
+
+// Record an observation in a summary, such as how long a poll took
+func (r *Registry) Observe(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.family(name).get(labels)
+	s.value += value
+	s.count++
+}
+
+// Remove every series of a gauge, so series for things that have gone away are not left behind
+func (r *Registry) Reset(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name).series = make(map[string]*series)
+}
+
+// Add a function that is called before every scrape, for gauges that are cheaper to work out on
+// demand than to keep up to date
+func (r *Registry) OnCollect(collect func(r *Registry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collect)
+}
+
+// Write every metric in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]func(r *Registry){}, r.collectors...)
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect(r)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		}
+		if f.typ != "" {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		}
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ == TypeSummary {
+				fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, s.labels, formatValue(s.value))
+				fmt.Fprintf(&b, "%s_count%s %d\n", f.name, s.labels, s.count)
+				continue
+			}
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, s.labels, formatValue(s.value))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Get a family, making it if this is the first time it has been used. Must be called with the lock held
+func (r *Registry) family(name string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+	return f
+}
+
+// Get a series, making it if this is the first time these labels have been used
+func (f *family) get(labels Labels) *series {
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Format labels as {a="1",b="2"}, sorted so the same labels always make the same key
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, strconv.Quote(labels[name])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Format a value the way Prometheus expects, including the special values
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
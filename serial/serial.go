@@ -2,6 +2,7 @@ package serial
 
 import (
 	"as2controlv2/config"
+	"as2controlv2/metrics"
 	"errors"
 	"fmt"
 	"log"
@@ -13,6 +14,10 @@ import (
 	tarmSerial "github.com/tarm/serial"
 )
 
+func init() {
+	metrics.Default.Describe("as2_serial_poll_retries_total", metrics.TypeCounter, "Polls that were retried because the module was stuck in command mode, by unit")
+}
+
 // Stores the serial connection
 type SerialConnection struct {
 	conn           *tarmSerial.Port
@@ -45,6 +50,14 @@ func SerialConnectionInit(conf config.SerialConfig, logger *slog.Logger) (Serial
 	return serialConn, nil
 }
 
+// Close the serial port, the connection can't be used after this
+func (sc *SerialConnection) Close() error {
+	if sc.conn == nil {
+		return nil
+	}
+	return sc.conn.Close()
+}
+
 // Send the poll command to a particular device
 func (sc *SerialConnection) sendPollCmd(deviceNumber uint) (string, error) {
 	// // First write to the serial connection, to clear the buffer
@@ -112,6 +125,7 @@ func (sc *SerialConnection) PollDevice(deviceNumber uint) ([]SensorReading, erro
 			if strings.Contains(byteStr, "CMD") {
 				// We are still in command mode, try again
 				sc.CurrentDevice = 0
+				metrics.Default.Inc("as2_serial_poll_retries_total", metrics.Labels{"unit": strconv.Itoa(int(deviceNumber))})
 				sc.logger.Warn("still in command mode, retrying")
 				log.Println("still in command mode, retrying")
 				sc.WriteToDevice("---\n\r")
@@ -0,0 +1,106 @@
+package weather
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Struct that holds the 5 day / 3 hour forecast response from OpenWeatherMap
+type ForecastResult struct {
+	Cod     string          `json:"cod"`
+	Count   int             `json:"cnt"`
+	Entries []ForecastEntry `json:"list"`
+	City    City            `json:"city"`
+}
+
+// A single 3 hour forecast period
+type ForecastEntry struct {
+	DT         uint      `json:"dt"`
+	Main       Main      `json:"main"`
+	Weather    []Weather `json:"weather"`
+	Clouds     Clouds    `json:"clouds"`
+	Wind       Wind      `json:"wind"`
+	Visibility uint      `json:"visibility"`
+	Pop        float64   `json:"pop"` // Probability of precipitation, 0 to 1
+	Rain       Rain      `json:"rain"`
+	DTText     string    `json:"dt_txt"`
+}
+
+// Represents the city JSON object of a forecast
+type City struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Coord    Coord  `json:"coord"`
+	Country  string `json:"country"`
+	Timezone int    `json:"timezone"`
+	Sunrise  uint   `json:"sunrise"`
+	Sunset   uint   `json:"sunset"`
+}
+
+// A forecast along with when we fetched it
+type ForecastObservation struct {
+	Result    ForecastResult
+	FetchedAt time.Time
+}
+
+// Get the 5 day / 3 hour forecast from OpenWeatherMap, kept as the last good forecast on success
+func (w *WeatherAPI) GetForecast() (ForecastResult, error) {
+	if time.Now().Before(w.rateLimitedUntil) {
+		return ForecastResult{}, ErrRateLimited
+	}
+	fullUrl := fmt.Sprintf("%s/data/2.5/forecast?lat=%f&lon=%f&appid=%s", w.URL, w.Latitude, w.Longitude, w.Token)
+
+	var result ForecastResult
+	if err := w.getJSON(fullUrl, &result, &w.forecastRetries); err != nil {
+		return ForecastResult{}, err
+	}
+	if len(result.Entries) == 0 {
+		return ForecastResult{}, errors.New("forecast has no entries")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastForecast = ForecastObservation{Result: result, FetchedAt: time.Now()}
+	return result, nil
+}
+
+// Get the last forecast that was successfully fetched, false if we have never had one
+func (w *WeatherAPI) LastForecast() (ForecastObservation, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastForecast, !w.lastForecast.FetchedAt.IsZero()
+}
+
+// Whether this forecast is older than maxAge, or was never fetched at all
+func (f ForecastObservation) IsStale(maxAge time.Duration) bool {
+	return f.FetchedAt.IsZero() || time.Since(f.FetchedAt) > maxAge
+}
+
+// The forecast entries that start between now and now + window
+func (f ForecastResult) Within(window time.Duration) []ForecastEntry {
+	entries := make([]ForecastEntry, 0)
+	now := time.Now()
+	for _, e := range f.Entries {
+		// Include the period we are currently in
+		if e.Time().Add(3*time.Hour).After(now) && e.Time().Before(now.Add(window)) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// The forecast entry covering the given time, false if it is outside the forecast
+func (f ForecastResult) At(t time.Time) (ForecastEntry, bool) {
+	for _, e := range f.Entries {
+		if !t.Before(e.Time()) && t.Before(e.Time().Add(3*time.Hour)) {
+			return e, true
+		}
+	}
+	return ForecastEntry{}, false
+}
+
+// The start of the forecast period
+func (e ForecastEntry) Time() time.Time {
+	return time.Unix(int64(e.DT), 0)
+}
@@ -0,0 +1,151 @@
+package weather
+
+import (
+	"as2controlv2/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the file in the state directory that caches geocoding results
+const geocodeCacheFile = "geocode_cache.json"
+
+// A single result from the OpenWeatherMap geocoding API, see config/api_checking.json
+type GeocodeResult struct {
+	Name       string            `json:"name"`
+	LocalNames map[string]string `json:"local_names,omitempty"`
+	Latitude   float64           `json:"lat"`
+	Longitude  float64           `json:"lon"`
+	Country    string            `json:"country"`
+	State      string            `json:"state,omitempty"`
+}
+
+// Look up a place name, such as "Townsville,QLD,AU", returning the best match
+func (w *WeatherAPI) GeocodeLocation(location string) (GeocodeResult, error) {
+	fullUrl := fmt.Sprintf("%s/geo/1.0/direct?q=%s&limit=1&appid=%s", w.URL, url.QueryEscape(location), w.Token)
+	var results []GeocodeResult
+	if err := w.getJSONWaiting(fullUrl, &results); err != nil {
+		return GeocodeResult{}, err
+	}
+	if len(results) == 0 {
+		return GeocodeResult{}, fmt.Errorf("no location found for %q", location)
+	}
+	return results[0], nil
+}
+
+// Look up a postcode with a country code, such as "4810,AU"
+func (w *WeatherAPI) GeocodePostcode(postcode string) (GeocodeResult, error) {
+	fullUrl := fmt.Sprintf("%s/geo/1.0/zip?zip=%s&appid=%s", w.URL, url.QueryEscape(postcode), w.Token)
+	var result GeocodeResult
+	if err := w.getJSONWaiting(fullUrl, &result); err != nil {
+		return GeocodeResult{}, err
+	}
+	if result.Name == "" && result.Latitude == 0 && result.Longitude == 0 {
+		return GeocodeResult{}, fmt.Errorf("no location found for postcode %q", postcode)
+	}
+	return result, nil
+}
+
+// The key a config's location is cached under, empty if it uses raw coordinates
+func geocodeQuery(conf config.OpenWeatherMapConfig) string {
+	if conf.Postcode != "" {
+		return "zip:" + strings.ToLower(strings.TrimSpace(conf.Postcode))
+	}
+	if conf.Location != "" {
+		return "q:" + strings.ToLower(strings.TrimSpace(conf.Location))
+	}
+	return ""
+}
+
+// Resolve the place name or postcode in the config to coordinates, using the cache in the
+// state directory unless refresh is set. The resolved coordinates are written into conf.
+// If the config only has coordinates, nothing is looked up and false is returned
+func ResolveLocation(conf *config.OpenWeatherMapConfig, stateDir string, refresh bool) (GeocodeResult, bool, error) {
+	query := geocodeQuery(*conf)
+	if query == "" {
+		return GeocodeResult{}, false, nil
+	}
+
+	cache, err := loadGeocodeCache(stateDir)
+	if err != nil {
+		return GeocodeResult{}, false, err
+	}
+	result, ok := cache[query]
+	if !ok || refresh {
+		w := WeatherInit(*conf)
+		if conf.Postcode != "" {
+			result, err = w.GeocodePostcode(conf.Postcode)
+		} else {
+			result, err = w.GeocodeLocation(conf.Location)
+		}
+		if err != nil {
+			return GeocodeResult{}, false, err
+		}
+		cache[query] = result
+		if err := saveGeocodeCache(stateDir, cache); err != nil {
+			return GeocodeResult{}, false, err
+		}
+	}
+
+	conf.Latitude = result.Latitude
+	conf.Longitude = result.Longitude
+	return result, true, nil
+}
+
+// Fetch the current weather and check that OpenWeatherMap agrees with the resolved location,
+// both by name and by being within a few kilometres of the coordinates. This is done once at
+// startup, so it waits between retries
+func (w *WeatherAPI) VerifyLocation(expected GeocodeResult) error {
+	result, err := w.GetCurrentWeather()
+	var retry *RetryError
+	for errors.As(err, &retry) {
+		time.Sleep(retry.Wait)
+		result, err = w.GetCurrentWeather()
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(result.Name, expected.Name) {
+		return fmt.Errorf("weather API reports location %q, expected %q", result.Name, expected.Name)
+	}
+	// OpenWeatherMap rounds the coordinates it returns, so allow a little slack
+	if math.Abs(result.Coord.Latitude-expected.Latitude) > 0.05 || math.Abs(result.Coord.Longitude-expected.Longitude) > 0.05 {
+		return fmt.Errorf("weather API coordinates (%f, %f) do not match resolved coordinates (%f, %f)",
+			result.Coord.Latitude, result.Coord.Longitude, expected.Latitude, expected.Longitude)
+	}
+	return nil
+}
+
+// Load the geocoding cache, an empty cache is returned if it doesn't exist yet
+func loadGeocodeCache(stateDir string) (map[string]GeocodeResult, error) {
+	cache := make(map[string]GeocodeResult)
+	bytes, err := os.ReadFile(filepath.Join(stateDir, geocodeCacheFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &cache); err != nil {
+		return nil, fmt.Errorf("could not parse geocode cache: %w", err)
+	}
+	return cache, nil
+}
+
+// Save the geocoding cache into the state directory
+func saveGeocodeCache(stateDir string, cache map[string]GeocodeResult) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, geocodeCacheFile), bytes, 0644)
+}
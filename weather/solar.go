@@ -0,0 +1,61 @@
+package weather
+
+import (
+	"math"
+	"time"
+)
+
+// Sunrise and sunset for a single day
+type SunTimes struct {
+	Sunrise time.Time
+	Sunset  time.Time
+}
+
+// Whether t is between sunrise and sunset
+func (s SunTimes) IsDaytime(t time.Time) bool {
+	return !t.Before(s.Sunrise) && t.Before(s.Sunset)
+}
+
+// The sunrise and sunset times from an observation
+func (r CurrentWeatherResult) SunTimes() SunTimes {
+	return SunTimes{
+		Sunrise: time.Unix(int64(r.Sys.Sunrise), 0),
+		Sunset:  time.Unix(int64(r.Sys.Sunset), 0),
+	}
+}
+
+// Calculate sunrise and sunset for the calendar day of the given time, at the given coordinates.
+// This uses the sunrise equation, which is accurate to a minute or two and is only used when we
+// have no weather data. False is returned if the sun does not rise or set that day
+func SolarTimes(latitude, longitude float64, day time.Time) (SunTimes, bool) {
+	const j2000 = 2451545.0
+	const unixEpochJulian = 2440587.5
+	rad := math.Pi / 180
+
+	// Days since J2000 for noon UTC on this calendar day
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, time.UTC)
+	n := math.Round(float64(noon.Unix())/86400 + unixEpochJulian - j2000 + 0.0008)
+
+	meanSolarNoon := n - longitude/360
+	meanAnomaly := math.Mod(357.5291+0.98560028*meanSolarNoon, 360)
+	centre := 1.9148*math.Sin(meanAnomaly*rad) + 0.02*math.Sin(2*meanAnomaly*rad) + 0.0003*math.Sin(3*meanAnomaly*rad)
+	eclipticLongitude := math.Mod(meanAnomaly+centre+180+102.9372, 360)
+	transit := j2000 + meanSolarNoon + 0.0053*math.Sin(meanAnomaly*rad) - 0.0069*math.Sin(2*eclipticLongitude*rad)
+
+	sinDeclination := math.Sin(eclipticLongitude*rad) * math.Sin(23.4397*rad)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+	// -0.833 degrees accounts for refraction and the size of the sun's disc
+	cosHourAngle := (math.Sin(-0.833*rad) - math.Sin(latitude*rad)*sinDeclination) / (math.Cos(latitude*rad) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return SunTimes{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / rad
+
+	toTime := func(julian float64) time.Time {
+		return time.Unix(int64(math.Round((julian-unixEpochJulian)*86400)), 0).In(day.Location())
+	}
+	return SunTimes{
+		Sunrise: toTime(transit - hourAngle/360),
+		Sunset:  toTime(transit + hourAngle/360),
+	}, true
+}
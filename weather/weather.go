@@ -2,22 +2,76 @@ package weather
 
 import (
 	"as2controlv2/config"
+	"as2controlv2/metrics"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // This package is intended to pull data from Openweather map, for now we are only doing current data
 // not predicitons yet
 
+// Defaults used when the config does not specify the fetch behaviour
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultMaxRetries = 3
+	defaultBackoff    = 2 * time.Second
+	defaultStaleAfter = 2 * time.Hour
+)
+
+// Returned when OpenWeatherMap has told us to back off and that period has not passed yet
+var ErrRateLimited = errors.New("rate limited by weather API")
+
+// Returned when a request failed but is worth trying again before the next scheduled fetch.
+// Nothing waits between attempts, the caller makes the next one once Wait has passed
+type RetryError struct {
+	Err  error
+	Wait time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s, trying again in %s", e.Err.Error(), e.Wait)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func init() {
+	metrics.Default.Describe("as2_weather_retries_total", metrics.TypeCounter, "Weather API requests that were retried")
+	metrics.Default.Describe("as2_weather_errors_total", metrics.TypeCounter, "Weather API requests that failed, by reason")
+}
+
 // Stores the weather API information
 type WeatherAPI struct {
 	URL       string
 	Token     string
 	Latitude  float64
 	Longitude float64
+
+	client           *http.Client
+	maxRetries       int
+	initialBackoff   time.Duration
+	rateLimitedUntil time.Time // Don't call the API again until after this time
+	weatherRetries   int       // Failed attempts in a row at the current weather
+	forecastRetries  int       // Failed attempts in a row at the forecast
+
+	// Fetching is done from one goroutine, these are read from others
+	mu           sync.Mutex
+	staleAfter   time.Duration
+	lastGood     Observation         // The last observation that passed validation
+	lastForecast ForecastObservation // The last forecast that was fetched
+}
+
+// A weather result along with when we fetched it, so decisions can tell how old it is
+type Observation struct {
+	Result    CurrentWeatherResult
+	FetchedAt time.Time
 }
 
 // Struct that holds the response from OpenWeatherMap
@@ -29,9 +83,10 @@ type CurrentWeatherResult struct {
 	Visibility uint      `json:"visibility"`
 	Wind       Wind      `json:"wind"`
 	Clouds     Clouds    `json:"clouds"`
+	Rain       Rain      `json:"rain"`
 	DT         uint      `json:"dt"`
 	Sys        Sys       `json:"sys"`
-	Timezone   uint      `json:"timezone"`
+	Timezone   int       `json:"timezone"` // Shift from UTC in seconds, can be negative
 	ID         uint      `json:"id"`
 	Name       string    `json:"name"`
 	Cod        int       `json:"cod"`
@@ -48,7 +103,7 @@ type Weather struct {
 // Represents the coord JSON object
 type Coord struct {
 	Latitude  float64 `json:"lat"`
-	Longitude float64 `json:"long"`
+	Longitude float64 `json:"lon"`
 }
 
 // Represents the main JSON object
@@ -67,6 +122,7 @@ type Main struct {
 type Wind struct {
 	Speed float64 `json:"speed"`
 	Deg   float64 `json:"deg"`
+	Gust  float64 `json:"gust"`
 }
 
 // Represents the clouds JSON object
@@ -74,6 +130,12 @@ type Clouds struct {
 	All float64 `json:"all"`
 }
 
+// Represents the rain JSON object, volumes are in mm
+type Rain struct {
+	OneHour   float64 `json:"1h"`
+	ThreeHour float64 `json:"3h"`
+}
+
 // Represents the sys JSON object
 type Sys struct {
 	Type    int    `json:"type"`
@@ -84,39 +146,196 @@ type Sys struct {
 }
 
 // Initialise the weather connection
-func WeatherInit(conf config.OpenWeatherMapConfig) WeatherAPI {
-	return WeatherAPI{
-		URL:       conf.URL,
-		Token:     conf.Token,
-		Latitude:  conf.Latitude,
-		Longitude: conf.Longitude,
+func WeatherInit(conf config.OpenWeatherMapConfig) *WeatherAPI {
+	timeout := defaultTimeout
+	if conf.TimeoutSeconds != 0 {
+		timeout = time.Duration(conf.TimeoutSeconds) * time.Second
 	}
+	maxRetries := defaultMaxRetries
+	if conf.MaxRetries != 0 {
+		maxRetries = int(conf.MaxRetries)
+	}
+	staleAfter := defaultStaleAfter
+	if conf.StaleAfterSeconds != 0 {
+		staleAfter = time.Duration(conf.StaleAfterSeconds) * time.Second
+	}
+	return &WeatherAPI{
+		URL:            conf.URL,
+		Token:          conf.Token,
+		Latitude:       conf.Latitude,
+		Longitude:      conf.Longitude,
+		client:         &http.Client{Timeout: timeout},
+		maxRetries:     maxRetries,
+		initialBackoff: defaultBackoff,
+		staleAfter:     staleAfter,
+	}
+}
+
+// Change the connection settings of a running connection. The last observation and forecast are
+// kept unless the location moved, as they no longer describe the site if it did
+func (w *WeatherAPI) Reconfigure(conf config.OpenWeatherMapConfig) {
+	next := WeatherInit(conf)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if next.Latitude != w.Latitude || next.Longitude != w.Longitude {
+		w.lastGood = Observation{}
+		w.lastForecast = ForecastObservation{}
+	}
+	// The rate limit is against the token
+	if next.Token != w.Token {
+		w.rateLimitedUntil = time.Time{}
+	}
+	w.URL, w.Token, w.Latitude, w.Longitude = next.URL, next.Token, next.Latitude, next.Longitude
+	w.client, w.maxRetries, w.initialBackoff, w.staleAfter = next.client, next.maxRetries, next.initialBackoff, next.staleAfter
+	w.weatherRetries, w.forecastRetries = 0, 0
 }
 
-// Get the current weather from OpenWeatherMap
+// Get the current weather from OpenWeatherMap. A failed request that is worth retrying returns a
+// RetryError with exponential backoff, and a successful result is kept as the last good observation
 func (w *WeatherAPI) GetCurrentWeather() (CurrentWeatherResult, error) {
+	if time.Now().Before(w.rateLimitedUntil) {
+		return CurrentWeatherResult{}, ErrRateLimited
+	}
 	fullUrl := fmt.Sprintf("%s/data/2.5/weather?lat=%f&lon=%f&appid=%s", w.URL, w.Latitude, w.Longitude, w.Token)
-	resp, err := http.Get(fullUrl)
-	if err != nil {
-		return CurrentWeatherResult{}, nil
+
+	var result CurrentWeatherResult
+	if err := w.getJSON(fullUrl, &result, &w.weatherRetries); err != nil {
+		return CurrentWeatherResult{}, err
+	}
+	if err := result.Validate(); err != nil {
+		return CurrentWeatherResult{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return CurrentWeatherResult{}, errors.New(fmt.Sprint("unexpected status code: ", resp.StatusCode))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastGood = Observation{Result: result, FetchedAt: time.Now()}
+	return result, nil
+}
+
+// Perform a GET request and decode the JSON body into out. Network errors and server errors are
+// retried with exponential backoff, but nothing waits here, as it would hold up the scheduler.
+// A RetryError says when to make the next attempt, until the retries run out. retries counts the
+// failed attempts in a row at this request
+func (w *WeatherAPI) getJSON(fullUrl string, out interface{}, retries *int) error {
+	retry, err := w.get(fullUrl, out)
+	if err == nil || !retry {
+		*retries = 0
+		return err
+	}
+	if *retries >= w.maxRetries {
+		attempts := *retries + 1
+		*retries = 0
+		metrics.Default.Inc("as2_weather_errors_total", metrics.Labels{"reason": "retries_exhausted"})
+		return fmt.Errorf("weather request failed after %d attempts: %w", attempts, err)
+	}
+	*retries++
+	metrics.Default.Inc("as2_weather_retries_total", nil)
+	return &RetryError{Err: err, Wait: w.backoff(*retries)}
+}
+
+// Perform a GET request, waiting between retries. Only for one off requests made outside the
+// scheduler, such as geocoding
+func (w *WeatherAPI) getJSONWaiting(fullUrl string, out interface{}) error {
+	retries := 0
+	for {
+		err := w.getJSON(fullUrl, out, &retries)
+		var retry *RetryError
+		if !errors.As(err, &retry) {
+			return err
+		}
+		time.Sleep(retry.Wait)
 	}
+}
 
+// Make a single GET request and decode the JSON body into out, and whether a failure is worth
+// retrying
+func (w *WeatherAPI) get(fullUrl string, out interface{}) (bool, error) {
+	if w.client == nil {
+		w.client = &http.Client{Timeout: defaultTimeout}
+	}
+	resp, err := w.client.Get(fullUrl)
+	if err != nil {
+		return true, err
+	}
 	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
 	if err != nil {
-		return CurrentWeatherResult{}, err
+		return true, err
 	}
 
-	var result CurrentWeatherResult
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return CurrentWeatherResult{}, err
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return false, json.Unmarshal(body, out)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// Respect the Retry-After header if we are given one, otherwise just back off
+		wait := w.backoff(1)
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+		w.rateLimitedUntil = time.Now().Add(wait)
+		metrics.Default.Inc("as2_weather_errors_total", metrics.Labels{"reason": "rate_limited"})
+		return false, ErrRateLimited
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	default:
+		// Anything else (bad token, bad coordinates) won't be fixed by retrying
+		metrics.Default.Inc("as2_weather_errors_total", metrics.Labels{"reason": "status"})
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
-	// Write these results into influxDB
+}
 
-	return result, nil
+// How long to wait before a retry, doubling with each one
+func (w *WeatherAPI) backoff(retry int) time.Duration {
+	backoff := w.initialBackoff
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	return backoff << (retry - 1)
+}
+
+// Get the last observation that was successfully fetched, false if we have never had one
+func (w *WeatherAPI) LastObservation() (Observation, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastGood, !w.lastGood.FetchedAt.IsZero()
+}
+
+// The maximum age an observation can be before it is considered stale
+func (w *WeatherAPI) StaleAfter() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.staleAfter
+}
+
+// How long ago this observation was fetched
+func (o Observation) Age() time.Duration {
+	if o.FetchedAt.IsZero() {
+		return 0
+	}
+	return time.Since(o.FetchedAt)
+}
+
+// Whether this observation is older than maxAge, or was never fetched at all
+func (o Observation) IsStale(maxAge time.Duration) bool {
+	return o.FetchedAt.IsZero() || o.Age() > maxAge
+}
+
+// Convert the Kelvin temperatures OpenWeatherMap returns into Celsius
+func KelvinToCelsius(k float64) float64 {
+	return k - 273.15
+}
+
+// Check that a result looks like a real observation, an empty result would put 0 Kelvin
+// into the database
+func (r CurrentWeatherResult) Validate() error {
+	if r.Cod != 0 && r.Cod != http.StatusOK {
+		return fmt.Errorf("weather API returned code %d", r.Cod)
+	}
+	if r.DT == 0 {
+		return errors.New("weather result has no observation time")
+	}
+	if r.Main.TempKelvin <= 0 {
+		return errors.New("weather result has no temperature")
+	}
+	return nil
 }
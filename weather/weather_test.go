@@ -0,0 +1,75 @@
+package weather
+
+import (
+	"as2controlv2/config"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testObservation = `{"dt": 1760767200, "main": {"temp": 293.15}, "name": "Townsville"}`
+
+// A weather API that fails with a server error the given number of times, then answers
+func flakyServer(t *testing.T, failures int) *httptest.Server {
+	t.Helper()
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(testObservation))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Failed requests come back straight away with when to try again, rather than waiting
+func TestRetryWithoutWaiting(t *testing.T) {
+	server := flakyServer(t, 2)
+	w := WeatherInit(config.OpenWeatherMapConfig{URL: server.URL, MaxRetries: 3})
+
+	for i, want := range []time.Duration{defaultBackoff, 2 * defaultBackoff} {
+		start := time.Now()
+		_, err := w.GetCurrentWeather()
+		var retry *RetryError
+		if !errors.As(err, &retry) {
+			t.Fatalf("attempt %d: err = %v, want a retry", i+1, err)
+		}
+		if retry.Wait != want {
+			t.Errorf("attempt %d: wait = %s, want %s", i+1, retry.Wait, want)
+		}
+		if elapsed := time.Since(start); elapsed > defaultBackoff/2 {
+			t.Errorf("attempt %d took %s, it should not wait", i+1, elapsed)
+		}
+	}
+	if _, err := w.GetCurrentWeather(); err != nil {
+		t.Fatal(err)
+	}
+	if obs, ok := w.LastObservation(); !ok || obs.Result.Name != "Townsville" {
+		t.Errorf("last observation = %+v, %t", obs, ok)
+	}
+}
+
+// Once the retries run out the error is final, and the next fetch starts over
+func TestRetriesExhausted(t *testing.T) {
+	server := flakyServer(t, 3)
+	w := WeatherInit(config.OpenWeatherMapConfig{URL: server.URL, MaxRetries: 2})
+
+	var retry *RetryError
+	for i := 0; i < 2; i++ {
+		if _, err := w.GetCurrentWeather(); !errors.As(err, &retry) {
+			t.Fatalf("attempt %d: err = %v, want a retry", i+1, err)
+		}
+	}
+	_, err := w.GetCurrentWeather()
+	if err == nil || errors.As(err, &retry) {
+		t.Fatalf("err = %v, want the retries to have run out", err)
+	}
+	if _, err := w.GetCurrentWeather(); err != nil {
+		t.Fatal(err)
+	}
+}